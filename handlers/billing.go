@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"codebuddy2cc/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errorMessageKey gin上下文中记录错误信息的键，供计费记录读取
+const errorMessageKey = "codebuddy2cc_error_message"
+
+// billingRecord 单个请求的计费对账记录，在请求结束时（含错误路径）输出一行JSON
+type billingRecord struct {
+	Timestamp                string `json:"timestamp"`
+	RequestID                string `json:"request_id"`
+	UserID                   string `json:"user_id,omitempty"`
+	Model                    string `json:"model"`
+	UpstreamModel            string `json:"upstream_model,omitempty"`
+	Stream                   bool   `json:"stream"`
+	InputTokens              int    `json:"input_tokens"`
+	OutputTokens             int    `json:"output_tokens"`
+	CacheCreationInputTokens int    `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int    `json:"cache_read_input_tokens"`
+	StopReason               string `json:"stop_reason,omitempty"`
+	DurationMs               int64  `json:"duration_ms"`
+	Status                   int    `json:"status"`
+	Success                  bool   `json:"success"`
+	Error                    string `json:"error,omitempty"`
+
+	start time.Time
+}
+
+var (
+	billingSinkOnce sync.Once
+	billingSinkMu   sync.Mutex
+	billingSink     io.Writer
+)
+
+// billingWriter 按 CODEBUDDY2CC_BILLING_LOG 打开计费记录输出目标（stdout、stderr或文件路径），未配置时返回nil
+func billingWriter() io.Writer {
+	billingSinkOnce.Do(func() {
+		target := strings.TrimSpace(os.Getenv("CODEBUDDY2CC_BILLING_LOG"))
+		switch target {
+		case "":
+			return
+		case "stdout":
+			billingSink = os.Stdout
+		case "stderr":
+			billingSink = os.Stderr
+		default:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				log.Printf("Warning: failed to open billing log %s: %v", target, err)
+				return
+			}
+			billingSink = f
+		}
+	})
+	return billingSink
+}
+
+// newBillingRecord 创建请求的计费记录并开始计时
+func newBillingRecord(requestID string) *billingRecord {
+	return &billingRecord{RequestID: requestID, start: time.Now()}
+}
+
+// setResult 填充响应结果中的token用量与停止原因
+func (r *billingRecord) setResult(data *ResponseData) {
+	if data == nil {
+		return
+	}
+	r.StopReason = data.StopReason
+	if data.Usage != nil {
+		r.InputTokens = data.Usage.InputTokens
+		r.OutputTokens = data.Usage.OutputTokens
+		r.CacheCreationInputTokens = data.Usage.CacheCreationInputTokens
+		r.CacheReadInputTokens = data.Usage.CacheReadInputTokens
+	}
+}
+
+// emit 在请求结束时输出计费记录，未配置输出目标时不做任何事
+func (r *billingRecord) emit(c *gin.Context) {
+	w := billingWriter()
+	if w == nil {
+		return
+	}
+
+	r.Timestamp = utils.GetCurrentTimestamp()
+	r.DurationMs = time.Since(r.start).Milliseconds()
+	r.Status = c.Writer.Status()
+	if r.Error == "" {
+		r.Error = c.GetString(errorMessageKey)
+	}
+	r.Success = r.Error == "" && r.Status < http.StatusBadRequest
+
+	line, err := utils.FastMarshal(r)
+	if err != nil {
+		log.Printf("Warning: failed to encode billing record for %s: %v", r.RequestID, err)
+		return
+	}
+
+	billingSinkMu.Lock()
+	defer billingSinkMu.Unlock()
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		log.Printf("Warning: failed to write billing record for %s: %v", r.RequestID, err)
+	}
+}
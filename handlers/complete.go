@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"bytes"
+	"codebuddy2cc/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LegacyCompleteRequest 旧版Text Completions API（/v1/complete）请求
+type LegacyCompleteRequest struct {
+	Model             string                 `json:"model"`
+	Prompt            string                 `json:"prompt"`
+	MaxTokensToSample *int                   `json:"max_tokens_to_sample"`
+	StopSequences     []string               `json:"stop_sequences,omitempty"`
+	Temperature       *float64               `json:"temperature,omitempty"`
+	TopP              *float64               `json:"top_p,omitempty"`
+	TopK              *int                   `json:"top_k,omitempty"`
+	Stream            bool                   `json:"stream,omitempty"`
+	Metadata          *utils.RequestMetadata `json:"metadata,omitempty"`
+}
+
+// LegacyCompleteResponse 旧版Text Completions API响应（流式时每个completion事件的data也使用该结构）
+type LegacyCompleteResponse struct {
+	Type       string  `json:"type"`
+	ID         string  `json:"id,omitempty"`
+	Completion string  `json:"completion"`
+	StopReason *string `json:"stop_reason"`
+	Stop       *string `json:"stop,omitempty"` // 命中的停止序列
+	Model      string  `json:"model"`
+}
+
+// 旧版prompt的轮次标记
+const (
+	legacyHumanMarker     = "\n\nHuman:"
+	legacyAssistantMarker = "\n\nAssistant:"
+)
+
+// legacyPrompt 将旧版 "\n\nHuman: ...\n\nAssistant: ..." 格式的prompt拆分为交替的user/assistant消息
+// 首个Human标记前的文本作为system提示词；末尾空的Assistant轮次是生成位置，不作为消息；
+// 相邻的同角色轮次合并，没有任何轮次标记时整个prompt作为单条user消息
+func legacyPrompt(prompt string) (string, []utils.Message) {
+	text := "\n\n" + strings.TrimLeft(prompt, " \t\r\n")
+	var system string
+	var messages []utils.Message
+	role := ""
+	for {
+		next, nextRole, markerLen := len(text), "", 0
+		if i := strings.Index(text, legacyHumanMarker); i >= 0 {
+			next, nextRole, markerLen = i, "user", len(legacyHumanMarker)
+		}
+		if i := strings.Index(text, legacyAssistantMarker); i >= 0 && i < next {
+			next, nextRole, markerLen = i, "assistant", len(legacyAssistantMarker)
+		}
+
+		turn := strings.TrimSpace(text[:next])
+		switch {
+		case turn == "":
+		case role == "":
+			system = turn
+		case len(messages) > 0 && messages[len(messages)-1].Role == role:
+			last := &messages[len(messages)-1]
+			last.Content = last.Content.(string) + "\n\n" + turn
+		default:
+			messages = append(messages, utils.Message{Role: role, Content: turn})
+		}
+
+		if nextRole == "" {
+			break
+		}
+		role, text = nextRole, text[next+markerLen:]
+	}
+
+	if len(messages) == 0 {
+		return "", []utils.Message{{Role: "user", Content: strings.TrimSpace(prompt)}}
+	}
+	return system, messages
+}
+
+// legacyStopReason 将Messages API的stop_reason映射为旧版取值（stop_sequence / max_tokens）
+func legacyStopReason(stopReason string) string {
+	switch stopReason {
+	case "", "end_turn", "stop_sequence":
+		return "stop_sequence"
+	default:
+		return stopReason
+	}
+}
+
+// legacyCompleteWriter 将MessagesHandler输出的Messages API响应转换为旧版Text Completions格式
+// 流式响应逐个事件转换：text_delta转换为completion事件，message_stop前输出携带stop_reason的最终事件；
+// 非流式响应缓冲后整体转换，错误响应原样输出
+type legacyCompleteWriter struct {
+	gin.ResponseWriter
+	status       int
+	buf          bytes.Buffer
+	messageID    string
+	model        string
+	stopReason   string
+	stopSequence *string
+}
+
+func newLegacyCompleteWriter(base gin.ResponseWriter) *legacyCompleteWriter {
+	return &legacyCompleteWriter{ResponseWriter: base, status: http.StatusOK}
+}
+
+func (w *legacyCompleteWriter) isStream() bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+}
+
+func (w *legacyCompleteWriter) WriteHeader(code int) {
+	w.status = code
+	if w.isStream() {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *legacyCompleteWriter) WriteHeaderNow() {
+	if w.isStream() {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *legacyCompleteWriter) Write(data []byte) (int, error) {
+	n, _ := w.buf.Write(data)
+	if w.isStream() {
+		if err := w.flushEvents(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (w *legacyCompleteWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *legacyCompleteWriter) Flush() {
+	if w.isStream() {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// flushEvents 转换并输出缓冲区中所有完整的SSE事件
+func (w *legacyCompleteWriter) flushEvents() error {
+	for {
+		end := bytes.Index(w.buf.Bytes(), []byte("\n\n"))
+		if end < 0 {
+			return nil
+		}
+		block := string(w.buf.Next(end + 2))
+
+		var eventType, data string
+		for line := range strings.SplitSeq(block, "\n") {
+			if value, ok := strings.CutPrefix(line, "event:"); ok {
+				eventType = strings.TrimSpace(value)
+			} else if value, ok := strings.CutPrefix(line, "data:"); ok {
+				data = strings.TrimSpace(value)
+			}
+		}
+
+		if out := w.convertEvent(eventType, data); out != "" {
+			if _, err := w.ResponseWriter.WriteString(out); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// convertEvent 将单个Messages API事件转换为旧版事件，无对应事件时返回空字符串
+func (w *legacyCompleteWriter) convertEvent(eventType, data string) string {
+	var event struct {
+		Message struct {
+			ID    string `json:"id"`
+			Model string `json:"model"`
+		} `json:"message"`
+		Delta struct {
+			Type         string  `json:"type"`
+			Text         string  `json:"text"`
+			StopReason   string  `json:"stop_reason"`
+			StopSequence *string `json:"stop_sequence"`
+		} `json:"delta"`
+	}
+	if data != "" {
+		utils.FastUnmarshal([]byte(data), &event)
+	}
+
+	switch eventType {
+	case utils.SSEEventMessageStart:
+		w.messageID, w.model = event.Message.ID, event.Message.Model
+	case utils.SSEEventContentBlockDelta:
+		if event.Delta.Type == "text_delta" && event.Delta.Text != "" {
+			return w.completionEvent(LegacyCompleteResponse{Completion: event.Delta.Text})
+		}
+	case utils.SSEEventMessageDelta:
+		w.stopReason, w.stopSequence = event.Delta.StopReason, event.Delta.StopSequence
+	case utils.SSEEventMessageStop:
+		stopReason := legacyStopReason(w.stopReason)
+		return w.completionEvent(LegacyCompleteResponse{StopReason: &stopReason, Stop: w.stopSequence})
+	case "ping", "error":
+		return fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, data)
+	}
+	return ""
+}
+
+// completionEvent 格式化旧版completion事件
+func (w *legacyCompleteWriter) completionEvent(resp LegacyCompleteResponse) string {
+	resp.Type = "completion"
+	resp.ID = w.messageID
+	resp.Model = w.model
+	payload, err := utils.FastMarshal(resp)
+	if err != nil {
+		utils.DebugLog("Failed to marshal legacy completion event: %v", err)
+		return utils.NewAnthropicSSEFormatter().FormatError("api_error", fmt.Sprintf("Failed to build completion event: %v", err))
+	}
+	return fmt.Sprintf("event: completion\ndata: %s\n\n", payload)
+}
+
+// finish 请求结束时输出非流式响应：成功的message转换为旧版格式，其余（错误等）原样输出
+func (w *legacyCompleteWriter) finish() {
+	if w.isStream() {
+		return
+	}
+
+	var message utils.AnthropicResponse
+	if w.status != http.StatusOK || utils.FastUnmarshal(w.buf.Bytes(), &message) != nil || message.Type != "message" {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.buf.Bytes())
+		return
+	}
+
+	var completion strings.Builder
+	for _, block := range message.Content {
+		if block.Type == "text" {
+			completion.WriteString(block.Text)
+		}
+	}
+	stopReason := "stop_sequence"
+	if message.StopReason != nil {
+		stopReason = legacyStopReason(*message.StopReason)
+	}
+
+	payload, err := utils.FastMarshal(LegacyCompleteResponse{
+		Type:       "completion",
+		ID:         message.ID,
+		Completion: completion.String(),
+		StopReason: &stopReason,
+		Stop:       message.StopSequence,
+		Model:      message.Model,
+	})
+	if err != nil {
+		w.writeError(fmt.Sprintf("Failed to build completion response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+	w.ResponseWriter.Write(payload)
+}
+
+// writeError 非流式响应转换失败时输出Anthropic格式的错误响应
+func (w *legacyCompleteWriter) writeError(message string) {
+	payload, _ := utils.FastMarshal(newAnthropicError(http.StatusInternalServerError, "", message))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+	w.ResponseWriter.Write(payload)
+}
+
+// CompleteHandler 处理旧版 /v1/complete 请求：prompt按轮次拆分为消息后复用MessagesHandler的转换与上游调用，
+// 响应再转换回旧版 completion 格式（stream为true时输出旧版SSE事件）
+func CompleteHandler(c *gin.Context) {
+	var legacy LegacyCompleteRequest
+	limitRequestBody(c)
+	if err := c.ShouldBindJSON(&legacy); err != nil {
+		writeBindError(c, err)
+		return
+	}
+	if strings.TrimSpace(legacy.Prompt) == "" {
+		writeAnthropicError(c, http.StatusBadRequest, "", "prompt: field required")
+		return
+	}
+	if legacy.MaxTokensToSample == nil {
+		writeAnthropicError(c, http.StatusBadRequest, "", "max_tokens_to_sample: field required")
+		return
+	}
+
+	system, messages := legacyPrompt(legacy.Prompt)
+	req := utils.AnthropicRequest{
+		Model:         legacy.Model,
+		Messages:      messages,
+		MaxTokens:     legacy.MaxTokensToSample,
+		StopSequences: legacy.StopSequences,
+		Temperature:   legacy.Temperature,
+		TopP:          legacy.TopP,
+		TopK:          legacy.TopK,
+		Stream:        legacy.Stream,
+		Metadata:      legacy.Metadata,
+	}
+	if system != "" {
+		req.System = system
+	}
+	body, err := utils.FastMarshal(req)
+	if err != nil {
+		writeAnthropicError(c, http.StatusInternalServerError, "", fmt.Sprintf("Failed to build messages request: %v", err))
+		return
+	}
+
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Request.ContentLength = int64(len(body))
+	// 响应需要在代理内转换，不能被压缩；Accept与stream保持一致，避免被resolveClientStream改写
+	c.Request.Header.Del("Accept-Encoding")
+	if legacy.Stream {
+		c.Request.Header.Set("Accept", "text/event-stream")
+	} else {
+		c.Request.Header.Set("Accept", "application/json")
+	}
+
+	original := c.Writer
+	writer := newLegacyCompleteWriter(original)
+	c.Writer = writer
+	MessagesHandler(c)
+	writer.finish()
+	c.Writer = original
+}
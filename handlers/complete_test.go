@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"codebuddy2cc/utils"
+)
+
+func TestLegacyPrompt(t *testing.T) {
+	tests := []struct {
+		name       string
+		prompt     string
+		wantSystem string
+		want       []utils.Message
+	}{
+		{
+			name:   "single turn",
+			prompt: "\n\nHuman: Hello\n\nAssistant:",
+			want:   []utils.Message{{Role: "user", Content: "Hello"}},
+		},
+		{
+			name:   "multi turn",
+			prompt: "\n\nHuman: Hi\n\nAssistant: Hello! How can I help?\n\nHuman: Tell me a joke\n\nAssistant:",
+			want: []utils.Message{
+				{Role: "user", Content: "Hi"},
+				{Role: "assistant", Content: "Hello! How can I help?"},
+				{Role: "user", Content: "Tell me a joke"},
+			},
+		},
+		{
+			name:   "assistant prefill",
+			prompt: "\n\nHuman: List three colors\n\nAssistant: 1.",
+			want: []utils.Message{
+				{Role: "user", Content: "List three colors"},
+				{Role: "assistant", Content: "1."},
+			},
+		},
+		{
+			name:       "text before the first turn is the system prompt",
+			prompt:     "You are terse.\n\nHuman: Hi\n\nAssistant:",
+			wantSystem: "You are terse.",
+			want:       []utils.Message{{Role: "user", Content: "Hi"}},
+		},
+		{
+			name:   "consecutive turns of one role are merged",
+			prompt: "Human: first\n\nHuman: second\n\nAssistant:",
+			want:   []utils.Message{{Role: "user", Content: "first\n\nsecond"}},
+		},
+		{
+			name:   "no markers",
+			prompt: "  just a question  ",
+			want:   []utils.Message{{Role: "user", Content: "just a question"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			system, messages := legacyPrompt(tt.prompt)
+			if system != tt.wantSystem {
+				t.Fatalf("system = %q, want %q", system, tt.wantSystem)
+			}
+			if !reflect.DeepEqual(messages, tt.want) {
+				t.Fatalf("messages = %+v, want %+v", messages, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompleteHandlerMultiTurnPrompt(t *testing.T) {
+	upstream := startFakeUpstream(t, upstreamSSE(upstreamChunk(t, textDelta("Why did the gopher cross the road?"), ""), upstreamChunk(t, nil, "stop"), "[DONE]"))
+
+	body := `{"model":"test-model","max_tokens_to_sample":32,` +
+		`"prompt":"\n\nHuman: Hi\n\nAssistant: Hello!\n\nHuman: Tell me a joke\n\nAssistant:"}`
+	c, recorder := newTestContext(http.MethodPost, "/v1/complete", body)
+	CompleteHandler(c)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", recorder.Code, recorder.Body.String())
+	}
+	var completion LegacyCompleteResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &completion); err != nil {
+		t.Fatalf("decode completion: %v", err)
+	}
+	if completion.Type != "completion" || completion.Completion != "Why did the gopher cross the road?" ||
+		completion.StopReason == nil || *completion.StopReason != "stop_sequence" {
+		t.Fatalf("completion = %+v", completion)
+	}
+
+	_, payload := upstream.upstreamRequest(t, 0)
+	var turns []string
+	for _, msg := range payload.Messages {
+		if msg.Role == "system" {
+			continue
+		}
+		text, _ := msg.Content.(string)
+		if blocks, ok := msg.Content.([]any); ok {
+			var b strings.Builder
+			for _, block := range blocks {
+				if m, ok := block.(map[string]any); ok {
+					s, _ := m["text"].(string)
+					b.WriteString(s)
+				}
+			}
+			text = b.String()
+		}
+		turns = append(turns, msg.Role+": "+text)
+	}
+	want := []string{"user: Hi", "assistant: Hello!", "user: Tell me a joke"}
+	if !reflect.DeepEqual(turns, want) {
+		t.Fatalf("upstream turns = %q, want %q", turns, want)
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+
+	"codebuddy2cc/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultGzipMinBytes 默认压缩阈值，小于该大小的响应压缩收益有限，直接原样输出
+const defaultGzipMinBytes = 1024
+
+// gzipMinBytes 非流式响应启用gzip的最小字节数，CODEBUDDY2CC_GZIP_MIN_BYTES=0 时禁用压缩
+func gzipMinBytes() int {
+	return utils.EnvInt("CODEBUDDY2CC_GZIP_MIN_BYTES", defaultGzipMinBytes)
+}
+
+// acceptsGzip 检查客户端Accept-Encoding是否接受gzip（q=0表示明确拒绝）
+func acceptsGzip(c *gin.Context) bool {
+	for part := range strings.SplitSeq(c.GetHeader("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// writeCompressibleJSON 输出JSON响应，客户端接受gzip且响应达到阈值时压缩输出
+// 仅用于非流式响应：SSE流压缩后会被缓冲，破坏实时刷新
+func writeCompressibleJSON(c *gin.Context, status int, obj any) {
+	minBytes := gzipMinBytes()
+	if minBytes <= 0 || !acceptsGzip(c) {
+		c.JSON(status, obj)
+		return
+	}
+
+	// 使用仓库统一的sonic编码；与c.JSON的差异仅在于不转义HTML字符，JSON语义等价
+	body, err := utils.FastMarshal(obj)
+	if err != nil {
+		c.JSON(status, obj)
+		return
+	}
+
+	c.Header("Vary", "Accept-Encoding")
+	if len(body) < minBytes {
+		c.Data(status, "application/json; charset=utf-8", body)
+		return
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil || zw.Close() != nil {
+		c.Data(status, "application/json; charset=utf-8", body)
+		return
+	}
+
+	c.Header("Content-Encoding", "gzip")
+	c.Data(status, "application/json; charset=utf-8", buf.Bytes())
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+
+	"codebuddy2cc/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConfigCheckHandler 处理 /service/config-check：重新读取并校验model.json，不影响当前生效的映射
+// 校验通过返回200，存在错误返回422，便于在发送SIGHUP前用脚本检查配置
+func ConfigCheckHandler(c *gin.Context) {
+	report := utils.CheckModelMapping()
+	status := http.StatusOK
+	if !report.Valid {
+		status = http.StatusUnprocessableEntity
+	}
+	c.JSON(status, report)
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"codebuddy2cc/utils"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DebugConvertHandler 处理 POST /v1/debug/convert：只执行请求转换并返回将发往上游的OpenAI请求，不调用上游
+// 仅在DEBUG模式下可用（运行时检查，SIGHUP重新加载配置后立即生效），否则返回404
+func DebugConvertHandler(c *gin.Context) {
+	if !utils.IsDebugEnabled() {
+		writeAnthropicError(c, http.StatusNotFound, "", "debug endpoints are only available when DEBUG is enabled")
+		return
+	}
+
+	requestID := generateRequestID()
+	ctx := utils.WithRequestID(c.Request.Context(), requestID)
+	c.Set(utils.RequestIDKey, requestID)
+	c.Header(requestIDHeader, requestID)
+
+	var req utils.AnthropicRequest
+	limitRequestBody(c)
+	if err := bindMessagesRequest(c, &req); err != nil {
+		writeBindError(c, err)
+		return
+	}
+
+	if err := utils.ValidateAndFixToolResults(ctx, &req); err != nil {
+		writeAnthropicError(c, http.StatusBadRequest, "", fmt.Sprintf("Tool results validation failed: %v", err))
+		return
+	}
+
+	// 与MessagesHandler一致：上游始终使用流式
+	req.Stream = true
+
+	openAIReq, err := utils.ConvertAnthropicToOpenAI(ctx, &req)
+	if err != nil {
+		writeAnthropicError(c, http.StatusBadRequest, "", fmt.Sprintf("Request conversion failed: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, openAIReq)
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"codebuddy2cc/utils"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AnthropicErrorDetail Anthropic错误详情
+type AnthropicErrorDetail struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// AnthropicError Anthropic格式的错误响应
+type AnthropicError struct {
+	Type  string               `json:"type"`
+	Error AnthropicErrorDetail `json:"error"`
+	// RequestID 上游响应携带的请求ID，便于与上游日志关联
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// upstreamRequestIDKey gin上下文中保存上游响应请求ID的键
+const upstreamRequestIDKey = "codebuddy2cc_upstream_request_id"
+
+// upstreamRequestIDHeader 成功响应中回传上游请求ID的响应头
+const upstreamRequestIDHeader = "X-Upstream-Request-Id"
+
+// requestIDHeader 回传代理内部请求ID的响应头
+const requestIDHeader = "X-Request-Id"
+
+// upstreamRequestID 读取上游响应的请求ID（X-Request-Id 或 Request-Id）
+func upstreamRequestID(resp *http.Response) string {
+	if id := resp.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return resp.Header.Get("Request-Id")
+}
+
+// recordUpstreamRequestID 记录上游请求ID并写入响应头，之后输出的错误响应也会携带该ID
+func recordUpstreamRequestID(c *gin.Context, resp *http.Response) {
+	id := upstreamRequestID(resp)
+	if id == "" {
+		return
+	}
+	c.Set(upstreamRequestIDKey, id)
+	c.Header(upstreamRequestIDHeader, id)
+}
+
+// anthropicErrorType 将HTTP状态码映射为Anthropic错误类型
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case 529:
+		return "overloaded_error"
+	default:
+		if status >= 400 && status < 500 {
+			return "invalid_request_error"
+		}
+		return "api_error"
+	}
+}
+
+// newAnthropicError 构建Anthropic错误对象，errType为空时按状态码推断
+func newAnthropicError(status int, errType, message string) AnthropicError {
+	if errType == "" {
+		errType = anthropicErrorType(status)
+	}
+	return AnthropicError{
+		Type:  "error",
+		Error: AnthropicErrorDetail{Type: errType, Message: message},
+	}
+}
+
+// writeAnthropicError 输出Anthropic格式的错误响应，errType为空时按状态码推断
+func writeAnthropicError(c *gin.Context, status int, errType, message string) {
+	c.Set(errorMessageKey, message)
+	apiErr := newAnthropicError(status, errType, message)
+	apiErr.RequestID = c.GetString(upstreamRequestIDKey)
+	c.JSON(status, apiErr)
+}
+
+// writeAnthropicStreamError 以SSE error事件输出错误，用于流式客户端
+// 流式客户端期望event-stream响应，因此以200状态返回单个error事件后结束流
+func writeAnthropicStreamError(c *gin.Context, status int, errType, message string) {
+	c.Set(errorMessageKey, message)
+	flusher, ok := prepareStreamWriter(c)
+	if !ok {
+		return
+	}
+
+	apiErr := newAnthropicError(status, errType, message)
+	apiErr.RequestID = c.GetString(upstreamRequestIDKey)
+	c.Status(http.StatusOK)
+	c.Writer.WriteString(utils.NewAnthropicSSEFormatter().FormatSSEEvent(utils.SSEEventError, apiErr))
+	flusher.Flush()
+}
+
+// upstreamErrorMessage 从上游错误响应体中提取可读的错误信息
+func upstreamErrorMessage(status int, body []byte) string {
+	var parsed map[string]any
+	if utils.FastUnmarshal(body, &parsed) == nil {
+		if errObj, ok := parsed["error"].(map[string]any); ok {
+			if msg, ok := errObj["message"].(string); ok && msg != "" {
+				return msg
+			}
+		}
+		if msg, ok := parsed["error"].(string); ok && msg != "" {
+			return msg
+		}
+		if msg, ok := parsed["message"].(string); ok && msg != "" {
+			return msg
+		}
+	}
+
+	if text := strings.TrimSpace(string(body)); text != "" {
+		return text
+	}
+	return http.StatusText(status)
+}
+
+// limitRequestBody 按 CODEBUDDY2CC_MAX_BODY_BYTES 限制请求体读取量，需在绑定请求体之前调用
+func limitRequestBody(c *gin.Context) {
+	if limit := utils.MaxRequestBodyBytes(); limit > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	}
+}
+
+// writeBindError 输出请求体绑定失败的错误，超过大小上限时返回413
+func writeBindError(c *gin.Context, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		writeAnthropicError(c, http.StatusRequestEntityTooLarge, "", fmt.Sprintf("Request body exceeds the maximum size of %d bytes", maxErr.Limit))
+		return
+	}
+	writeAnthropicError(c, http.StatusBadRequest, "", fmt.Sprintf("Invalid request format: %v", err))
+}
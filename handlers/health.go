@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"codebuddy2cc/utils"
+)
+
+const (
+	// upstreamHealthTimeout 深度健康检查探测上游的超时时间
+	upstreamHealthTimeout = 3 * time.Second
+	// upstreamHealthCacheTTL 探测结果缓存时间，避免频繁轮询时打满上游
+	upstreamHealthCacheTTL = 5 * time.Second
+)
+
+// UpstreamHealth 上游可达性探测结果
+type UpstreamHealth struct {
+	Reachable bool
+	Latency   time.Duration
+	CheckedAt time.Time
+}
+
+var (
+	upstreamHealthMu    sync.Mutex
+	upstreamHealthCache *UpstreamHealth
+)
+
+// CheckUpstreamHealth 探测上游是否可达，结果缓存upstreamHealthCacheTTL
+// 只要上游返回任意HTTP响应（包括401/405）即视为可达，仅网络错误或超时视为不可达
+func CheckUpstreamHealth(ctx context.Context) UpstreamHealth {
+	upstreamHealthMu.Lock()
+	defer upstreamHealthMu.Unlock()
+
+	if upstreamHealthCache != nil && time.Since(upstreamHealthCache.CheckedAt) < upstreamHealthCacheTTL {
+		return *upstreamHealthCache
+	}
+
+	result := probeUpstream(ctx)
+	upstreamHealthCache = &result
+	return result
+}
+
+// probeUpstream 向上游地址发送HEAD请求测量往返耗时
+func probeUpstream(ctx context.Context) UpstreamHealth {
+	start := time.Now()
+
+	// mock上游模式下不发起真实网络请求
+	if mockUpstreamEnabled() {
+		return UpstreamHealth{Reachable: true, CheckedAt: start}
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, upstreamHealthTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(probeCtx, http.MethodHead, upstreamURL(), nil)
+	if err != nil {
+		utils.DebugLog("[Health] Failed to create upstream probe request: %v", err)
+		return UpstreamHealth{CheckedAt: start}
+	}
+
+	resp, err := (&http.Client{Timeout: upstreamHealthTimeout}).Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		utils.DebugLog("[Health] Upstream probe failed after %s: %v", latency, err)
+		return UpstreamHealth{Latency: latency, CheckedAt: start}
+	}
+	resp.Body.Close()
+
+	utils.DebugLog("[Health] Upstream probe status %d in %s", resp.StatusCode, latency)
+	return UpstreamHealth{Reachable: true, Latency: latency, CheckedAt: start}
+}
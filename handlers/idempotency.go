@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+
+	"codebuddy2cc/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotencyKeyHeader 客户端重试同一请求时携带的幂等键
+const idempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	// defaultIdempotencyTTL 已完成响应的默认缓存时间（秒）
+	defaultIdempotencyTTL = 300
+	// defaultIdempotencyMaxEntries 默认最多缓存的响应数
+	defaultIdempotencyMaxEntries = 1000
+)
+
+// idempotencyEntry 单个幂等键缓存的已完成响应
+type idempotencyEntry struct {
+	key       string
+	bodyHash  [sha256.Size]byte // 转换后上游请求体的摘要，同一键对应不同请求时拒绝复用
+	data      *ResponseData
+	expiresAt time.Time
+}
+
+// idempotencyCache 有界的幂等响应缓存，按写入顺序淘汰最早的条目
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // 元素为*idempotencyEntry，队首最早写入
+}
+
+var idempotentResponses = &idempotencyCache{entries: make(map[string]*list.Element), order: list.New()}
+
+// idempotencyTTL 幂等缓存时间，CODEBUDDY2CC_IDEMPOTENCY_TTL=0 时禁用
+func idempotencyTTL() time.Duration {
+	return time.Duration(utils.EnvInt("CODEBUDDY2CC_IDEMPOTENCY_TTL", defaultIdempotencyTTL)) * time.Second
+}
+
+// idempotencyMaxEntries 幂等缓存容量上限
+func idempotencyMaxEntries() int {
+	return utils.EnvInt("CODEBUDDY2CC_IDEMPOTENCY_MAX_ENTRIES", defaultIdempotencyMaxEntries)
+}
+
+// idempotencyKey 返回请求的幂等键，未携带或功能禁用时返回空字符串
+func idempotencyKey(c *gin.Context) string {
+	if idempotencyTTL() <= 0 || idempotencyMaxEntries() <= 0 {
+		return ""
+	}
+	return strings.TrimSpace(c.GetHeader(idempotencyKeyHeader))
+}
+
+// get 查找未过期的缓存响应；mismatch为true表示该键已用于不同的请求体
+func (ic *idempotencyCache) get(key string, reqBody []byte) (data *ResponseData, mismatch bool) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	elem, ok := ic.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*idempotencyEntry)
+	if time.Now().After(entry.expiresAt) {
+		ic.remove(elem)
+		return nil, false
+	}
+	if entry.bodyHash != sha256.Sum256(reqBody) {
+		return nil, true
+	}
+	return entry.data, false
+}
+
+// put 缓存已完成的响应，超出容量时先清理过期条目，仍不足则淘汰最早的条目
+func (ic *idempotencyCache) put(key string, reqBody []byte, data *ResponseData) {
+	ttl, limit := idempotencyTTL(), idempotencyMaxEntries()
+	if ttl <= 0 || limit <= 0 {
+		return
+	}
+
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if elem, ok := ic.entries[key]; ok {
+		ic.remove(elem)
+	}
+
+	now := time.Now()
+	if ic.order.Len() >= limit {
+		for elem := ic.order.Front(); elem != nil; {
+			next := elem.Next()
+			if now.After(elem.Value.(*idempotencyEntry).expiresAt) {
+				ic.remove(elem)
+			}
+			elem = next
+		}
+	}
+	for ic.order.Len() >= limit {
+		ic.remove(ic.order.Front())
+	}
+
+	entry := &idempotencyEntry{key: key, bodyHash: sha256.Sum256(reqBody), data: data, expiresAt: now.Add(ttl)}
+	ic.entries[key] = ic.order.PushBack(entry)
+}
+
+// remove 删除缓存条目（调用方持有锁）
+func (ic *idempotencyCache) remove(elem *list.Element) {
+	delete(ic.entries, elem.Value.(*idempotencyEntry).key)
+	ic.order.Remove(elem)
+}
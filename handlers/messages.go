@@ -2,21 +2,27 @@ package handlers
 
 import (
 	"bytes"
+	"codebuddy2cc/middleware"
 	"codebuddy2cc/utils"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // getGoroutineID 获取当前goroutine的ID（仅用于调试）
@@ -40,11 +46,15 @@ func getGoroutineID() uint64 {
 type SSEStreamState struct {
 	messageStartSent    bool
 	contentBlockStarted bool
+	blockType           string // 当前打开的内容块类型
 	streamFinished      bool
 	messageID           string
 	messageModel        string
 	currentBlockIndex   int
 	toolCallsActive     bool
+	toolUseBlocks       int     // 已开启的tool_use块数量
+	stopSequence        *string // 命中的停止序列，在message_delta中输出
+	requestID           string  // 所属请求ID，用于关联调试日志
 
 	// 🔧 新增：事件序列管理和验证
 	eventHistory      []string                 // 已发送的事件历史
@@ -53,13 +63,20 @@ type SSEStreamState struct {
 	lastEventTime     time.Time                // 最后事件时间
 	errorCount        int                      // 错误计数
 
+	// 🔧 增量事件合并刷新：累积flushEvery个增量或距上次刷新超过flushInterval时才刷新，块边界与流结束时立即刷新
+	flushEvery    int
+	flushInterval time.Duration
+	pendingDeltas int // 已写入但尚未刷新的增量事件数
+	lastFlush     time.Time
+
 	// 🔧 性能优化：移除mutex，因为单请求单goroutine访问模式
 }
 
 // NewSSEStreamState 创建新的增强SSE流状态管理器
 // 🔧 核心修复：初始化事件序列验证功能
-func NewSSEStreamState() *SSEStreamState {
+func NewSSEStreamState(requestID string) *SSEStreamState {
 	return &SSEStreamState{
+		requestID:           requestID,
 		messageStartSent:    false,
 		contentBlockStarted: false,
 		streamFinished:      false,
@@ -74,12 +91,59 @@ func NewSSEStreamState() *SSEStreamState {
 		sequenceValidator: utils.NewSSEEventValidator(),
 		lastEventTime:     time.Now(),
 		errorCount:        0,
+
+		flushEvery:    streamFlushEvery(),
+		flushInterval: streamFlushInterval(),
+		lastFlush:     time.Now(),
+	}
+}
+
+// defaultFlushIntervalMs 合并刷新时增量事件最长的缓冲时间（毫秒）
+const defaultFlushIntervalMs = 50
+
+// streamFlushEvery 每累积多少个增量事件刷新一次（CODEBUDDY2CC_FLUSH_EVERY_N），默认1即每个事件立即刷新
+func streamFlushEvery() int {
+	return max(utils.EnvInt("CODEBUDDY2CC_FLUSH_EVERY_N", 1), 1)
+}
+
+// streamFlushInterval 合并刷新时增量事件的最长缓冲时间（CODEBUDDY2CC_FLUSH_INTERVAL_MS）
+func streamFlushInterval() time.Duration {
+	return time.Duration(max(utils.EnvInt("CODEBUDDY2CC_FLUSH_INTERVAL_MS", defaultFlushIntervalMs), 0)) * time.Millisecond
+}
+
+// flush 立即刷新已写入的事件（块边界、message事件等）
+func (s *SSEStreamState) flush(flusher http.Flusher) {
+	flusher.Flush()
+	s.pendingDeltas = 0
+	s.lastFlush = time.Now()
+}
+
+// flushDelta 写入增量事件后调用：达到合并数量或缓冲时间时刷新
+func (s *SSEStreamState) flushDelta(flusher http.Flusher) {
+	s.pendingDeltas++
+	if s.pendingDeltas >= s.flushEvery || time.Since(s.lastFlush) >= s.flushInterval {
+		s.flush(flusher)
+	}
+}
+
+// FlushPending 刷新缓冲中的增量事件（等待上游期间由定时器触发）
+func (s *SSEStreamState) FlushPending(flusher http.Flusher) {
+	if s.pendingDeltas > 0 {
+		s.flush(flusher)
 	}
 }
 
+// pendingFlushTimer 有未刷新的增量事件时返回在缓冲时间到期时触发的定时器，否则返回nil
+func (s *SSEStreamState) pendingFlushTimer() <-chan time.Time {
+	if s.pendingDeltas == 0 {
+		return nil
+	}
+	return time.After(max(s.flushInterval-time.Since(s.lastFlush), 0))
+}
+
 // EnsureMessageStart 确保message_start事件已发送，如果未发送则发送
 // 🔧 性能优化：移除mutex操作，因为单goroutine顺序访问
-func (s *SSEStreamState) EnsureMessageStart(c *gin.Context, flusher http.Flusher, formatter *utils.AnthropicSSEFormatter, messageID, model string) bool {
+func (s *SSEStreamState) EnsureMessageStart(c *gin.Context, flusher http.Flusher, formatter *utils.AnthropicSSEFormatter, messageID, model string, usage *utils.Usage) bool {
 	if s.messageStartSent {
 		return false // 已发送，无需重复
 	}
@@ -96,38 +160,58 @@ func (s *SSEStreamState) EnsureMessageStart(c *gin.Context, flusher http.Flusher
 
 	// 🔧 核心修复：在发送事件前记录到历史
 	if err := s.recordEvent(utils.SSEEventMessageStart); err != nil {
-		utils.DebugLog("[SSEState] Warning: message_start validation failed: %v", err)
+		s.debugLog("[SSEState] Warning: message_start validation failed: %v", err)
 	}
 
-	startEvent := formatter.FormatMessageStart(messageID, model)
+	// 上游已提供输入用量时在message_start中填充input_tokens，输出用量仍在message_delta中给出
+	startEvent := formatter.FormatMessageStartWithUsage(messageID, model, messageStartUsage(usage))
 	c.Writer.WriteString(startEvent)
-	flusher.Flush()
+	s.flush(flusher)
 
 	s.messageStartSent = true
-	utils.DebugLog("[SSEState] Sent message_start (id: %s, model: %s)", messageID, model)
+	s.debugLog("[SSEState] Sent message_start (id: %s, model: %s)", messageID, model)
 	return true
 }
 
-// EnsureContentBlockStart 确保content_block_start事件已发送（用于文本内容）
+// messageStartUsage 提取message_start中使用的输入侧用量（输入与缓存token），上游尚未提供用量时返回nil
+func messageStartUsage(usage *utils.Usage) *utils.Usage {
+	if usage == nil {
+		return nil
+	}
+	return &utils.Usage{
+		PromptTokens:             usage.PromptTokens,
+		InputTokens:              usage.InputTokens,
+		CacheCreationInputTokens: usage.CacheCreationInputTokens,
+		CacheReadInputTokens:     usage.CacheReadInputTokens,
+	}
+}
+
+// EnsureContentBlockStart 确保content_block_start事件已发送（用于文本和thinking内容）
 // 🔧 核心修复：添加事件记录和验证
 func (s *SSEStreamState) EnsureContentBlockStart(c *gin.Context, flusher http.Flusher, formatter *utils.AnthropicSSEFormatter, blockType string) bool {
 	// 🔧 性能优化：移除mutex操作（单goroutine顺序访问）
 
+	// thinking块之后开始输出其他内容时先关闭thinking块
+	if s.contentBlockStarted && s.blockType == "thinking" && blockType != "thinking" {
+		s.FinishContentBlock(c, flusher, formatter)
+	}
+
 	if s.contentBlockStarted || s.toolCallsActive {
 		return false // 已有活跃的内容块或工具调用
 	}
 
 	// 🔧 核心修复：在发送事件前记录到历史
 	if err := s.recordEvent(utils.SSEEventContentBlockStart); err != nil {
-		utils.DebugLog("[SSEState] Warning: content_block_start validation failed: %v", err)
+		s.debugLog("[SSEState] Warning: content_block_start validation failed: %v", err)
 	}
 
 	startEvent := formatter.FormatContentBlockStart(s.currentBlockIndex, blockType, nil)
 	c.Writer.WriteString(startEvent)
-	flusher.Flush()
+	s.flush(flusher)
 
 	s.contentBlockStarted = true
-	utils.DebugLog("[SSEState] Sent content_block_start (index: %d, type: %s)", s.currentBlockIndex, blockType)
+	s.blockType = blockType
+	s.debugLog("[SSEState] Sent content_block_start (index: %d, type: %s)", s.currentBlockIndex, blockType)
 	return true
 }
 
@@ -142,25 +226,138 @@ func (s *SSEStreamState) FinishContentBlock(c *gin.Context, flusher http.Flusher
 
 	// 🔧 核心修复：在发送事件前记录到历史
 	if err := s.recordEvent(utils.SSEEventContentBlockStop); err != nil {
-		utils.DebugLog("[SSEState] Warning: content_block_stop validation failed: %v", err)
+		s.debugLog("[SSEState] Warning: content_block_stop validation failed: %v", err)
 	}
 
 	stopEvent := formatter.FormatContentBlockStop(s.currentBlockIndex)
 	c.Writer.WriteString(stopEvent)
-	flusher.Flush()
+	s.flush(flusher)
 
 	s.contentBlockStarted = false
 	s.currentBlockIndex++
-	utils.DebugLog("[SSEState] Sent content_block_stop (index: %d)", s.currentBlockIndex-1)
+	s.debugLog("[SSEState] Sent content_block_stop (index: %d)", s.currentBlockIndex-1)
+	return true
+}
+
+// SendTextDelta 在当前文本内容块中发送text_delta事件
+func (s *SSEStreamState) SendTextDelta(c *gin.Context, flusher http.Flusher, formatter *utils.AnthropicSSEFormatter, text string) {
+	if err := s.recordEvent(utils.SSEEventContentBlockDelta); err != nil {
+		s.debugLog("[SSEState] Warning: text delta validation failed: %v", err)
+	}
+
+	deltaEvent := formatter.FormatContentBlockDelta(s.currentBlockIndex, "text_delta", text)
+	c.Writer.WriteString(deltaEvent)
+	s.flushDelta(flusher)
+}
+
+// SendThinkingDelta 在当前thinking内容块中发送thinking_delta事件
+func (s *SSEStreamState) SendThinkingDelta(c *gin.Context, flusher http.Flusher, formatter *utils.AnthropicSSEFormatter, thinking string) {
+	if err := s.recordEvent(utils.SSEEventContentBlockDelta); err != nil {
+		s.debugLog("[SSEState] Warning: thinking delta validation failed: %v", err)
+	}
+
+	deltaEvent := formatter.FormatContentBlockDelta(s.currentBlockIndex, "thinking_delta", thinking)
+	c.Writer.WriteString(deltaEvent)
+	s.flushDelta(flusher)
+}
+
+// SendSignatureDelta 在当前thinking内容块中发送signature_delta事件
+func (s *SSEStreamState) SendSignatureDelta(c *gin.Context, flusher http.Flusher, formatter *utils.AnthropicSSEFormatter, signature string) {
+	if err := s.recordEvent(utils.SSEEventContentBlockDelta); err != nil {
+		s.debugLog("[SSEState] Warning: signature delta validation failed: %v", err)
+	}
+
+	deltaEvent := formatter.FormatContentBlockDelta(s.currentBlockIndex, "signature_delta", signature)
+	c.Writer.WriteString(deltaEvent)
+	s.flushDelta(flusher)
+}
+
+// StartToolUseBlock 以当前索引开启tool_use内容块
+func (s *SSEStreamState) StartToolUseBlock(c *gin.Context, flusher http.Flusher, formatter *utils.AnthropicSSEFormatter, id, name string) {
+	if err := s.recordEvent(utils.SSEEventContentBlockStart); err != nil {
+		s.debugLog("[SSEState] Warning: tool content_block_start validation failed: %v", err)
+	}
+
+	s.contentBlockStarted = true
+	s.blockType = "tool_use"
+	s.toolUseBlocks++
+
+	additional := map[string]any{
+		"id":    id,
+		"name":  name,
+		"input": map[string]any{}, // 🔧 关键修复：添加空的input字段，符合Anthropic规范
+	}
+	startLine := formatter.FormatContentBlockStart(s.currentBlockIndex, "tool_use", additional)
+	s.debugLog("Sending to client[tool-start]: %s", strings.TrimSpace(startLine))
+	c.Writer.WriteString(startLine)
+	s.flush(flusher)
+}
+
+// SendInputJSONDelta 在当前tool_use内容块中发送一个input_json_delta事件
+func (s *SSEStreamState) SendInputJSONDelta(c *gin.Context, flusher http.Flusher, formatter *utils.AnthropicSSEFormatter, partialJSON string) {
+	if err := s.recordEvent(utils.SSEEventContentBlockDelta); err != nil {
+		s.debugLog("[SSEState] Warning: tool json delta validation failed: %v", err)
+	}
+
+	deltaLine := formatter.FormatContentBlockDelta(s.currentBlockIndex, "input_json_delta", partialJSON)
+	s.debugLog("Sending to client[json-delta]: %s", strings.TrimSpace(deltaLine))
+	c.Writer.WriteString(deltaLine)
+	s.flushDelta(flusher)
+}
+
+// WriteToolUseBlock 以当前索引输出完整的tool_use内容块（start、分块input_json_delta、stop）
+func (s *SSEStreamState) WriteToolUseBlock(c *gin.Context, flusher http.Flusher, formatter *utils.AnthropicSSEFormatter, id, name, argsJSON string) {
+	s.StartToolUseBlock(c, flusher, formatter, id, name)
+
+	// 🔧 关键修复：确保JSON字符串是有效的UTF-8编码
+	if !utf8.ValidString(argsJSON) {
+		s.debugLog("Invalid UTF-8 in JSON string, attempting to fix")
+		argsJSON = strings.ToValidUTF8(argsJSON, "\uFFFD")
+	}
+
+	// 🔧 增强：使用UTF-8安全的智能分块算法
+	for _, chunk := range splitUTF8SafeChunks(argsJSON, streamChunkSize) {
+		if chunk != "" {
+			s.SendInputJSONDelta(c, flusher, formatter, chunk)
+		}
+	}
+
+	s.FinishContentBlock(c, flusher, formatter)
+}
+
+// SendPingIfIdle 距上次事件超过interval时发送ping事件
+// ping仅用于保活，不记录到事件序列，也不在流结束后发送
+func (s *SSEStreamState) SendPingIfIdle(c *gin.Context, flusher http.Flusher, formatter *utils.AnthropicSSEFormatter, interval time.Duration) bool {
+	if s.streamFinished || time.Since(s.lastEventTime) < interval {
+		return false
+	}
+
+	s.debugLog("[SSEState] Sending ping (idle: %s)", time.Since(s.lastEventTime).Round(time.Second))
+	return s.SendPing(c, flusher, formatter)
+}
+
+// SendPing 立即发送ping事件（流结束后不再发送），不记录到事件序列
+func (s *SSEStreamState) SendPing(c *gin.Context, flusher http.Flusher, formatter *utils.AnthropicSSEFormatter) bool {
+	if s.streamFinished {
+		return false
+	}
+
+	c.Writer.WriteString(formatter.FormatPing())
+	s.flush(flusher)
 	return true
 }
 
+// SetStopSequence 设置命中的停止序列，结束流时随message_delta输出
+func (s *SSEStreamState) SetStopSequence(stopSequence *string) {
+	s.stopSequence = stopSequence
+}
+
 // ActivateToolCalls 激活工具调用模式
 func (s *SSEStreamState) ActivateToolCalls() {
 	// 🔧 性能优化：移除mutex操作（单goroutine顺序访问）
 
 	s.toolCallsActive = true
-	utils.DebugLog("[SSEState] Activated tool calls mode")
+	s.debugLog("[SSEState] Activated tool calls mode")
 }
 
 // FinishStream 完成整个流（发送message_delta和message_stop）
@@ -181,49 +378,81 @@ func (s *SSEStreamState) FinishStreamWithUsage(c *gin.Context, flusher http.Flus
 	if s.contentBlockStarted {
 		// 🔧 核心修复：记录自动关闭的content_block_stop事件
 		if err := s.recordEvent(utils.SSEEventContentBlockStop); err != nil {
-			utils.DebugLog("[SSEState] Warning: auto content_block_stop validation failed: %v", err)
+			s.debugLog("[SSEState] Warning: auto content_block_stop validation failed: %v", err)
 		}
 		stopEvent := formatter.FormatContentBlockStop(s.currentBlockIndex)
 		c.Writer.WriteString(stopEvent)
 		s.contentBlockStarted = false
-		utils.DebugLog("[SSEState] Auto-closed content block before stream finish")
+		s.debugLog("[SSEState] Auto-closed content block before stream finish")
 	}
 
 	// 🔧 核心修复：记录message_delta事件
 	if err := s.recordEvent(utils.SSEEventMessageDelta); err != nil {
-		utils.DebugLog("[SSEState] Warning: message_delta validation failed: %v", err)
+		s.debugLog("[SSEState] Warning: message_delta validation failed: %v", err)
 	}
 
 	// 🔧 核心修复：发送包含usage信息的message_delta事件
-	deltaEvent := formatter.FormatMessageDelta(stopReason, usage)
+	deltaEvent := formatter.FormatMessageDeltaWithStopSequence(stopReason, s.stopSequence, usage)
 	c.Writer.WriteString(deltaEvent)
-	flusher.Flush()
+	s.flush(flusher)
 
 	// 🔧 核心修复：记录message_stop事件
 	if err := s.recordEvent(utils.SSEEventMessageStop); err != nil {
-		utils.DebugLog("[SSEState] Warning: message_stop validation failed: %v", err)
+		s.debugLog("[SSEState] Warning: message_stop validation failed: %v", err)
 	}
 
 	stopEvent := formatter.FormatMessageStop(nil)
 	c.Writer.WriteString(stopEvent)
-	flusher.Flush()
+	s.flush(flusher)
 
 	s.streamFinished = true
-	utils.DebugLog("[SSEState] Finished stream with reason: %s", stopReason)
+	s.debugLog("[SSEState] Finished stream with reason: %s", stopReason)
 
 	// 🔧 核心新增：最终验证完整序列
 	if s.validationEnabled {
 		if err := s.sequenceValidator.ValidateCompleteSequence(); err != nil {
-			utils.DebugLog("[SSEValidation] Final sequence validation failed: %v", err)
+			s.debugLog("[SSEValidation] Final sequence validation failed: %v", err)
 			s.errorCount++
 		} else {
-			utils.DebugLog("[SSEValidation] Complete sequence validation passed")
+			s.debugLog("[SSEValidation] Complete sequence validation passed")
 		}
 	}
 
 	return true
 }
 
+// AbortWithError 流中途出错时结束流：发送error事件后关闭仍打开的内容块，再以message_delta/message_stop结束
+// 仍打开的块可能含残缺的工具参数，客户端在error事件处即停止解析；已完整输出的内容块保留给客户端
+// message_start尚未发送时只输出error事件
+func (s *SSEStreamState) AbortWithError(c *gin.Context, flusher http.Flusher, formatter *utils.AnthropicSSEFormatter, errType, message, stopReason string, usage *utils.Usage) bool {
+	if s.streamFinished {
+		return false
+	}
+
+	if err := s.recordEvent(utils.SSEEventError); err != nil {
+		s.debugLog("[SSEState] Warning: error event validation failed: %v", err)
+	}
+	c.Writer.WriteString(formatter.FormatError(errType, message))
+	s.flush(flusher)
+	s.debugLog("[SSEState] Aborting stream with error: %s", message)
+
+	s.FinishContentBlock(c, flusher, formatter)
+
+	if !s.messageStartSent {
+		s.streamFinished = true
+		return true
+	}
+	return s.FinishStreamWithUsage(c, flusher, formatter, stopReason, usage)
+}
+
+// debugLog 输出带请求ID前缀的调试日志
+func (s *SSEStreamState) debugLog(format string, args ...any) {
+	if s.requestID != "" {
+		format = "[Request:" + s.requestID + "] " + format
+	}
+	utils.DebugLog(format, args...)
+}
+
 // IsFinished 检查流是否已完成
 func (s *SSEStreamState) IsFinished() bool {
 	// 🔧 性能优化：移除mutex操作（单goroutine顺序访问）
@@ -241,13 +470,13 @@ func (s *SSEStreamState) recordEvent(eventType string) error {
 	if s.validationEnabled && s.sequenceValidator != nil {
 		if err := s.sequenceValidator.ValidateEvent(eventType); err != nil {
 			s.errorCount++
-			utils.DebugLog("[SSEValidation] Event sequence validation failed: %v (event: %s)", err, eventType)
+			s.debugLog("[SSEValidation] Event sequence validation failed: %v (event: %s)", err, eventType)
 			// 不返回错误，只记录，避免中断流
 			return err
 		}
 	}
 
-	utils.DebugLog("[SSESequence] Recorded event: %s (total: %d, errors: %d)",
+	s.debugLog("[SSESequence] Recorded event: %s (total: %d, errors: %d)",
 		eventType, len(s.eventHistory), s.errorCount)
 	return nil
 }
@@ -302,7 +531,7 @@ func (s *SSEStreamState) GetValidationReport() map[string]any {
 func (s *SSEStreamState) EnableValidation(enabled bool) {
 	// 🔧 性能优化：移除mutex操作（单goroutine顺序访问）
 	s.validationEnabled = enabled
-	utils.DebugLog("[SSEValidation] Validation %s",
+	s.debugLog("[SSEValidation] Validation %s",
 		func() string {
 			if enabled {
 				return "enabled"
@@ -312,14 +541,6 @@ func (s *SSEStreamState) EnableValidation(enabled bool) {
 		}())
 }
 
-// 统一工具调用处理器接口（SRP原则）
-type ToolCallProcessor interface {
-	ProcessToolCalls(choice *utils.OpenAIChoice, isStream bool) ToolProcessResult
-	OutputAnthropicFormat(c *gin.Context, flusher http.Flusher) bool
-	ClearSession()
-	GetStats() map[string]int
-}
-
 // DefaultToolCallManager 默认工具调用管理器（统一流式和非流式处理）
 type DefaultToolCallManager struct {
 	session   *ToolCallsSession
@@ -333,7 +554,7 @@ func NewDefaultToolCallManager(requestID string) *DefaultToolCallManager {
 	session := newToolCallsSession(requestID)
 
 	// 🔍 诊断：记录会话创建的详细信息
-	utils.DebugLog("[SessionIsolation] Created isolated session for request: %s (session_id: %s, goroutine: g%d, address: %p)",
+	utils.DebugLog("[Request:%s] [SessionIsolation] Created isolated session (session_id: %s, goroutine: g%d, address: %p)",
 		requestID, session.requestID, getGoroutineID(), session)
 
 	manager := &DefaultToolCallManager{
@@ -342,7 +563,7 @@ func NewDefaultToolCallManager(requestID string) *DefaultToolCallManager {
 	}
 
 	// 🔍 诊断：验证管理器的独立性
-	utils.DebugLog("[SessionIsolation] Manager created - requestID: %s, manager_address: %p, session_address: %p",
+	utils.DebugLog("[Request:%s] [SessionIsolation] Manager created - manager_address: %p, session_address: %p",
 		requestID, manager, session)
 
 	return manager
@@ -353,22 +574,6 @@ func (m *DefaultToolCallManager) ProcessToolCalls(choice *utils.OpenAIChoice, is
 	return m.session.processToolCallsUnified(choice, isStream)
 }
 
-// OutputAnthropicFormat 输出完整的Anthropic格式（包括message_stop）
-func (m *DefaultToolCallManager) OutputAnthropicFormat(c *gin.Context, flusher http.Flusher) bool {
-	return m.session.convertAndOutputAnthropicToolCalls(c, flusher)
-}
-
-// OutputAnthropicToolCallsOnly 只输出工具调用内容，不发送message_stop
-func (m *DefaultToolCallManager) OutputAnthropicToolCallsOnly(c *gin.Context, flusher http.Flusher) bool {
-	return m.session.convertAndOutputAnthropicToolCallsOnly(c, flusher)
-}
-
-// OutputAnthropicToolCallsWithState 只输出工具调用内容，支持事件记录，不发送message_stop
-// 🔧 核心新增：支持SSE事件序列记录的工具调用输出
-func (m *DefaultToolCallManager) OutputAnthropicToolCallsWithState(c *gin.Context, flusher http.Flusher, streamState *SSEStreamState) bool {
-	return m.session.convertAndOutputAnthropicToolCallsWithState(c, flusher, streamState)
-}
-
 // ClearSession 清理会话
 func (m *DefaultToolCallManager) ClearSession() {
 	m.session.clearToolCallsWithLogging()
@@ -387,33 +592,208 @@ func upstreamURL() string {
 	return "https://www.codebuddy.ai/v2/chat/completions"
 }
 
+// upstreamURLForModel 映射后模型的上游地址：优先使用按模型配置的地址，否则回退到全局 upstreamURL()
+func upstreamURLForModel(mappedModel string) string {
+	if url, ok := utils.ModelUpstreamURL(mappedModel); ok {
+		utils.DebugLog("Using per-model upstream for %s: %s", mappedModel, url)
+		return url
+	}
+	return upstreamURL()
+}
+
+// upstreamMethod 上游请求方法，支持通过环境变量覆盖（默认POST）
+func upstreamMethod() string {
+	if v := strings.TrimSpace(os.Getenv("CODEBUDDY2CC_UPSTREAM_METHOD")); v != "" {
+		return strings.ToUpper(v)
+	}
+	return http.MethodPost
+}
+
+// expectContinueDisabled 是否对上游禁用 Expect: 100-continue（部分上游不响应100状态导致请求停顿）
+func expectContinueDisabled() bool {
+	return utils.EnvBool("CODEBUDDY2CC_DISABLE_EXPECT_CONTINUE")
+}
+
+// expectContinueTimeout 上游100-continue等待时间，禁用时为0（立即发送请求体）
+func expectContinueTimeout() time.Duration {
+	if expectContinueDisabled() {
+		return 0
+	}
+	return 1 * time.Second
+}
+
+// defaultUpstreamUserAgent 默认上游User-Agent
+const defaultUpstreamUserAgent = "CLI/1.0.9 CodeBuddy/1.0.9"
+
+// upstreamUserAgent 上游User-Agent，支持通过 CODEBUDDY2CC_USER_AGENT 覆盖
+func upstreamUserAgent() string {
+	if v := strings.TrimSpace(os.Getenv("CODEBUDDY2CC_USER_AGENT")); v != "" {
+		return v
+	}
+	return defaultUpstreamUserAgent
+}
+
+// upstreamStaticHeaders 解析需附加到每个上游请求的静态头部
+// CODEBUDDY2CC_UPSTREAM_HEADERS 格式：Key1=Value1,Key2=Value2
+// CODEBUDDY2CC_EXTRA_HEADERS 格式：key1:val1;key2:val2（同名时覆盖前者）
+func upstreamStaticHeaders() http.Header {
+	headers := make(http.Header)
+	parseHeaderList(headers, os.Getenv("CODEBUDDY2CC_UPSTREAM_HEADERS"), ",", "=")
+	parseHeaderList(headers, os.Getenv("CODEBUDDY2CC_EXTRA_HEADERS"), ";", ":")
+	return headers
+}
+
+// parseHeaderList 按指定分隔符解析头部列表并写入headers，格式错误的条目忽略
+func parseHeaderList(headers http.Header, raw, pairSep, kvSep string) {
+	if strings.TrimSpace(raw) == "" {
+		return
+	}
+
+	for pair := range strings.SplitSeq(raw, pairSep) {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, found := strings.Cut(pair, kvSep)
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			utils.DebugLog("Ignoring malformed upstream header entry: %q", pair)
+			continue
+		}
+		headers.Set(key, strings.TrimSpace(value))
+	}
+}
+
+// resolveClientStream 决定客户端响应是否使用流式，由 CODEBUDDY2CC_STREAM_PRECEDENCE 控制：
+// 默认（body）以请求体stream字段为准；json 时Accept头明确只接受 application/json 则使用非流式，避免向期望JSON的客户端输出SSE；
+// accept 时完全以Accept头为准：包含 text/event-stream 则流式，只接受 application/json 则非流式。
+// 两者不一致时记录日志，便于诊断行为异常的客户端
+func resolveClientStream(c *gin.Context, bodyStream bool) bool {
+	accept := strings.ToLower(c.GetHeader("Accept"))
+	wantsSSE := strings.Contains(accept, "text/event-stream")
+	wantsJSON := strings.Contains(accept, "application/json") && !wantsSSE
+
+	stream := bodyStream
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("CODEBUDDY2CC_STREAM_PRECEDENCE"))) {
+	case "accept":
+		if wantsSSE {
+			stream = true
+		} else if wantsJSON {
+			stream = false
+		}
+	case "json":
+		if wantsJSON {
+			stream = false
+		}
+	}
+
+	if (bodyStream && wantsJSON) || (!bodyStream && wantsSSE) {
+		log.Printf("[Request:%s] Client stream mismatch: body stream=%v, Accept=%q, using stream=%v",
+			c.GetString(utils.RequestIDKey), bodyStream, c.GetHeader("Accept"), stream)
+	}
+	return stream
+}
+
+// cancelOnDisconnect 客户端断开时是否取消上游请求，默认启用；CODEBUDDY2CC_CANCEL_ON_DISCONNECT=false 时关闭
+func cancelOnDisconnect() bool {
+	if strings.TrimSpace(os.Getenv("CODEBUDDY2CC_CANCEL_ON_DISCONNECT")) == "" {
+		return true
+	}
+	return utils.EnvBool("CODEBUDDY2CC_CANCEL_ON_DISCONNECT")
+}
+
+// systemSuffixHeader 按请求覆盖system后缀的请求头
+const systemSuffixHeader = "X-System-Suffix"
+
+// modelOverrideHeader 按请求覆盖客户端model的请求头
+const modelOverrideHeader = "X-Model-Override"
+
+// maxMessages 单个请求允许的最大消息数，0表示不限制
+func maxMessages() int {
+	return utils.EnvInt("CODEBUDDY2CC_MAX_MESSAGES", 0)
+}
+
+// defaultMaxMalformedEvents 默认允许的连续格式异常事件数
+const defaultMaxMalformedEvents = 20
+
+// errMalformedUpstream 上游连续发送过多无法解析的事件
+var errMalformedUpstream = errors.New("upstream sent too many malformed SSE events")
+
 // SSEStreamParser 真正的流式SSE解析器，支持context取消检测
 type SSEStreamParser struct {
 	reader   io.Reader
 	buffer   []byte
 	position int
 	tempBuf  []byte // 重用的临时缓冲区
+
+	// 🔧 格式异常计数：被丢弃的非SSE行和无法解析的data事件
+	// 连续异常超过上限时返回errMalformedUpstream，收到合法事件后重新计数
+	malformed            atomic.Int64
+	consecutiveMalformed int
+	maxMalformed         int // 0表示不限制
 }
 
 // NewSSEStreamParser 创建新的SSE流解析器
 func NewSSEStreamParser(reader io.Reader) *SSEStreamParser {
 	return &SSEStreamParser{
-		reader:   reader,
-		buffer:   make([]byte, 0, 8192),
-		position: 0,
-		tempBuf:  make([]byte, 1024), // 预分配重用缓冲区
+		reader:       reader,
+		buffer:       make([]byte, 0, 8192),
+		position:     0,
+		tempBuf:      make([]byte, 1024), // 预分配重用缓冲区
+		maxMalformed: utils.EnvInt("CODEBUDDY2CC_MAX_MALFORMED_EVENTS", defaultMaxMalformedEvents),
+	}
+}
+
+// MalformedCount 返回已遇到的格式异常事件总数
+func (p *SSEStreamParser) MalformedCount() int {
+	return int(p.malformed.Load())
+}
+
+// recordMalformed 记录一个格式异常事件，连续异常超过上限时返回错误
+func (p *SSEStreamParser) recordMalformed() error {
+	p.malformed.Add(1)
+	p.consecutiveMalformed++
+	if p.maxMalformed > 0 && p.consecutiveMalformed > p.maxMalformed {
+		return errMalformedUpstream
+	}
+	return nil
+}
+
+// checkEvent 检查解析出的事件：data内容不是合法JSON、[DONE]或结束信号时计为格式异常
+// 异常事件仍返回给调用方（如上游的进度通知由调用方按未知事件处理）
+func (p *SSEStreamParser) checkEvent(event string) error {
+	payload, ok := extractUpstreamData(event)
+	if ok && (payload == "[DONE]" || strings.HasPrefix(payload, "finish_reason:") || utils.FastValid([]byte(payload))) {
+		p.consecutiveMalformed = 0
+		return nil
 	}
+	return p.recordMalformed()
+}
+
+// isSSEFieldLine 判断是否为data以外的合法SSE行（event/id/retry字段或注释）
+func isSSEFieldLine(line []byte) bool {
+	return len(line) == 0 || line[0] == ':' ||
+		bytes.HasPrefix(line, []byte("event:")) || bytes.HasPrefix(line, []byte("id:")) || bytes.HasPrefix(line, []byte("retry:"))
 }
 
 // NextEvent 读取下一个完整的SSE事件，支持context取消检测
 func (p *SSEStreamParser) NextEvent(ctx context.Context) (string, error) {
 	for {
 		// 尝试从缓冲区解析完整事件
-		if event, consumed := p.tryParseEvent(); event != "" {
-			// 移除已消费的数据
-			p.buffer = p.buffer[consumed:]
+		event, consumed, err := p.tryParseEvent()
+		if err != nil {
+			return "", err
+		}
+		// 移除已消费的数据
+		p.buffer = p.buffer[consumed:]
+		if event != "" {
+			if err := p.checkEvent(event); err != nil {
+				return "", err
+			}
 			return event, nil
 		}
+		if consumed > 0 {
+			continue // 丢弃了非data行，缓冲区中可能还有完整事件
+		}
 
 		// 🔧 关键修复：检查context状态，提前退出避免无限循环
 		select {
@@ -425,6 +805,11 @@ func (p *SSEStreamParser) NextEvent(ctx context.Context) (string, error) {
 
 		// 需要更多数据，从reader读取（重用预分配缓冲区）
 		n, err := p.reader.Read(p.tempBuf)
+		// 🔧 Read可能在返回最后一段数据的同时返回io.EOF（如带Content-Length的响应体），需先保留数据
+		p.buffer = append(p.buffer, p.tempBuf[:n]...)
+		if n > 0 && err == io.EOF {
+			continue // 先解析缓冲区中的事件，再次读取时reader会继续返回io.EOF
+		}
 		if err != nil {
 			// 🔧 特殊处理：context.Canceled不应产生噪声日志
 			if err == context.Canceled {
@@ -444,23 +829,24 @@ func (p *SSEStreamParser) NextEvent(ctx context.Context) (string, error) {
 					if end > start {
 						event := string(p.buffer[start:end])
 						p.buffer = nil
+						if err := p.checkEvent(event); err != nil {
+							return "", err
+						}
 						return event, nil
 					}
 				}
 			}
 			return "", err
 		}
-
-		// 追加新数据到缓冲区
-		p.buffer = append(p.buffer, p.tempBuf[:n]...)
 	}
 }
 
-// tryParseEvent 尝试从缓冲区解析一个完整的SSE事件
-func (p *SSEStreamParser) tryParseEvent() (string, int) {
+// tryParseEvent 尝试从缓冲区解析一个完整的SSE事件，返回事件和消费的字节数
+// 丢弃的非SSE行计为格式异常，连续异常超过上限时返回错误
+func (p *SSEStreamParser) tryParseEvent() (string, int, error) {
 	data := p.buffer
 	if len(data) == 0 {
-		return "", 0
+		return "", 0, nil
 	}
 
 	// 🎯 优化的SSE事件解析策略，支持更灵活的格式
@@ -470,13 +856,19 @@ func (p *SSEStreamParser) tryParseEvent() (string, int) {
 
 	// 查找 "data: " 开始位置
 	dataStart := bytes.Index(data, []byte("data: "))
-	if dataStart == -1 {
-		// 没有找到data标记，查找纯换行进行清理
-		if newlineIdx := bytes.IndexByte(data, '\n'); newlineIdx != -1 {
-			// 消费到换行符，返回空字符串继续处理
-			return "", newlineIdx + 1
+	if dataStart != 0 {
+		// data标记之前的完整行（空行、event/id字段或无法识别的内容）逐行消费，返回空字符串继续处理
+		if newlineIdx := bytes.IndexByte(data, '\n'); newlineIdx != -1 && (dataStart == -1 || newlineIdx < dataStart) {
+			if !isSSEFieldLine(bytes.TrimSpace(data[:newlineIdx])) {
+				if err := p.recordMalformed(); err != nil {
+					return "", newlineIdx + 1, err
+				}
+			}
+			return "", newlineIdx + 1, nil
+		}
+		if dataStart == -1 {
+			return "", 0, nil
 		}
-		return "", 0
 	}
 
 	// 从data位置开始查找事件边界
@@ -486,7 +878,7 @@ func (p *SSEStreamParser) tryParseEvent() (string, int) {
 	if doubleNewline := bytes.Index(data[searchStart:], []byte("\n\n")); doubleNewline != -1 {
 		eventEnd := searchStart + doubleNewline
 		event := strings.TrimSpace(string(data[dataStart:eventEnd]))
-		return event, eventEnd + 2 // +2 跳过 \n\n
+		return event, eventEnd + 2, nil // +2 跳过 \n\n
 	}
 
 	// 🎯 查找单换行作为事件边界（兼容模式）
@@ -496,12 +888,12 @@ func (p *SSEStreamParser) tryParseEvent() (string, int) {
 
 		// 验证这是一个完整的JSON数据行
 		if strings.Contains(event, "data: {") || strings.Contains(event, "data: [DONE]") {
-			return event, eventEnd + 1
+			return event, eventEnd + 1, nil
 		}
 	}
 
 	// 需要更多数据才能形成完整事件
-	return "", 0
+	return "", 0, nil
 }
 
 // OpenAIToolCall OpenAI工具调用结构
@@ -532,6 +924,23 @@ type ToolCallsSession struct {
 	toolCallsMap   map[string]*AnthropicToolCall
 	toolCallsOrder []*AnthropicToolCall
 	requestID      string // 会话唯一标识
+
+	// 按上游tool_calls[].index索引的工具，用于归属缺失ID的参数片段
+	toolsByIndex map[int]*AnthropicToolCall
+
+	// 可选的工具ID映射：将上游缺失/合成的ID映射为稳定的客户端ID，请求内保持一致
+	idMappingEnabled bool
+	idMap            map[string]string
+
+	maxArgBytes int // 单个工具参数大小上限，0表示不限制
+}
+
+// syntheticToolIDPrefix 上游缺失工具ID时合成ID的前缀
+const syntheticToolIDPrefix = "synthetic_"
+
+// isSyntheticToolID 判断工具ID是否为缺失或合成的ID（原始上游ID保持透传）
+func isSyntheticToolID(id string) bool {
+	return id == "" || strings.HasPrefix(id, syntheticToolIDPrefix) || strings.HasPrefix(id, "unknown_tool_")
 }
 
 // AnthropicToolCall Anthropic工具调用转换器
@@ -539,19 +948,65 @@ type AnthropicToolCall struct {
 	ID        string
 	Name      string
 	Arguments strings.Builder
+	// ArgsTruncated 参数超出大小上限被截断，输出时以错误信息替代残缺参数
+	ArgsTruncated bool
+}
+
+// argumentsJSON 返回用于输出的参数字符串；参数被截断时返回描述错误的JSON对象
+func (tool *AnthropicToolCall) argumentsJSON() string {
+	if tool.ArgsTruncated {
+		errObj := map[string]any{
+			"error": fmt.Sprintf("tool arguments exceeded the %d byte limit and were discarded", tool.Arguments.Len()),
+		}
+		if data, err := utils.FastMarshal(errObj); err == nil {
+			return string(data)
+		}
+	}
+	return strings.TrimSpace(tool.Arguments.String())
+}
+
+// defaultMaxToolArgBytes 单个工具调用参数的默认大小上限（1MiB）
+const defaultMaxToolArgBytes = 1 << 20
+
+// maxToolArgBytes 单个工具调用参数的大小上限，0或负数表示不限制
+func maxToolArgBytes() int {
+	return utils.EnvInt("CODEBUDDY2CC_MAX_TOOL_ARG_BYTES", defaultMaxToolArgBytes)
 }
 
 // newToolCallsSession 创建新的工具调用会话，使用传入的请求ID
 func newToolCallsSession(requestID string) *ToolCallsSession {
 	session := &ToolCallsSession{
-		toolCallsMap:   make(map[string]*AnthropicToolCall),
-		toolCallsOrder: make([]*AnthropicToolCall, 0, 4),
-		requestID:      requestID, // 使用请求ID作为会话标识
+		toolCallsMap:     make(map[string]*AnthropicToolCall),
+		toolCallsOrder:   make([]*AnthropicToolCall, 0, 4),
+		toolsByIndex:     make(map[int]*AnthropicToolCall),
+		requestID:        requestID, // 使用请求ID作为会话标识
+		idMappingEnabled: utils.EnvBool("CODEBUDDY2CC_TOOL_ID_MAPPING"),
+		idMap:            make(map[string]string),
+		maxArgBytes:      maxToolArgBytes(),
 	}
 
 	return session
 }
 
+// clientToolID 返回面向客户端的工具ID
+// 原始上游ID直接透传；启用映射时，合成ID在同一请求内始终映射为同一个toolu_前缀ID
+func (session *ToolCallsSession) clientToolID(upstreamID string) string {
+	if !session.idMappingEnabled || !isSyntheticToolID(upstreamID) {
+		return upstreamID
+	}
+
+	if clientID, exists := session.idMap[upstreamID]; exists {
+		return clientID
+	}
+
+	randomBytes := make([]byte, 12)
+	rand.Read(randomBytes)
+	clientID := "toolu_" + hex.EncodeToString(randomBytes)
+	session.idMap[upstreamID] = clientID
+	session.debugLog("[ToolID] Mapped synthetic id %q -> %s", upstreamID, clientID)
+	return clientID
+}
+
 // processToolCallsUnified 统一工具调用处理逻辑
 func (session *ToolCallsSession) processToolCallsUnified(choice *utils.OpenAIChoice, _ bool) ToolProcessResult {
 	// 1. 处理工具调用数据收集
@@ -568,7 +1023,7 @@ func (session *ToolCallsSession) processToolCallsUnified(choice *utils.OpenAICho
 				} else {
 					// 边界检查
 					if len(session.toolCallsOrder) >= MaxToolCalls {
-						utils.DebugLog("Tool calls limit exceeded: %d >= %d", len(session.toolCallsOrder), MaxToolCalls)
+						session.debugLog("Tool calls limit exceeded: %d >= %d", len(session.toolCallsOrder), MaxToolCalls)
 						return ToolProcessError
 					}
 					// 创建新工具
@@ -576,23 +1031,44 @@ func (session *ToolCallsSession) processToolCallsUnified(choice *utils.OpenAICho
 					session.toolCallsMap[openaiTool.ID] = currentTool
 					session.toolCallsOrder = append(session.toolCallsOrder, currentTool)
 				}
+			} else if indexed := session.toolByIndex(openaiTool.Index); indexed != nil {
+				// 无ID但有index：按index归属到对应的工具（OpenAI流式片段仅以index区分工具）
+				currentTool = indexed
 			} else {
-				// 无ID情况：延续最后一个工具
+				// 无ID且index未知：延续最后一个工具
 				if len(session.toolCallsOrder) > 0 {
 					currentTool = session.toolCallsOrder[len(session.toolCallsOrder)-1]
+				} else if session.idMappingEnabled && openaiTool.Function.Name != "" {
+					// 启用ID映射时，为缺失ID的首个工具合成ID，输出时再映射为客户端ID
+					syntheticID := fmt.Sprintf("%s%d", syntheticToolIDPrefix, len(session.toolCallsOrder))
+					currentTool = &AnthropicToolCall{ID: syntheticID}
+					session.toolCallsMap[syntheticID] = currentTool
+					session.toolCallsOrder = append(session.toolCallsOrder, currentTool)
 				} else {
 					continue
 				}
 			}
 
+			// 记录index归属，首次出现的index绑定到当前工具
+			if openaiTool.Index != nil {
+				if _, exists := session.toolsByIndex[*openaiTool.Index]; !exists {
+					session.toolsByIndex[*openaiTool.Index] = currentTool
+				}
+			}
+
 			// 更新工具信息
 			if openaiTool.Function.Name != "" && currentTool.Name == "" {
 				currentTool.Name = openaiTool.Function.Name
 			}
 
-			// 累积参数片段
-			if openaiTool.Function.Arguments != "" {
-				currentTool.Arguments.WriteString(openaiTool.Function.Arguments)
+			// 累积参数片段，超出上限时截断并标记，不再继续增长
+			if fragment := openaiTool.Function.Arguments; fragment != "" && !currentTool.ArgsTruncated {
+				if session.maxArgBytes > 0 && currentTool.Arguments.Len()+len(fragment) > session.maxArgBytes {
+					fragment = truncateUTF8(fragment, session.maxArgBytes-currentTool.Arguments.Len())
+					currentTool.ArgsTruncated = true
+					session.debugLog("[ToolCall] Arguments of tool %s (id=%s) exceeded %d bytes, truncated", currentTool.Name, currentTool.ID, session.maxArgBytes)
+				}
+				currentTool.Arguments.WriteString(fragment)
 			}
 		}
 
@@ -607,17 +1083,33 @@ func (session *ToolCallsSession) processToolCallsUnified(choice *utils.OpenAICho
 	return ToolProcessContinue
 }
 
+// toolByIndex 返回上游index对应的已累积工具，index为nil或未出现过时返回nil
+func (session *ToolCallsSession) toolByIndex(index *int) *AnthropicToolCall {
+	if index == nil {
+		return nil
+	}
+	return session.toolsByIndex[*index]
+}
+
+// debugLog 输出带请求ID前缀的调试日志
+func (session *ToolCallsSession) debugLog(format string, args ...any) {
+	if session.requestID != "" {
+		format = "[Request:" + session.requestID + "] " + format
+	}
+	utils.DebugLog(format, args...)
+}
+
 // 🎯 移除所有ID映射方法 - 改为直接透传模式简化架构
 
 // clearToolCallsWithLogging 带日志的会话状态清理
 func (session *ToolCallsSession) clearToolCallsWithLogging() {
-	utils.DebugLog("[Session] Clearing session %s: tools=%d",
-		session.requestID, len(session.toolCallsOrder))
+	session.debugLog("[Session] Clearing session: tools=%d", len(session.toolCallsOrder))
 
 	// 1. 清空map引用
 	for k := range session.toolCallsMap {
 		delete(session.toolCallsMap, k)
 	}
+	clear(session.toolsByIndex)
 
 	// 2. 清理slice中的指针引用（防止内存泄漏）
 	for i := range session.toolCallsOrder {
@@ -636,6 +1128,16 @@ func (session *ToolCallsSession) getSessionStats() map[string]int {
 	}
 }
 
+// bindMessagesRequest 解码Messages请求体，数字以json.Number保留原始精度（如tool_use.input中的大整数和小数）
+// 仅作用于Messages请求，其他处理器仍使用gin默认的JSON绑定
+func bindMessagesRequest(c *gin.Context, req *utils.AnthropicRequest) error {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+	return utils.FastUnmarshalUseNumber(body, req)
+}
+
 func MessagesHandler(c *gin.Context) {
 	// 🔍 诊断：记录处理器入口信息
 	// handlerStartTime := time.Now()
@@ -650,19 +1152,94 @@ func MessagesHandler(c *gin.Context) {
 	// utils.DebugLog("[ConnectionDiag] Request headers - Connection: %s, Accept: %s",
 	// 	c.GetHeader("Connection"), c.GetHeader("Accept"))
 
+	// 📊 进程级统计：进行中请求数与累计请求数
+	defer stats.beginRequest()()
+
+	// 🔧 生成唯一的请求标识符
+	requestID := generateRequestID()
+
+	// 链路追踪：每个请求一个根span（未配置OTLP时为no-op）
+	spanCtx, span := startRequestSpan(c, "messages")
+	defer endRequestSpan(c, span)
+
+	// 请求ID写入context，转换等下游函数的日志可据此关联请求；同时写入gin上下文供访问日志使用
+	ctx := utils.WithRequestID(spanCtx, requestID)
+	c.Set(utils.RequestIDKey, requestID)
+	c.Header(requestIDHeader, requestID)
+
+	// 计费记录：无论成功或失败，请求结束时都输出
+	billing := newBillingRecord(requestID)
+	defer billing.emit(c)
+
+	// 调试追踪：配置 CODEBUDDY2CC_TRACE_DIR 时请求结束后写入追踪文件
+	trace := newRequestTrace(requestID)
+	defer trace.write()
+	defer closeStreamMirror(c)
+
 	var req utils.AnthropicRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request format: %v", err)})
+	limitRequestBody(c)
+	if err := bindMessagesRequest(c, &req); err != nil {
+		writeBindError(c, err)
 		return
 	}
+	trace.setAnthropicRequest(&req)
 
-	// 🔧 生成唯一的请求标识符
-	requestID := generateRequestID()
+	// 🔧 A/B测试：允许通过请求头强制指定模型（需显式开启），在模型映射之前替换客户端的model
+	if utils.EnvBool("CODEBUDDY2CC_ALLOW_MODEL_OVERRIDE") {
+		if override := strings.TrimSpace(c.GetHeader(modelOverrideHeader)); override != "" && override != req.Model {
+			log.Printf("[Request:%s] Model overridden by header: %s -> %s", requestID, req.Model, override)
+			req.Model = override
+		}
+	}
+	span.SetAttributes(attribute.String("request.id", requestID), attribute.String("model", req.Model))
+
+	billing.Model = req.Model
+	billing.Stream = req.Stream
+	if req.Metadata != nil && req.Metadata.UserID != "" {
+		billing.UserID = req.Metadata.UserID
+		c.Set(utils.UserIDKey, req.Metadata.UserID)
+	}
+
+	// Anthropic Messages API只返回单个候选，明确拒绝n>1而不是静默只返回第一个
+	if req.N != nil && *req.N > 1 {
+		writeAnthropicError(c, http.StatusBadRequest, "", fmt.Sprintf("n=%d is not supported: only a single completion can be returned", *req.N))
+		return
+	}
+
+	// 🔧 在转换前限制消息数量，防止超长历史拖慢转换并撑大上游请求
+	if limit := maxMessages(); limit > 0 && len(req.Messages) > limit {
+		writeAnthropicError(c, http.StatusBadRequest, "", fmt.Sprintf("Too many messages: %d exceeds limit of %d", len(req.Messages), limit))
+		return
+	}
+
+	// 🔧 可选的max_tokens上限：超出时截断，未指定时使用上限值
+	if limit := utils.EnvInt("CODEBUDDY2CC_MAX_TOKENS_CAP", 0); limit > 0 {
+		if req.MaxTokens == nil {
+			req.MaxTokens = &limit
+		} else if *req.MaxTokens > limit {
+			utils.InfoLogCtx(ctx, "Clamping max_tokens %d to cap %d", *req.MaxTokens, limit)
+			req.MaxTokens = &limit
+		}
+	}
+
+	// 🔧 可选的上下文窗口预检：估算输入token，超出映射后上游模型的上下文窗口时在本地直接拒绝
+	if utils.EnvBool("CODEBUDDY2CC_CONTEXT_PREFLIGHT") {
+		if meta, ok := utils.GetUpstreamModelMetadata(req.Model); ok && meta.ContextWindow > 0 {
+			maxTokens := 0
+			if req.MaxTokens != nil {
+				maxTokens = *req.MaxTokens
+			}
+			if estimated := utils.EstimateInputTokens(&req); estimated > meta.ContextWindow-maxTokens {
+				writeAnthropicError(c, http.StatusBadRequest, "", fmt.Sprintf("request exceeds context window: estimated %d input tokens + %d max_tokens > %d", estimated, maxTokens, meta.ContextWindow))
+				return
+			}
+		}
+	}
 
 	// 🔍 诊断：验证请求的唯一性
 	// utils.DebugLog("[HandlerDiag] Request mapping - requestID: %s, goroutine: %s",
 	// requestID, goroutineID)
-	utils.DebugLog("[Request:%s] Processing request", requestID)
+	utils.DebugLog("[Request:%s] Processing request (user: %s)", requestID, c.GetString(utils.UserIDKey))
 
 	// Debug: 输出客户端原始请求内容（排除tools字段以减少日志大小）
 	debugClientReq := struct {
@@ -680,13 +1257,13 @@ func MessagesHandler(c *gin.Context) {
 		Stream:      req.Stream,
 		ToolsCount:  len(req.Tools),
 	}
-	utils.DebugLogJSON("Client Original Request", debugClientReq)
+	utils.DebugLogJSONCtx(ctx, "Client Original Request", debugClientReq)
 
 	// 在发送到 Bedrock 之前验证消息格式
-	if err := utils.ValidateAndFixToolResults(&req); err != nil {
-		utils.DebugLog("[ERROR] Failed to validate tool results: %v", err)
-		// 尝试自动修复失败，返回错误
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Tool results validation failed: %v", err)})
+	if err := utils.ValidateAndFixToolResults(ctx, &req); err != nil {
+		utils.DebugLogCtx(ctx, "[ERROR] Failed to validate tool results: %v", err)
+		// 尝试自动修复失败（请求中的工具调用序列有歧义），属于客户端请求错误
+		writeAnthropicError(c, http.StatusBadRequest, "", fmt.Sprintf("Tool results validation failed: %v", err))
 		return
 	}
 
@@ -697,13 +1274,39 @@ func MessagesHandler(c *gin.Context) {
 	// utils.DebugLog("[HandlerDiag] Created tool manager for request %s, session state: %+v",
 	// 	requestID, toolManager.GetStats())
 
+	// 🔧 允许通过请求头覆盖system后缀（需显式开启），空值表示不注入
+	if utils.EnvBool("CODEBUDDY2CC_ALLOW_HEADER_SUFFIX") {
+		if values, ok := c.Request.Header[systemSuffixHeader]; ok {
+			suffix := ""
+			if len(values) > 0 {
+				suffix = strings.TrimSpace(values[0])
+			}
+			req.SystemSuffix = &suffix
+			utils.DebugLog("[Request:%s] System suffix overridden by header (empty: %v)", requestID, suffix == "")
+		}
+	}
+
 	// 🔧 强制上游使用流式，因为上游不支持非流式调用
-	originalClientStream := req.Stream
+	originalClientStream := resolveClientStream(c, req.Stream)
+	billing.Stream = originalClientStream
+	span.SetAttributes(attribute.Bool("stream", originalClientStream))
 	req.Stream = true
 
-	openAIReq, err := utils.ConvertAnthropicToOpenAI(&req)
+	// 🔧 限制单个客户端（按IP）同时进行的流式请求数，流结束时释放
+	if limit := maxStreamsPerClient(); limit > 0 && originalClientStream {
+		client := c.ClientIP()
+		if !clientStreams.acquire(client, limit) {
+			writeAnthropicError(c, http.StatusTooManyRequests, "rate_limit_error", fmt.Sprintf("Too many concurrent streams: limit is %d per client", limit))
+			return
+		}
+		defer clientStreams.release(client)
+	}
+
+	_, convertSpan := startSpan(ctx, "convert_request")
+	openAIReq, err := utils.ConvertAnthropicToOpenAI(ctx, &req)
+	convertSpan.End()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Request conversion failed: %v", err)})
+		writeAnthropicError(c, http.StatusInternalServerError, "", fmt.Sprintf("Request conversion failed: %v", err))
 		return
 	}
 
@@ -723,27 +1326,68 @@ func MessagesHandler(c *gin.Context) {
 		Stream:      openAIReq.Stream,
 		ToolsCount:  len(openAIReq.Tools),
 	}
-	utils.DebugLogJSON("Converted OpenAI Request", debugReq)
+	utils.DebugLogJSONCtx(ctx, "Converted OpenAI Request", debugReq)
 
 	reqBody, err := utils.FastMarshal(openAIReq)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode request"})
+		writeAnthropicError(c, http.StatusInternalServerError, "", "Failed to encode request")
 		return
 	}
+	trace.setOpenAIRequest(reqBody)
+
+	// 🔧 幂等键：客户端重试已完成的请求时直接重放缓存的响应，不再调用上游
+	idemKey := idempotencyKey(c)
+	if idemKey != "" {
+		cached, mismatch := idempotentResponses.get(idemKey, reqBody)
+		if mismatch {
+			writeAnthropicError(c, http.StatusUnprocessableEntity, "invalid_request_error", "Idempotency-Key has already been used with a different request")
+			return
+		}
+		if cached != nil {
+			utils.DebugLog("[Request:%s] Replaying cached response for Idempotency-Key %q", requestID, idemKey)
+			if originalClientStream {
+				writeStreamResponse(c, cached)
+			} else {
+				writeNonStreamResponse(c, cached)
+			}
+			return
+		}
+	}
 
 	// 🔧 关键修复：为每个请求创建独立的context，避免相互影响
 	// 使用背景context + 超时，而不是直接使用gin的request context
-	requestCtx, requestCancel := context.WithTimeout(context.Background(), 600*time.Second)
+	requestCtx, requestCancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer requestCancel() // 确保清理
+	// 仅携带链路上下文，不继承客户端请求的取消
+	requestCtx = withSpanFrom(requestCtx, spanCtx)
+
+	// 🔧 客户端断开时取消上游请求（仍保留独立超时），CODEBUDDY2CC_CANCEL_ON_DISCONNECT=false 时坚持读取到上游结束
+	clientCtx := c.Request.Context()
+	if cancelOnDisconnect() {
+		stopCancelWatch := context.AfterFunc(clientCtx, requestCancel)
+		defer stopCancelWatch()
+	} else {
+		clientCtx = context.WithoutCancel(clientCtx)
+	}
 
 	// 🔍 新增：检测context隔离性
-	utils.DebugLog("[ContextIsolation] Creating request context - parent: background, timeout: 600s, requestID: %s",
-		requestID)
+	utils.DebugLogCtx(ctx, "[ContextIsolation] Creating request context - parent: background, timeout: %s", requestTimeout)
 
-	upstreamReq, err := http.NewRequestWithContext(requestCtx, "POST", upstreamURL(), bytes.NewBuffer(reqBody))
+	// 🔧 多密钥轮询：每个请求按顺序选取下一个上游密钥
+	upstreamKeys := utils.UpstreamKeys()
+	if len(upstreamKeys) == 0 {
+		writeAnthropicError(c, http.StatusInternalServerError, "", "CODEBUDDY2CC_KEY not configured")
+		return
+	}
+
+	// 🔧 按映射后的模型选择上游地址（未单独配置时使用全局上游）
+	targetURL := upstreamURLForModel(openAIReq.Model)
+	upstreamCtx, upstreamSpan := startSpan(requestCtx, "upstream_request", attribute.String("upstream.model", openAIReq.Model), attribute.String("upstream.url", targetURL))
+	defer upstreamSpan.End()
+	upstreamReq, err := newUpstreamRequest(upstreamCtx, c, targetURL, reqBody, nextUpstreamKey(upstreamKeys))
 	if err != nil {
 		utils.DebugLog("[Request:%s] [ERROR] Failed to create upstream request: %v", requestID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upstream request"})
+		writeAnthropicError(c, http.StatusInternalServerError, "", "Failed to create upstream request")
 		return
 	}
 
@@ -751,67 +1395,72 @@ func MessagesHandler(c *gin.Context) {
 	utils.DebugLog("[Request:%s] [CONCURRENCY] Created upstream request with independent context, goroutine: g%d, ctx_addr: %p",
 		requestID, getGoroutineID(), requestCtx)
 
-	// 使用单一上游API密钥
-	upstreamKey := os.Getenv("CODEBUDDY2CC_KEY")
-	if upstreamKey == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "CODEBUDDY2CC_KEY not configured"})
-		return
+	// 🔧 复用共享客户端的连接池；本地开发启用mock上游时不发起真实网络请求
+	client := sharedUpstreamClient()
+	if mockUpstreamEnabled() {
+		client = mockUpstreamClient
 	}
 
-	// utils.DebugLog("[Request:%s] Using configured API key", requestID)
-	upstreamReq.Header.Set("Authorization", "Bearer "+upstreamKey)
-	upstreamReq.Header.Set("Content-Type", "application/json")
-	upstreamReq.Header.Set("User-Agent", "CLI/1.0.9 CodeBuddy/1.0.9")
+	// 📊 指标：按映射后的上游模型和客户端流式模式统计
+	upstreamModel := openAIReq.Model
+	billing.UpstreamModel = upstreamModel
+	metrics.recordRequest(upstreamModel, originalClientStream)
+	upstreamStart := time.Now()
 
-	// 🔧 关键修复：过滤HTTP/2禁止的连接特定头部
-	bannedHeaders := map[string]bool{
-		"Authorization":     true,
-		"Connection":        true, // HTTP/2禁止
-		"Keep-Alive":        true, // HTTP/2禁止
-		"Proxy-Connection":  true, // HTTP/2禁止
-		"Transfer-Encoding": true, // HTTP/2禁止
-		"Upgrade":           true, // HTTP/2禁止
-	}
-
-	for key, values := range c.Request.Header {
-		// 使用标准化的头部键名进行比较（避免大小写问题）
-		normalizedKey := http.CanonicalHeaderKey(key)
-		if !bannedHeaders[normalizedKey] {
-			for _, value := range values {
-				upstreamReq.Header.Add(key, value)
-			}
+	// 🔧 限制同时进行的上游请求数，名额在整个上游请求（含响应读取与重试）结束后释放
+	releaseSlot, ok := acquireUpstreamSlot(requestCtx, c.Request.Context())
+	if !ok {
+		utils.DebugLog("[Request:%s] Upstream concurrency limit reached, rejecting request", requestID)
+		message := "Too many concurrent upstream requests, please retry later"
+		if originalClientStream {
+			writeAnthropicStreamError(c, http.StatusServiceUnavailable, "overloaded_error", message)
+		} else {
+			writeAnthropicError(c, http.StatusServiceUnavailable, "overloaded_error", message)
 		}
+		return
 	}
+	defer releaseSlot()
+
+	// 🔧 所有重试路径共享同一预算，避免多种重试叠加导致尝试次数和耗时失控
+	budget := newRetryBudget()
+	budget.take() // 首次请求始终发出
+	resp, err := client.Do(upstreamReq)
+
+	// 🔧 配置了多个密钥时，401/429换用下一个密钥重试（受请求预算限制）
+	for err == nil && len(upstreamKeys) > 1 && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusTooManyRequests) && budget.take() {
+		utils.DebugLog("[Request:%s] Upstream returned %d, retrying with next key", requestID, resp.StatusCode)
+		resp.Body.Close()
 
-	// 🔧 关键修复：优化并发连接配置
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSHandshakeTimeout:   10 * time.Second, // TLS握手超时
-			ResponseHeaderTimeout: 30 * time.Second, // 增加响应头超时到30秒
-			IdleConnTimeout:       90 * time.Second, // 增加空闲连接超时
-			MaxIdleConns:          100,              // 🔧 增加最大空闲连接数，支持并发
-			MaxConnsPerHost:       50,               // 🔧 增加每个主机最大连接数，支持高并发
-			MaxIdleConnsPerHost:   20,               // 🔧 新增：每个主机最大空闲连接数
-			DisableKeepAlives:     false,            // 确保保持连接活跃
-			DisableCompression:    false,            // 启用压缩
-			ExpectContinueTimeout: 1 * time.Second,  // 🔧 新增：100-continue超时
-		},
+		retryReq, retryErr := newUpstreamRequest(upstreamCtx, c, targetURL, reqBody, nextUpstreamKey(upstreamKeys))
+		if retryErr != nil {
+			utils.DebugLog("[Request:%s] [ERROR] Failed to create retry request: %v", requestID, retryErr)
+			writeAnthropicError(c, http.StatusInternalServerError, "", "Failed to create upstream request")
+			return
+		}
+		resp, err = client.Do(retryReq)
 	}
 
-	resp, err := client.Do(upstreamReq)
 	if err != nil {
+		metrics.recordUpstream(upstreamModel, originalClientStream, 0, time.Since(upstreamStart))
 		utils.DebugLog("[Request:%s] HTTP request failed: %v", requestID, err)
-		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Request failed: %v", err)})
+		writeAnthropicError(c, http.StatusBadGateway, "", fmt.Sprintf("Request failed: %v", err))
 		return
 	}
 
+	metrics.recordUpstream(upstreamModel, originalClientStream, resp.StatusCode, time.Since(upstreamStart))
+	trace.setUpstreamStatus(resp.StatusCode)
+	recordUpstreamRequestID(c, resp)
+	upstreamSpan.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	upstreamSpan.End()
+
 	if resp.StatusCode != http.StatusOK {
 		body, err := io.ReadAll(resp.Body)
 		resp.Body.Close()
+		trace.recordEvent(string(body))
 
 		if err != nil {
 			utils.DebugLog("[Request:%s] Failed to read error response body: %v", requestID, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read error response"})
+			writeAnthropicError(c, http.StatusInternalServerError, "", "Failed to read error response")
 			return
 		}
 
@@ -824,7 +1473,12 @@ func MessagesHandler(c *gin.Context) {
 		if utils.FastUnmarshal(body, &errorResponse) == nil {
 			utils.DebugLog("[Request:%s] Upstream API Error - Parsed JSON: %+v", requestID, errorResponse)
 		}
-		c.Data(resp.StatusCode, "application/json", body)
+		// 流式客户端需要event-stream格式的错误事件，非流式客户端返回JSON错误
+		if originalClientStream {
+			writeAnthropicStreamError(c, resp.StatusCode, "", upstreamErrorMessage(resp.StatusCode, body))
+		} else {
+			writeAnthropicError(c, resp.StatusCode, "", upstreamErrorMessage(resp.StatusCode, body))
+		}
 		return
 	}
 
@@ -833,19 +1487,194 @@ func MessagesHandler(c *gin.Context) {
 
 	defer resp.Body.Close()
 
-	// 🎯 统一处理响应，根据客户端需求决定输出格式
-	responseData, err := processUnifiedResponse(resp, toolManager, requestID)
+	_, processSpan := startSpan(ctx, "process_response")
+	defer processSpan.End()
+
+	// 🔧 上游返回200但没有任何内容和工具调用时，按配置重试一次（受请求预算限制），重试仍为空才使用默认文本
+	var retryEmpty func() (*http.Response, bool)
+	if retryOnEmptyEnabled() {
+		retryEmpty = func() (*http.Response, bool) {
+			if !budget.take() {
+				return nil, false
+			}
+			return retryUpstreamRequest(requestCtx, c, client, targetURL, reqBody, nextUpstreamKey(upstreamKeys), requestID)
+		}
+	}
+
+	// 🎯 流式客户端：边解析上游边输出，文本增量无需等待上游结束
+	// 携带幂等键时走累积路径，以便缓存完整内容块供重放时重建SSE序列
+	if originalClientStream && !isJSONResponse(resp) && idemKey == "" {
+		result := streamUnifiedResponse(c, resp, toolManager, requestID, req.StopSequences, trace, retryEmpty)
+		span.SetAttributes(attribute.Int("tool_calls", result.ToolCalls))
+		billing.setResult(result)
+		metrics.recordResponseType(upstreamModel, true, result.IsToolCall)
+		return
+	}
+
+	// 🎯 非流式客户端（或上游返回完整JSON）：统一处理响应后一次性输出
+	responseData, err := processUnifiedResponse(clientCtx, resp, toolManager, requestID, req.StopSequences, trace)
+
+	if err == nil && responseData.Empty {
+		log.Printf("[Request:%s] Upstream returned an empty response (no content, no tool calls)", requestID)
+		if retryEmpty != nil {
+			if retried, ok := retryEmptyResponse(clientCtx, retryEmpty, requestID, req.StopSequences, trace); ok {
+				responseData = retried
+			}
+		}
+	}
+	if errors.Is(err, errClientDisconnected) {
+		billing.Error = err.Error()
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Response processing failed: %v", err)})
+		writeAnthropicError(c, http.StatusInternalServerError, "", fmt.Sprintf("Response processing failed: %v", err))
 		return
 	}
 
-	// 根据客户端需求选择输出格式
+	billing.setResult(responseData)
+	metrics.recordResponseType(upstreamModel, originalClientStream, responseData.IsToolCall)
+	if idemKey != "" {
+		idempotentResponses.put(idemKey, reqBody, responseData)
+	}
+	span.SetAttributes(attribute.Int("tool_calls", responseData.ToolCalls))
+
+	// 上游返回完整JSON（或请求携带幂等键）而客户端要求流式时，将完整响应转换为SSE事件序列输出
 	if originalClientStream {
 		writeStreamResponse(c, responseData)
-	} else {
-		writeNonStreamResponse(c, responseData)
+		return
+	}
+	writeNonStreamResponse(c, responseData)
+}
+
+// retryOnEmptyEnabled 上游返回空响应时是否重试一次（CODEBUDDY2CC_RETRY_ON_EMPTY）
+func retryOnEmptyEnabled() bool {
+	return utils.EnvBool("CODEBUDDY2CC_RETRY_ON_EMPTY")
+}
+
+// retryUpstreamRequest 上游返回空响应后重新请求一次，请求失败或状态码非200时返回false
+func retryUpstreamRequest(ctx context.Context, c *gin.Context, client *http.Client, targetURL string, reqBody []byte, upstreamKey, requestID string) (*http.Response, bool) {
+	upstreamReq, err := newUpstreamRequest(ctx, c, targetURL, reqBody, upstreamKey)
+	if err != nil {
+		utils.DebugLog("[Request:%s] [ERROR] Failed to create empty-response retry request: %v", requestID, err)
+		return nil, false
+	}
+
+	resp, err := client.Do(upstreamReq)
+	if err != nil {
+		utils.DebugLog("[Request:%s] Empty-response retry failed: %v", requestID, err)
+		return nil, false
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		utils.DebugLog("[Request:%s] Empty-response retry returned status %d", requestID, resp.StatusCode)
+		return nil, false
+	}
+	return resp, true
+}
+
+// retryEmptyResponse 以retry重新请求并累积响应，重试失败或仍为空时返回false（沿用首次的默认文本响应）
+func retryEmptyResponse(clientCtx context.Context, retry func() (*http.Response, bool), requestID string, stopSequences []string, trace *requestTrace) (*ResponseData, bool) {
+	resp, ok := retry()
+	if !ok {
+		return nil, false
+	}
+	defer resp.Body.Close()
+
+	data, err := processUnifiedResponse(clientCtx, resp, NewDefaultToolCallManager(requestID), requestID, stopSequences, trace)
+	if err != nil || data.Empty {
+		log.Printf("[Request:%s] Empty-response retry did not produce content, using fallback text", requestID)
+		return nil, false
+	}
+	utils.DebugLog("[Request:%s] Empty-response retry succeeded", requestID)
+	return data, true
+}
+
+// upstreamKeyCounter 上游密钥轮询计数器
+var upstreamKeyCounter atomic.Uint64
+
+// nextUpstreamKey 按轮询顺序选取下一个上游密钥
+func nextUpstreamKey(keys []string) string {
+	idx := upstreamKeyCounter.Add(1) - 1
+	return keys[idx%uint64(len(keys))]
+}
+
+// defaultForwardHeaders 未配置 CODEBUDDY2CC_FORWARD_HEADERS 时转发给上游的客户端头部
+const defaultForwardHeaders = "Accept,Accept-Language,Anthropic-Version,Anthropic-Beta,X-Request-Id"
+
+// neverForwardedHeaders 无论白名单如何配置都不转发的头部：认证与内容类型由代理设置，连接相关头部HTTP/2禁止
+var neverForwardedHeaders = map[string]bool{
+	"Authorization":     true,
+	"Content-Type":      true,
+	"Content-Length":    true,
+	"Connection":        true, // HTTP/2禁止
+	"Keep-Alive":        true, // HTTP/2禁止
+	"Proxy-Connection":  true, // HTTP/2禁止
+	"Transfer-Encoding": true, // HTTP/2禁止
+	"Upgrade":           true, // HTTP/2禁止
+	systemSuffixHeader:  true, // 仅供代理使用，不转发上游
+	modelOverrideHeader: true, // 仅供代理使用，不转发上游
+}
+
+// forwardedHeaderAllowlist 解析 CODEBUDDY2CC_FORWARD_HEADERS（逗号分隔的头部名），返回是否转发全部及白名单
+// 配置为 * 时恢复转发全部客户端头部（仍排除neverForwardedHeaders）
+func forwardedHeaderAllowlist() (bool, map[string]bool) {
+	raw, ok := os.LookupEnv("CODEBUDDY2CC_FORWARD_HEADERS")
+	if !ok {
+		raw = defaultForwardHeaders
+	}
+
+	allowed := make(map[string]bool)
+	for name := range strings.SplitSeq(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "*" {
+			return true, nil
+		}
+		if name != "" {
+			allowed[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return false, allowed
+}
+
+// newUpstreamRequest 构建上游请求：设置认证头并转发白名单内的客户端头部
+func newUpstreamRequest(ctx context.Context, c *gin.Context, targetURL string, reqBody []byte, upstreamKey string) (*http.Request, error) {
+	upstreamReq, err := http.NewRequestWithContext(ctx, upstreamMethod(), targetURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamReq.Header.Set("Authorization", "Bearer "+upstreamKey)
+	upstreamReq.Header.Set("Content-Type", "application/json")
+	upstreamReq.Header.Set("User-Agent", upstreamUserAgent())
+
+	// 🔧 仅转发白名单中的客户端头部，避免Cookie、内部认证头等泄露给上游
+	allowAll, allowed := forwardedHeaderAllowlist()
+	for key, values := range c.Request.Header {
+		// 使用标准化的头部键名进行比较（避免大小写问题）
+		normalizedKey := http.CanonicalHeaderKey(key)
+		if neverForwardedHeaders[normalizedKey] || (!allowAll && !allowed[normalizedKey]) {
+			continue
+		}
+		for _, value := range values {
+			upstreamReq.Header.Add(normalizedKey, value)
+		}
+	}
+
+	// 🔧 上游不支持 Expect: 100-continue 时移除该头部，避免每个请求等待ExpectContinueTimeout
+	if expectContinueDisabled() {
+		upstreamReq.Header.Del("Expect")
+	}
+
+	// 🔧 在过滤之后附加运维配置的静态头部（如网关凭证、路由头），覆盖客户端同名头部
+	for key, values := range upstreamStaticHeaders() {
+		upstreamReq.Header[key] = values
 	}
+
+	// 🔧 启用链路追踪时写入当前span的上下文（traceparent），覆盖客户端转发的同名头部
+	injectTraceContext(ctx, upstreamReq.Header)
+
+	return upstreamReq, nil
 }
 
 // generateRequestID 生成请求唯一标识符
@@ -861,31 +1690,50 @@ type ResponseData struct {
 	MessageModel  string
 	ContentBlocks []utils.ContentBlock
 	StopReason    string
+	StopSequence  *string // 命中的停止序列，仅stop_reason为stop_sequence时非nil
 	Usage         *utils.Usage
 	IsToolCall    bool
+	Empty         bool // 上游没有返回任何内容和工具调用，内容为默认文本
+	ToolCalls     int  // 输出给客户端的tool_use块数
 }
 
-// processUnifiedResponse 统一处理上游响应（SRP原则）
-func processUnifiedResponse(resp *http.Response, toolManager *DefaultToolCallManager, requestID string) (*ResponseData, error) {
-	var messageID string
-	var messageModel string
-	var contentBlocks []utils.ContentBlock
-	var stopReason string = "end_turn"
-	var usage *utils.Usage
-	var isToolCall bool = false
+// errClientDisconnected 非流式累积期间客户端已断开
+var errClientDisconnected = errors.New("client disconnected")
 
-	// utils.DebugLog("[Request:%s] Processing unified response with manager stats: %+v", requestID, toolManager.GetStats())
+// processUnifiedResponse 统一处理上游响应（SRP原则）
+// clientCtx 为客户端请求的context，客户端断开时中止上游读取并返回errClientDisconnected
+// stopSequences 为客户端请求的停止序列，用于识别上游是否因停止序列结束
+// trace 为请求的调试追踪（可为nil），记录解析到的原始上游事件
+func processUnifiedResponse(clientCtx context.Context, resp *http.Response, toolManager *DefaultToolCallManager, requestID string, stopSequences []string, trace *requestTrace) (*ResponseData, error) {
+	// 🔧 上游直接返回完整JSON时直接解析，跳过SSE解析
+	if isJSONResponse(resp) {
+		return processJSONResponse(resp, toolManager, requestID, stopSequences, trace)
+	}
 
 	// 使用完全独立的context
-	processCtx, processCancel := context.WithTimeout(context.Background(), 600*time.Second)
+	processCtx, processCancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer processCancel()
 
+	// 🔧 客户端断开时立即中止上游读取，避免为已放弃的请求继续消耗上游配额
+	stopWatch := context.AfterFunc(clientCtx, func() {
+		processCancel()
+		resp.Body.Close()
+	})
+	defer stopWatch()
+
+	// 与流式路径共用块组装逻辑，仅输出目标不同
+	sink := &bufferedBlockSink{}
+	assembler := newResponseAssembler(requestID, stopSequences, toolManager.session, sink, false)
 	streamParser := NewSSEStreamParser(resp.Body)
 
 	for {
 		event, err := streamParser.NextEvent(processCtx)
 		if err != nil {
-			if err == io.EOF {
+			if clientCtx.Err() != nil {
+				utils.DebugLog("[Request:%s] Client disconnected during buffered accumulation, aborting upstream read", requestID)
+				return nil, errClientDisconnected
+			}
+			if err == io.EOF || abruptEOFWithToolCalls(err, assembler.finishSeen, toolManager.session) {
 				break
 			}
 			if err == context.Canceled || err == context.DeadlineExceeded {
@@ -898,204 +1746,386 @@ func processUnifiedResponse(resp *http.Response, toolManager *DefaultToolCallMan
 		if event == "" {
 			continue
 		}
+		trace.recordEvent(event)
 
-		// 提取上游数据
-		var rawData string
-		if after, ok := strings.CutPrefix(event, "data: "); ok {
-			rawData = strings.TrimSpace(after)
-		} else if strings.HasPrefix(event, "internal:finish_reason:") {
-			rawData = strings.TrimPrefix(event, "internal:")
-		} else {
-			continue
-		}
-
-		// 处理流结束信号
-		if rawData == "[DONE]" || strings.HasPrefix(rawData, "finish_reason:") {
-			if r, found := strings.CutPrefix(rawData, "finish_reason:"); found {
-				switch r {
-				case "tool_calls":
-					isToolCall = true
-					stopReason = "tool_use"
-				case "stop":
-					stopReason = "end_turn"
-				}
-			}
-			continue
+		if rawData, ok := extractUpstreamData(event); ok {
+			assembler.handleData(rawData)
 		}
+	}
 
-		// 解析OpenAI数据块
-		var openAIChunk utils.OpenAIResponse
-		if err := utils.FastUnmarshal([]byte(rawData), &openAIChunk); err != nil {
-			continue
-		}
+	data := assembler.finish()
+	data.ContentBlocks = sink.blocks
+	return data, nil
+}
 
-		// 收集usage信息
-		if openAIChunk.Usage != nil {
-			usage = collectUsageInfo(openAIChunk.Usage)
-		}
+// abruptEOFWithToolCalls 上游在工具调用进行中直接断开连接（读取到不完整的响应体）时视为流结束，
+// 由responseAssembler.finish输出已累积的工具调用；其他情况的读取错误仍按上游中断处理
+func abruptEOFWithToolCalls(err error, finishSeen bool, session *ToolCallsSession) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) && !finishSeen && len(session.toolCallsOrder) > 0
+}
 
-		// 设置消息基本信息
-		if len(openAIChunk.Choices) > 0 && messageID == "" {
-			messageID = openAIChunk.ID
-			messageModel = openAIChunk.Model
-		}
+// textBoundaryDelta 判断增量是否标记了文本分段：文本之后出现推理内容（交错推理），或上游以不带文本的增量重新声明assistant角色
+// 每个增量都携带role的上游不受影响；未出现分段标记时全部文本合并为单个文本块
+func textBoundaryDelta(delta *utils.OpenAIMessage) bool {
+	if delta.ReasoningContent != "" {
+		return true
+	}
+	text, _ := delta.Content.(string)
+	return delta.Role == "assistant" && text == ""
+}
 
-		// 处理choices
-		if len(openAIChunk.Choices) > 0 {
-			choice := openAIChunk.Choices[0]
+// matchedStopSequence 上游因客户端停止序列结束时返回命中的序列，否则返回nil
+// OpenAI标准响应不包含命中信息，仅当上游在choice.stop_reason中返回命中的字符串时才能识别
+func matchedStopSequence(choice *utils.OpenAIChoice, stopSequences []string) *string {
+	if len(stopSequences) == 0 || choice.FinishReason == nil || *choice.FinishReason != "stop" {
+		return nil
+	}
+	seq, ok := choice.StopReason.(string)
+	if !ok || !slices.Contains(stopSequences, seq) {
+		return nil
+	}
+	return &seq
+}
 
-			// 处理工具调用
-			if (choice.Delta != nil && choice.Delta.ToolCalls != nil && len(choice.Delta.ToolCalls) > 0) || (choice.FinishReason != nil && *choice.FinishReason == "tool_calls") {
-				toolManager.ProcessToolCalls(&choice, true)
-				if choice.FinishReason != nil && *choice.FinishReason == "tool_calls" {
-					isToolCall = true
-					stopReason = "tool_use"
-				}
-				continue
-			}
+// isJSONResponse 判断上游是否直接返回了完整的非SSE JSON响应（部分网关会忽略stream参数）
+func isJSONResponse(resp *http.Response) bool {
+	contentType := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Type")))
+	return strings.HasPrefix(contentType, "application/json")
+}
 
-			// 处理文本内容（非工具调用模式下）
-			if choice.Delta != nil && choice.Delta.Content != nil && !isToolCall {
-				if contentStr, ok := choice.Delta.Content.(string); ok && contentStr != "" {
-					if len(contentBlocks) == 0 {
-						contentBlocks = append(contentBlocks, utils.ContentBlock{Type: "text", Text: contentStr})
-					} else {
-						// 累积到最后一个文本块
-						for i := len(contentBlocks) - 1; i >= 0; i-- {
-							if contentBlocks[i].Type == "text" {
-								contentBlocks[i].Text += contentStr
-								break
-							}
-						}
-					}
-				}
-			}
-		}
+// processJSONResponse 将上游完整的OpenAI非流式JSON响应直接转换为响应数据，无需经过SSE解析
+func processJSONResponse(resp *http.Response, toolManager *DefaultToolCallManager, requestID string, stopSequences []string, trace *requestTrace) (*ResponseData, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream response: %v", err)
 	}
+	trace.recordEvent(string(body))
 
-	// 处理工具调用结果
-	if isToolCall && len(toolManager.session.toolCallsOrder) > 0 {
-		contentBlocks = buildToolCallBlocks(toolManager)
-		stopReason = "tool_use"
+	var openAIResp utils.OpenAIResponse
+	if err := utils.FastUnmarshal(body, &openAIResp); err != nil {
+		return nil, fmt.Errorf("invalid upstream JSON response: %v", err)
 	}
+	utils.DebugLog("[Request:%s] Upstream returned a complete JSON response, skipping SSE parsing", requestID)
 
-	// 过滤空文本块并提供默认内容
-	contentBlocks = filterAndDefaultContent(contentBlocks)
-
-	// 设置默认值
-	if messageID == "" {
-		messageID = fmt.Sprintf("msg_%d", time.Now().UnixNano())
+	sink := &bufferedBlockSink{}
+	assembler := newResponseAssembler(requestID, stopSequences, toolManager.session, sink, false)
+	if openAIResp.Usage != nil {
+		assembler.usage = collectUsageInfo(openAIResp.Usage)
 	}
-	if messageModel == "" {
-		messageModel = "claude-unknown"
+
+	// 完整消息视为单个增量，复用流式路径的块组装逻辑
+	if choice, ok := primaryChoice(openAIResp.Choices, requestID); ok {
+		message := choice.Message
+		if message == nil {
+			message = choice.Delta
+		}
+		assembler.begin(openAIResp.ID, openAIResp.Model)
+		assembler.handleChoice(&utils.OpenAIChoice{Index: choice.Index, Delta: message, FinishReason: choice.FinishReason, StopReason: choice.StopReason})
 	}
 
-	return &ResponseData{
-		MessageID:     messageID,
-		MessageModel:  messageModel,
-		ContentBlocks: contentBlocks,
-		StopReason:    stopReason,
-		Usage:         usage,
-		IsToolCall:    isToolCall,
-	}, nil
+	data := assembler.finish()
+	data.ContentBlocks = sink.blocks
+	return data, nil
 }
 
-// collectUsageInfo 统一收集usage信息
-func collectUsageInfo(openAIUsage *utils.Usage) *utils.Usage {
-	usageMap := make(map[string]any)
-	if openAIUsage.PromptTokens > 0 {
-		usageMap["prompt_tokens"] = openAIUsage.PromptTokens
-	}
-	if openAIUsage.CompletionTokens > 0 {
-		usageMap["completion_tokens"] = openAIUsage.CompletionTokens
+// primaryChoice 返回index为0的choice；Anthropic只支持单个候选，其余候选丢弃，避免不同候选的增量混入同一响应
+func primaryChoice(choices []utils.OpenAIChoice, requestID string) (utils.OpenAIChoice, bool) {
+	for _, choice := range choices {
+		if choice.Index == 0 {
+			return choice, true
+		}
 	}
-	if openAIUsage.TotalTokens > 0 {
-		usageMap["total_tokens"] = openAIUsage.TotalTokens
+	if len(choices) > 0 {
+		utils.DebugLog("[Request:%s] Dropping %d upstream choice(s) with index > 0", requestID, len(choices))
 	}
-	if openAIUsage.InputTokens > 0 {
-		usageMap["input_tokens"] = openAIUsage.InputTokens
+	return utils.OpenAIChoice{}, false
+}
+
+// isInformationalChunk 判断JSON数据块是否既无choices也无usage（如上游的进度/状态通知）
+func isInformationalChunk(chunk *utils.OpenAIResponse) bool {
+	return len(chunk.Choices) == 0 && chunk.Usage == nil
+}
+
+// unknownEventMode 上游无法识别事件的处理方式（CODEBUDDY2CC_UNKNOWN_EVENTS）
+// drop：默认，仅输出调试日志；log：始终记录日志；ping：记录调试日志并向流式客户端转发ping事件
+func unknownEventMode() string {
+	return strings.ToLower(strings.TrimSpace(os.Getenv("CODEBUDDY2CC_UNKNOWN_EVENTS")))
+}
+
+// handleUnknownUpstreamEvent 按配置记录无法识别的上游事件，返回是否应向流式客户端发送ping
+func handleUnknownUpstreamEvent(requestID, data string) bool {
+	switch unknownEventMode() {
+	case "log":
+		log.Printf("[Request:%s] Unknown upstream event: %s", requestID, truncateUTF8(data, 512))
+		return false
+	case "ping":
+		utils.DebugLog("[Request:%s] Unknown upstream event forwarded as ping: %s", requestID, truncateUTF8(data, 512))
+		return true
+	default:
+		utils.DebugLog("[Request:%s] Unknown upstream event dropped: %s", requestID, truncateUTF8(data, 512))
+		return false
 	}
-	if openAIUsage.OutputTokens > 0 {
-		usageMap["output_tokens"] = openAIUsage.OutputTokens
+}
+
+// extractUpstreamData 从上游SSE事件中提取数据部分，非数据事件返回false
+func extractUpstreamData(event string) (string, bool) {
+	if after, ok := strings.CutPrefix(event, "data: "); ok {
+		return strings.TrimSpace(after), true
 	}
-	if openAIUsage.CacheCreationInputTokens > 0 {
-		usageMap["cache_creation_input_tokens"] = openAIUsage.CacheCreationInputTokens
+	if strings.HasPrefix(event, "internal:finish_reason:") {
+		return strings.TrimPrefix(event, "internal:"), true
 	}
-	if openAIUsage.CacheReadInputTokens > 0 {
-		usageMap["cache_read_input_tokens"] = openAIUsage.CacheReadInputTokens
+	return "", false
+}
+
+// collectUsageInfo 统一收集usage信息
+// 字段映射（prompt_tokens→input_tokens等）已在Usage解码时由utils.ParseUsageFromResponse完成，这里返回副本，避免后续修改影响上游chunk
+func collectUsageInfo(openAIUsage *utils.Usage) *utils.Usage {
+	usage := *openAIUsage
+	return &usage
+}
+
+// stopReasonFromFinish 将OpenAI finish_reason映射为Anthropic stop_reason（length→max_tokens，content_filter→refusal），未知值返回空字符串
+// 流式与非流式路径共用，避免两条输出路径的stop_reason出现差异
+func stopReasonFromFinish(finishReason string) string {
+	switch finishReason {
+	case "tool_calls":
+		return "tool_use"
+	case "stop":
+		return "end_turn"
+	case "length":
+		return "max_tokens"
+	case "content_filter":
+		return "refusal"
+	}
+	return ""
+}
+
+// toolCallStopReason 输出工具调用后的stop_reason：参数因max_tokens截断时保留max_tokens，否则为tool_use
+func toolCallStopReason(stopReason string) string {
+	if stopReason == "max_tokens" {
+		return stopReason
 	}
-	if openAIUsage.PromptCacheHitTokens > 0 {
-		usageMap["prompt_cache_hit_tokens"] = openAIUsage.PromptCacheHitTokens
+	return "tool_use"
+}
+
+// prepareStreamWriter 设置SSE响应头并返回flusher，不支持流式时输出错误并返回false
+func prepareStreamWriter(c *gin.Context) (http.Flusher, bool) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
+	// 🔧 HTTP/2禁止连接特定头部（与上游请求的neverForwardedHeaders保持一致）
+	if c.Request.ProtoMajor < 2 {
+		c.Header("Connection", "keep-alive")
 	}
-	if openAIUsage.PromptCacheMissTokens > 0 {
-		usageMap["prompt_cache_miss_tokens"] = openAIUsage.PromptCacheMissTokens
+	c.Header("X-Accel-Buffering", "no")
+	enableStreamMirror(c)
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		utils.DebugLog("ERROR: Streaming not supported")
+		writeAnthropicError(c, http.StatusInternalServerError, "", "Streaming not supported")
+		return nil, false
 	}
-	return utils.ParseUsageFromResponse(usageMap)
+	return flusher, true
 }
 
-// buildToolCallBlocks 构建工具调用内容块
-func buildToolCallBlocks(toolManager *DefaultToolCallManager) []utils.ContentBlock {
-	var contentBlocks []utils.ContentBlock
-	for _, tool := range toolManager.session.toolCallsOrder {
-		if tool.Name != "" {
-			var inputObj map[string]any
-			argsStr := strings.TrimSpace(tool.Arguments.String())
+// streamUnifiedResponse 边读取上游SSE边向客户端输出Anthropic事件
+// 文本与推理增量实时透传，工具调用默认累积到结束后统一输出；块组装逻辑与非流式路径共用
+// retryEmpty 非nil时推迟message_start到首个内容块，上游返回空响应且尚未输出内容时以retryEmpty重新请求一次
+// 返回的ResponseData不包含内容块，内容已直接写出
+func streamUnifiedResponse(c *gin.Context, resp *http.Response, toolManager *DefaultToolCallManager, requestID string, stopSequences []string, trace *requestTrace, retryEmpty func() (*http.Response, bool)) *ResponseData {
+	flusher, ok := prepareStreamWriter(c)
+	if !ok {
+		return &ResponseData{}
+	}
+
+	streamState := NewSSEStreamState(requestID)
+	defer stats.recordStream(streamState)
+	formatter := utils.NewAnthropicSSEFormatter()
+	sink := &streamBlockSink{c: c, flusher: flusher, formatter: formatter, state: streamState, deferStart: retryEmpty != nil}
+
+	// 🔧 客户端断开后首次写入失败即中止，不再读取上游或写入已断开的连接
+	writeAborted := middleware.WriteAborted(c)
+	// 🔧 启用断开取消时，客户端请求context结束即中止，无需等到下一次写入失败
+	var clientGone <-chan struct{}
+	if cancelOnDisconnect() {
+		clientGone = c.Request.Context().Done()
+	}
+
+	// 🔧 保活：在间隔内没有其他事件时发送ping，避免慢速生成时客户端超时断开
+	var pingC <-chan time.Time
+	if interval := pingInterval(); interval > 0 {
+		pingTicker := time.NewTicker(interval)
+		defer pingTicker.Stop()
+		pingC = pingTicker.C
+	}
+
+	// streamUpstream 读取一次上游响应并交给组装器输出，返回上游读取错误与客户端是否已断开
+	streamUpstream := func(resp *http.Response, assembler *responseAssembler) (streamErr error, clientLost bool) {
+		processCtx, processCancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer processCancel()
+
+		// 上游读取放到独立goroutine，主循环可在等待期间发送ping，所有写操作仍在当前goroutine完成
+		events := readUpstreamEvents(processCtx, NewSSEStreamParser(resp.Body))
+
+	readLoop:
+		for {
+			var event string
+			select {
+			case <-writeAborted:
+				break readLoop
+			case <-clientGone:
+				break readLoop
+			default:
+			}
+			select {
+			case <-writeAborted:
+				break readLoop
+			case <-clientGone:
+				break readLoop
+			case upstreamEvent, ok := <-events:
+				if !ok {
+					break readLoop
+				}
+				if upstreamEvent.err != nil {
+					if upstreamEvent.err != io.EOF && !abruptEOFWithToolCalls(upstreamEvent.err, assembler.finishSeen, assembler.session) {
+						utils.DebugLog("[Request:%s] Stream parsing stopped: %v", requestID, upstreamEvent.err)
+						streamErr = upstreamEvent.err
+					}
+					break readLoop
+				}
+				event = upstreamEvent.data
+			case <-pingC:
+				streamState.SendPingIfIdle(c, flusher, formatter, pingInterval())
+				continue
+			case <-streamState.pendingFlushTimer():
+				// 等待上游期间缓冲的增量事件到期，刷新以保证低延迟
+				streamState.FlushPending(flusher)
+				continue
+			}
 
-			if argsStr == "" {
-				inputObj = map[string]any{}
-			} else if err := utils.FastUnmarshal([]byte(argsStr), &inputObj); err != nil {
-				inputObj = map[string]any{"raw_args": argsStr}
+			if event == "" {
+				continue
 			}
+			trace.recordEvent(event)
 
-			contentBlocks = append(contentBlocks, utils.ContentBlock{
-				Type:  "tool_use",
-				ID:    tool.ID,
-				Name:  tool.Name,
-				Input: inputObj,
-			})
+			if rawData, ok := extractUpstreamData(event); ok && assembler.handleData(rawData) {
+				streamState.SendPing(c, flusher, formatter)
+			}
+			if assembler.err != nil {
+				streamErr = assembler.err
+				break readLoop
+			}
 		}
-	}
-	return contentBlocks
-}
 
-// filterAndDefaultContent 过滤空内容并提供默认值
-func filterAndDefaultContent(contentBlocks []utils.ContentBlock) []utils.ContentBlock {
-	if len(contentBlocks) > 0 {
-		filtered := make([]utils.ContentBlock, 0, len(contentBlocks))
-		for _, b := range contentBlocks {
-			if b.Type == "text" {
-				if strings.TrimSpace(b.Text) != "" {
-					filtered = append(filtered, b)
+		// 客户端已断开：取消上游读取，丢弃未输出的内容
+		select {
+		case <-writeAborted:
+			clientLost = true
+		case <-clientGone:
+			clientLost = true
+			utils.DebugLog("[Request:%s] Client disconnected mid-stream, cancelling upstream", requestID)
+		default:
+		}
+		return streamErr, clientLost
+	}
+
+	assembler := newResponseAssembler(requestID, stopSequences, toolManager.session, sink, streamToolArgsEnabled())
+	streamErr, clientLost := streamUpstream(resp, assembler)
+
+	// 🔧 上游返回200但没有任何内容和工具调用：message_start尚未发送时可透明地重新请求一次
+	if streamErr == nil && !clientLost && assembler.empty() {
+		log.Printf("[Request:%s] Upstream returned an empty response (no content, no tool calls)", requestID)
+		if retryEmpty != nil && !streamState.messageStartSent {
+			if retryResp, ok := retryEmpty(); ok {
+				defer retryResp.Body.Close()
+				assembler = newResponseAssembler(requestID, stopSequences, newToolCallsSession(requestID), sink, streamToolArgsEnabled())
+				streamErr, clientLost = streamUpstream(retryResp, assembler)
+				if streamErr == nil && !clientLost && assembler.empty() {
+					log.Printf("[Request:%s] Empty-response retry did not produce content, using fallback text", requestID)
+				} else {
+					utils.DebugLog("[Request:%s] Empty-response retry succeeded", requestID)
 				}
-			} else {
-				filtered = append(filtered, b)
 			}
 		}
-		contentBlocks = filtered
 	}
 
-	if len(contentBlocks) == 0 {
-		contentBlocks = []utils.ContentBlock{{Type: "text", Text: "处理完成"}}
+	if clientLost {
+		c.Set(errorMessageKey, "Client connection lost")
+		assembler.discardToolCalls()
+		return &ResponseData{Usage: assembler.usage, IsToolCall: assembler.toolBlocks > 0}
+	}
+
+	// 🔧 上游中途出错：保留已输出的块，关闭打开的块并输出参数已完整的工具调用后以error事件结束
+	if streamErr != nil {
+		stopReason := assembler.abort()
+		message := fmt.Sprintf("Upstream stream interrupted: %v", streamErr)
+		if assembler.err != nil {
+			message = fmt.Sprintf("Tool call aborted: %v", assembler.err)
+		}
+		sink.flushStart()
+		streamState.AbortWithError(c, flusher, formatter, "api_error", message, stopReason, assembler.usage)
+		c.Set(errorMessageKey, message)
+		return &ResponseData{StopReason: stopReason, Usage: assembler.usage, IsToolCall: assembler.toolBlocks > 0, ToolCalls: assembler.toolBlocks}
 	}
-	return contentBlocks
+
+	data := assembler.finish()
+	streamState.SetStopSequence(data.StopSequence)
+	streamState.FinishStreamWithUsage(c, flusher, formatter, data.StopReason, assembler.usage)
+	return data
+}
+
+// upstreamEvent 上游SSE事件读取结果
+type upstreamEvent struct {
+	data string
+	err  error
+}
+
+// readUpstreamEvents 在独立goroutine中持续读取上游事件，读取出错（含EOF）后关闭通道
+func readUpstreamEvents(ctx context.Context, parser *SSEStreamParser) <-chan upstreamEvent {
+	events := make(chan upstreamEvent)
+	go func() {
+		defer close(events)
+		for {
+			event, err := parser.NextEvent(ctx)
+			select {
+			case events <- upstreamEvent{data: event, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// forwardThinkingEnabled 是否将上游reasoning_content转换为Anthropic thinking块输出（部分客户端不接受thinking块，默认关闭）
+func forwardThinkingEnabled() bool {
+	return utils.EnvBool("CODEBUDDY2CC_FORWARD_THINKING")
+}
+
+// streamToolArgsEnabled 是否将上游工具参数片段实时转发给流式客户端（默认累积后统一输出）
+func streamToolArgsEnabled() bool {
+	return utils.EnvBool("CODEBUDDY2CC_STREAM_TOOL_ARGS")
+}
+
+// pingInterval SSE保活ping间隔，0表示关闭
+func pingInterval() time.Duration {
+	return time.Duration(utils.EnvInt("CODEBUDDY2CC_PING_INTERVAL", 15)) * time.Second
 }
 
 // writeStreamResponse SSE流式输出（OCP原则）
 func writeStreamResponse(c *gin.Context, data *ResponseData) {
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
-	c.Header("Connection", "keep-alive")
-	c.Header("X-Accel-Buffering", "no")
-
-	flusher, ok := c.Writer.(http.Flusher)
+	flusher, ok := prepareStreamWriter(c)
 	if !ok {
-		utils.DebugLog("ERROR: Streaming not supported")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
 		return
 	}
 
 	// 使用原子化状态管理器
-	streamState := NewSSEStreamState()
+	streamState := NewSSEStreamState(c.GetString(utils.RequestIDKey))
+	defer stats.recordStream(streamState)
 	formatter := utils.NewAnthropicSSEFormatter()
 
 	// 确保流正确关闭
@@ -1106,63 +2136,40 @@ func writeStreamResponse(c *gin.Context, data *ResponseData) {
 	}()
 
 	// 发送message_start
-	streamState.EnsureMessageStart(c, flusher, formatter, data.MessageID, data.MessageModel)
-
-	// 处理工具调用输出
-	if data.IsToolCall {
-		// 直接从处理后的数据构建工具调用输出，避免重复处理
-		for idx, block := range data.ContentBlocks {
-			if block.Type == "tool_use" {
-				// 发送content_block_start
-				additional := map[string]any{
-					"id":    block.ID,
-					"name":  block.Name,
-					"input": map[string]any{},
+	streamState.EnsureMessageStart(c, flusher, formatter, data.MessageID, data.MessageModel, data.Usage)
+	streamState.SetStopSequence(data.StopSequence)
+
+	// 按顺序输出全部内容块，索引由状态管理器统一递增，与非流式响应的content顺序保持一致
+	for _, block := range data.ContentBlocks {
+		switch block.Type {
+		case "text":
+			if strings.TrimSpace(block.Text) == "" {
+				continue
+			}
+			streamState.EnsureContentBlockStart(c, flusher, formatter, "text")
+			for _, chunk := range splitUTF8SafeChunks(block.Text, streamChunkSize) {
+				if chunk != "" {
+					streamState.SendTextDelta(c, flusher, formatter, chunk)
 				}
-				startLine := formatter.FormatContentBlockStart(idx, "tool_use", additional)
-				c.Writer.WriteString(startLine)
-				flusher.Flush()
-
-				// 发送工具参数
-				if block.Input != nil {
-					if inputBytes, err := utils.FastMarshal(block.Input); err == nil {
-						chunks := splitUTF8SafeChunks(string(inputBytes), 64)
-						for _, chunk := range chunks {
-							if chunk != "" {
-								deltaLine := formatter.FormatContentBlockDelta(idx, "input_json_delta", chunk)
-								c.Writer.WriteString(deltaLine)
-								flusher.Flush()
-							}
-						}
-					}
+			}
+			streamState.FinishContentBlock(c, flusher, formatter)
+		case "thinking":
+			streamState.EnsureContentBlockStart(c, flusher, formatter, "thinking")
+			for _, chunk := range splitUTF8SafeChunks(block.Thinking, streamChunkSize) {
+				if chunk != "" {
+					streamState.SendThinkingDelta(c, flusher, formatter, chunk)
 				}
-
-				// 发送content_block_stop
-				stopLine := formatter.FormatContentBlockStop(idx)
-				c.Writer.WriteString(stopLine)
-				flusher.Flush()
 			}
-		}
-	} else {
-		// 处理文本内容
-		for idx, block := range data.ContentBlocks {
-			if block.Type == "text" && strings.TrimSpace(block.Text) != "" {
-				// 发送content_block_start
-				streamState.EnsureContentBlockStart(c, flusher, formatter, "text")
-
-				// 分块发送文本内容
-				chunks := splitUTF8SafeChunks(block.Text, 64)
-				for _, chunk := range chunks {
-					if chunk != "" {
-						deltaEvent := formatter.FormatContentBlockDelta(idx, "text_delta", chunk)
-						c.Writer.WriteString(deltaEvent)
-						flusher.Flush()
-					}
+			streamState.SendSignatureDelta(c, flusher, formatter, block.Signature)
+			streamState.FinishContentBlock(c, flusher, formatter)
+		case "tool_use":
+			argsJSON := "{}"
+			if block.Input != nil {
+				if inputBytes, err := utils.FastMarshal(block.Input); err == nil {
+					argsJSON = string(inputBytes)
 				}
-
-				// 结束content block
-				streamState.FinishContentBlock(c, flusher, formatter)
 			}
+			streamState.WriteToolUseBlock(c, flusher, formatter, block.ID, block.Name, argsJSON)
 		}
 	}
 
@@ -1180,289 +2187,63 @@ func writeNonStreamResponse(c *gin.Context, data *ResponseData) {
 		Content:      data.ContentBlocks,
 		Model:        data.MessageModel,
 		StopReason:   &data.StopReason,
-		StopSequence: nil,
+		StopSequence: data.StopSequence,
 		Usage:        data.Usage,
 	}
 
-	c.JSON(http.StatusOK, anthResp)
+	stats.recordContentBlocks(data.ContentBlocks)
+	writeCompressibleJSON(c, http.StatusOK, anthResp)
 }
 
-// convertAndOutputAnthropicToolCalls 转换为Anthropic格式并输出 - 符合规范的流式格式
-func (session *ToolCallsSession) convertAndOutputAnthropicToolCalls(c *gin.Context, flusher http.Flusher) bool {
-	if len(session.toolCallsOrder) == 0 {
-		return false
-	}
-
-	utils.DebugLog("Converting %d tool calls to Anthropic streaming format", len(session.toolCallsOrder))
-
-	// 创建符合规范的SSE格式化器
-	formatter := utils.NewAnthropicSSEFormatter()
-
-	// 为每个工具发送符合规范的流式事件序列
-	for idx, tool := range session.toolCallsOrder {
-		if tool.Name == "" {
-			utils.DebugLog("Skipping tool with empty name: id=%s", tool.ID)
-			continue
-		}
-
-		// 🎯 KISS简化：直接使用工具ID，无需复杂映射
-		// 1. 发送content_block_start事件 (仅包含基本信息，符合Anthropic规范)
-		additional := map[string]any{
-			"id":   tool.ID, // 直接使用原始工具ID
-			"name": tool.Name,
-			// 🎯 关键修复：content_block_start不包含input，符合Anthropic流式规范
-		}
-		startLine := formatter.FormatContentBlockStart(idx, "tool_use", additional)
-		utils.DebugLog("Sending to client[tool-start]: %s", strings.TrimSpace(startLine))
-		c.Writer.WriteString(startLine)
-
-		// 2. 通过input_json_delta发送工具参数 (符合Anthropic规范的增量格式)
-		argsStr := strings.TrimSpace(tool.Arguments.String())
-		if argsStr == "" {
-			argsStr = "{}"
-		} else {
-			// 验证JSON格式
-			var testObj map[string]any
-			if err := utils.FastUnmarshal([]byte(argsStr), &testObj); err != nil {
-				utils.DebugLog("Invalid JSON for tool %s, using fallback: %v", tool.Name, err)
-				argsStr = `{"raw_args":"` + strings.ReplaceAll(argsStr, `"`, `\"`) + `"}`
-			}
-		}
-
-		// 分块发送JSON参数以符合Anthropic input_json_delta规范
-		session.sendInputJsonDeltasWithFormatter(c, flusher, idx, argsStr, formatter)
-
-		// 3. 发送content_block_stop事件
-		stopLine := formatter.FormatContentBlockStop(idx)
-		utils.DebugLog("Sending to client[tool-stop]: %s", strings.TrimSpace(stopLine))
-		c.Writer.WriteString(stopLine)
-
-		utils.DebugLog("Sent Anthropic tool_use stream: idx=%d id=%s name=%s", idx, tool.ID, tool.Name)
-	}
-
-	// 发送message完成事件
-	deltaLine := formatter.FormatMessageDelta("tool_use", nil)
-	utils.DebugLog("Sending to client[msg-delta]: %s", strings.TrimSpace(deltaLine))
-	c.Writer.WriteString(deltaLine)
-	flusher.Flush()
-
-	stopLine := formatter.FormatMessageStop(nil)
-	utils.DebugLog("Sending to client[msg-stop]: %s", strings.TrimSpace(stopLine))
-	c.Writer.WriteString(stopLine)
-	flusher.Flush()
-
-	utils.DebugLog("Anthropic tool calls streaming completed: sent %d tools", len(session.toolCallsOrder))
-
-	// 🔧 关键修复：彻底清理会话状态，避免重复发送和内存泄漏
-	session.clearToolCallsWithLogging()
-
-	return true
-}
-
-// convertAndOutputAnthropicToolCallsWithState 只输出工具调用内容，不发送message结束事件，但支持事件记录
-// 🔧 核心新增：为工具调用添加事件序列记录功能
-func (session *ToolCallsSession) convertAndOutputAnthropicToolCallsWithState(c *gin.Context, flusher http.Flusher, streamState *SSEStreamState) bool {
-	if len(session.toolCallsOrder) == 0 {
-		return false
-	}
-
-	utils.DebugLog("Converting %d tool calls to Anthropic streaming format with state tracking", len(session.toolCallsOrder))
-
-	// 创建符合规范的SSE格式化器
-	formatter := utils.NewAnthropicSSEFormatter()
-
-	// 为每个工具发送符合规范的流式事件序列（不包括最终message事件）
-	for idx, tool := range session.toolCallsOrder {
-		if tool.Name == "" {
-			utils.DebugLog("Skipping tool with empty name: id=%s", tool.ID)
-			continue
-		}
-
-		// 🔧 核心修复：记录content_block_start事件
-		if err := streamState.recordEvent(utils.SSEEventContentBlockStart); err != nil {
-			utils.DebugLog("Warning: tool content_block_start validation failed: %v", err)
-		}
-
-		// 🔧 核心修复：正确设置content block状态
-		streamState.contentBlockStarted = true
-		streamState.currentBlockIndex = idx
-
-		// 1. 发送content_block_start事件（包含完整的工具信息，符合Anthropic规范）
-		additional := map[string]any{
-			"id":    tool.ID,
-			"name":  tool.Name,
-			"input": map[string]any{}, // 🔧 关键修复：添加空的input字段，符合Anthropic规范
-		}
-		startLine := formatter.FormatContentBlockStart(idx, "tool_use", additional)
-		utils.DebugLog("Sending to client[tool-start]: %s", strings.TrimSpace(startLine))
-		c.Writer.WriteString(startLine)
-		flusher.Flush()
-
-		// 2. 发送工具参数
-		argsStr := strings.TrimSpace(tool.Arguments.String())
-		if argsStr == "" {
-			argsStr = "{}"
-		} else {
-			// 验证JSON格式
-			var testObj map[string]any
-			if err := utils.FastUnmarshal([]byte(argsStr), &testObj); err != nil {
-				utils.DebugLog("Invalid JSON for tool %s, using fallback: %v", tool.Name, err)
-				argsStr = `{"raw_args":"` + strings.ReplaceAll(argsStr, `"`, `\"`) + `"}`
-			}
-		}
-
-		// 分块发送JSON参数
-		session.sendInputJsonDeltasWithFormatterAndState(c, flusher, idx, argsStr, formatter, streamState)
-
-		// 🔧 核心修复：记录content_block_stop事件
-		if err := streamState.recordEvent(utils.SSEEventContentBlockStop); err != nil {
-			utils.DebugLog("Warning: tool content_block_stop validation failed: %v", err)
-		}
+const (
+	defaultStreamChunkSize = 64
+	// minStreamChunkSize 不小于单个UTF-8字符的最大字节数，保证分块时总能在字符边界切割
+	minStreamChunkSize = utf8.UTFMax
+)
 
-		// 3. 发送content_block_stop事件
-		stopLine := formatter.FormatContentBlockStop(idx)
-		utils.DebugLog("Sending to client[tool-stop]: %s", strings.TrimSpace(stopLine))
-		c.Writer.WriteString(stopLine)
-		flusher.Flush()
+// defaultRequestTimeout 默认请求超时时间
+const defaultRequestTimeout = 600 * time.Second
 
-		// 🔧 核心修复：确保状态正确更新，防止重复关闭
-		streamState.contentBlockStarted = false
-		streamState.currentBlockIndex++
+// requestTimeout 上游请求及响应处理的超时时间，启动时由InitRequestTimeout读取配置
+var requestTimeout = defaultRequestTimeout
 
-		utils.DebugLog("Sent Anthropic tool_use stream: idx=%d id=%s name=%s", idx, tool.ID, tool.Name)
+// InitRequestTimeout 读取 CODEBUDDY2CC_TIMEOUT（秒）配置请求超时，非法值回退到默认值
+func InitRequestTimeout() {
+	seconds := utils.EnvInt("CODEBUDDY2CC_TIMEOUT", int(defaultRequestTimeout/time.Second))
+	if seconds <= 0 {
+		log.Printf("Warning: invalid CODEBUDDY2CC_TIMEOUT %d (must be > 0), using default %s", seconds, defaultRequestTimeout)
+		requestTimeout = defaultRequestTimeout
+		return
 	}
-
-	utils.DebugLog("Anthropic tool calls content streaming completed: sent %d tools (no message end events)", len(session.toolCallsOrder))
-
-	// 🔧 关键修复：清理会话状态，但不发送message结束事件
-	session.clearToolCallsWithLogging()
-
-	return true
+	requestTimeout = time.Duration(seconds) * time.Second
 }
 
-// sendInputJsonDeltasWithFormatterAndState 发送符合Anthropic规范的input_json_delta事件序列（增强UTF-8安全和事件记录）
-// 🔧 核心新增：为工具参数发送添加事件记录
-func (session *ToolCallsSession) sendInputJsonDeltasWithFormatterAndState(c *gin.Context, flusher http.Flusher, index int, jsonStr string, formatter *utils.AnthropicSSEFormatter, streamState *SSEStreamState) {
-	// 🔧 关键修复：确保JSON字符串是有效的UTF-8编码
-	if !utf8.ValidString(jsonStr) {
-		utils.DebugLog("Invalid UTF-8 in JSON string, attempting to fix")
-		jsonStr = strings.ToValidUTF8(jsonStr, "﷿")
-	}
-
-	// 🔧 增强：使用UTF-8安全的智能分块算法
-	chunks := splitUTF8SafeChunks(jsonStr, 64) // 增大块大小并确保UTF-8安全
-
-	for i, chunk := range chunks {
-		if chunk == "" {
-			continue // 跳过空块
-		}
-
-		// 验证每个块都是有效的UTF-8
-		if !utf8.ValidString(chunk) {
-			utils.DebugLog("Invalid UTF-8 chunk detected at index %d, skipping", i)
-			continue
-		}
-
-		// 🔧 核心修复：记录每个content_block_delta事件
-		if err := streamState.recordEvent(utils.SSEEventContentBlockDelta); err != nil {
-			utils.DebugLog("Warning: tool json delta validation failed: %v", err)
-		}
+// streamChunkSize 文本与工具参数分块输出的字节数，启动时由InitStreamChunkSize读取配置
+var streamChunkSize = defaultStreamChunkSize
 
-		deltaLine := formatter.FormatContentBlockDelta(index, "input_json_delta", chunk)
-		utils.DebugLog("Sending to client[json-delta-%d]: %s", i, strings.TrimSpace(deltaLine))
-		c.Writer.WriteString(deltaLine)
-		flusher.Flush()
+// InitStreamChunkSize 读取 CODEBUDDY2CC_CHUNK_SIZE 配置分块大小，非法值回退到默认值
+func InitStreamChunkSize() {
+	size := utils.EnvInt("CODEBUDDY2CC_CHUNK_SIZE", defaultStreamChunkSize)
+	if size < minStreamChunkSize {
+		log.Printf("Warning: invalid CODEBUDDY2CC_CHUNK_SIZE %d (must be >= %d), using default %d", size, minStreamChunkSize, defaultStreamChunkSize)
+		size = defaultStreamChunkSize
 	}
+	streamChunkSize = size
 }
 
-// convertAndOutputAnthropicToolCallsOnly 只输出工具调用内容，不发送message结束事件（保留版本）
-func (session *ToolCallsSession) convertAndOutputAnthropicToolCallsOnly(c *gin.Context, flusher http.Flusher) bool {
-	if len(session.toolCallsOrder) == 0 {
-		return false
+// truncateUTF8 将字符串截断到不超过maxBytes字节，且不在UTF-8字符中间切割
+func truncateUTF8(input string, maxBytes int) string {
+	if maxBytes <= 0 {
+		return ""
 	}
-
-	utils.DebugLog("Converting %d tool calls to Anthropic streaming format (content only)", len(session.toolCallsOrder))
-
-	// 创建符合规范的SSE格式化器
-	formatter := utils.NewAnthropicSSEFormatter()
-
-	// 为每个工具发送符合规范的流式事件序列（不包括message结束事件）
-	for idx, tool := range session.toolCallsOrder {
-		if tool.Name == "" {
-			utils.DebugLog("Skipping tool with empty name: id=%s", tool.ID)
-			continue
-		}
-
-		// 1. 发送content_block_start事件
-		additional := map[string]any{
-			"id":   tool.ID,
-			"name": tool.Name,
-		}
-		startLine := formatter.FormatContentBlockStart(idx, "tool_use", additional)
-		utils.DebugLog("Sending to client[tool-start]: %s", strings.TrimSpace(startLine))
-		c.Writer.WriteString(startLine)
-		flusher.Flush()
-
-		// 2. 发送工具参数
-		argsStr := strings.TrimSpace(tool.Arguments.String())
-		if argsStr == "" {
-			argsStr = "{}"
-		} else {
-			// 验证JSON格式
-			var testObj map[string]any
-			if err := utils.FastUnmarshal([]byte(argsStr), &testObj); err != nil {
-				utils.DebugLog("Invalid JSON for tool %s, using fallback: %v", tool.Name, err)
-				argsStr = `{"raw_args":"` + strings.ReplaceAll(argsStr, `"`, `\"`) + `"}`
-			}
-		}
-
-		// 分块发送JSON参数
-		session.sendInputJsonDeltasWithFormatter(c, flusher, idx, argsStr, formatter)
-
-		// 3. 发送content_block_stop事件
-		stopLine := formatter.FormatContentBlockStop(idx)
-		utils.DebugLog("Sending to client[tool-stop]: %s", strings.TrimSpace(stopLine))
-		c.Writer.WriteString(stopLine)
-		flusher.Flush()
-
-		utils.DebugLog("Sent Anthropic tool_use stream: idx=%d id=%s name=%s", idx, tool.ID, tool.Name)
+	if len(input) <= maxBytes {
+		return input
 	}
-
-	utils.DebugLog("Anthropic tool calls content streaming completed: sent %d tools (no message end events)", len(session.toolCallsOrder))
-
-	// 🔧 关键修复：清理会话状态，但不发送message结束事件
-	session.clearToolCallsWithLogging()
-
-	return true
-}
-
-// sendInputJsonDeltasWithFormatter 发送符合Anthropic规范的input_json_delta事件序列（增强UTF-8安全）
-func (session *ToolCallsSession) sendInputJsonDeltasWithFormatter(c *gin.Context, flusher http.Flusher, index int, jsonStr string, formatter *utils.AnthropicSSEFormatter) {
-	// 🔧 关键修复：确保JSON字符串是有效的UTF-8编码
-	if !utf8.ValidString(jsonStr) {
-		utils.DebugLog("Invalid UTF-8 in JSON string, attempting to fix")
-		jsonStr = strings.ToValidUTF8(jsonStr, "�")
-	}
-
-	// 🔧 增强：使用UTF-8安全的智能分块算法
-	chunks := splitUTF8SafeChunks(jsonStr, 64) // 增大块大小并确保UTF-8安全
-
-	for i, chunk := range chunks {
-		if chunk == "" {
-			continue // 跳过空块
-		}
-
-		// 验证每个块都是有效的UTF-8
-		if !utf8.ValidString(chunk) {
-			utils.DebugLog("Invalid UTF-8 chunk detected at index %d, skipping", i)
-			continue
-		}
-
-		deltaLine := formatter.FormatContentBlockDelta(index, "input_json_delta", chunk)
-		utils.DebugLog("Sending to client[json-delta-%d]: %s", i, strings.TrimSpace(deltaLine))
-		c.Writer.WriteString(deltaLine)
-		flusher.Flush()
+	end := maxBytes
+	for end > 0 && !utf8.RuneStart(input[end]) {
+		end--
 	}
+	return input[:end]
 }
 
 // splitUTF8SafeChunks 将字符串分割为UTF-8安全的块
@@ -0,0 +1,946 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"codebuddy2cc/middleware"
+	"codebuddy2cc/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestContext 构造携带指定请求体的gin上下文，返回响应记录器
+func newTestContext(method, target, body string) (*gin.Context, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(method, target, strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	return c, recorder
+}
+
+// decodeUseNumber 以json.Number解码，便于逐字比较数字
+func decodeUseNumber(t *testing.T, data string) any {
+	t.Helper()
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		t.Fatalf("decode %q: %v", data, err)
+	}
+	return v
+}
+
+// fakeUpstream 按顺序返回预设SSE响应体的上游服务，记录收到的请求
+type fakeUpstream struct {
+	mu       sync.Mutex
+	bodies   []string        // 第n次请求返回bodies[n]，超出时重复最后一个
+	statuses []int           // 第n次请求返回的状态码，未设置时为200
+	requests []*http.Request // 收到的请求（不含请求体）
+	payloads []string        // 收到的请求体
+}
+
+// startFakeUpstream 启动上游服务并通过环境变量指向它
+func startFakeUpstream(t *testing.T, bodies ...string) *fakeUpstream {
+	t.Helper()
+	upstream := &fakeUpstream{bodies: bodies}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		upstream.mu.Lock()
+		n := len(upstream.requests)
+		upstream.requests = append(upstream.requests, r)
+		upstream.payloads = append(upstream.payloads, string(payload))
+		status := http.StatusOK
+		if n < len(upstream.statuses) {
+			status = upstream.statuses[n]
+		}
+		upstream.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(status)
+		io.WriteString(w, upstream.bodies[min(n, len(upstream.bodies)-1)])
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("CODEBUDDY2CC_UPSTREAM_URL", server.URL)
+	t.Setenv("CODEBUDDY2CC_KEYS", "")
+	t.Setenv("CODEBUDDY2CC_KEY", "test-key")
+	return upstream
+}
+
+// requestCount 返回上游收到的请求数
+func (u *fakeUpstream) requestCount() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.requests)
+}
+
+// upstreamRequest 返回上游收到的第n个请求及解码后的请求体
+func (u *fakeUpstream) upstreamRequest(t *testing.T, n int) (*http.Request, utils.OpenAIRequest) {
+	t.Helper()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if n >= len(u.requests) {
+		t.Fatalf("upstream received %d requests, want at least %d", len(u.requests), n+1)
+	}
+	var payload utils.OpenAIRequest
+	if err := json.Unmarshal([]byte(u.payloads[n]), &payload); err != nil {
+		t.Fatalf("decode upstream payload: %v", err)
+	}
+	return u.requests[n], payload
+}
+
+// systemText 拼接上游请求中system消息的全部文本，没有system消息时返回空字符串
+func systemText(payload utils.OpenAIRequest) string {
+	var b strings.Builder
+	for _, msg := range payload.Messages {
+		if msg.Role != "system" {
+			continue
+		}
+		switch content := msg.Content.(type) {
+		case string:
+			b.WriteString(content)
+		case []any:
+			for _, block := range content {
+				if m, ok := block.(map[string]any); ok {
+					text, _ := m["text"].(string)
+					b.WriteString(text)
+				}
+			}
+		}
+	}
+	return b.String()
+}
+
+func TestBindMessagesRequestPreservesToolInputFidelity(t *testing.T) {
+	const objectInput = `{"big":12345678901234567890,"pi":3.14159265358979323846,"tiny":1e-7,"neg":-0.10,` +
+		`"list":[1,2.50,[3,{"deep":0.1}]],"nested":{"id":9007199254740993,"ok":true,"none":null}}`
+
+	tests := []struct {
+		name  string
+		input string // 请求JSON中tool_use.input的原文
+		want  string // 期望的OpenAI arguments（按json.Number语义比较）
+	}{
+		{name: "nested numbers arrays objects", input: objectInput, want: objectInput},
+		{name: "string holding json object", input: `"{\"path\":\"a.go\",\"line\":12}"`, want: `{"path":"a.go","line":12}`},
+		{name: "numeric string keeps type", input: `"42"`, want: `"42"`},
+		{name: "boolean string keeps type", input: `"true"`, want: `"true"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"model":"test-model","max_tokens":16,"messages":[` +
+				`{"role":"user","content":"run it"},` +
+				`{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"run","input":` + tt.input + `}]},` +
+				`{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"done"}]}]}`
+			c, _ := newTestContext(http.MethodPost, "/v1/messages", body)
+
+			var req utils.AnthropicRequest
+			if err := bindMessagesRequest(c, &req); err != nil {
+				t.Fatalf("bindMessagesRequest: %v", err)
+			}
+			openAIReq, err := utils.ConvertAnthropicToOpenAI(context.Background(), &req)
+			if err != nil {
+				t.Fatalf("ConvertAnthropicToOpenAI: %v", err)
+			}
+
+			var arguments string
+			for _, msg := range openAIReq.Messages {
+				for _, call := range msg.ToolCalls {
+					arguments = call.Function.Arguments
+				}
+			}
+			if arguments == "" {
+				t.Fatalf("no tool call in converted request: %+v", openAIReq.Messages)
+			}
+			if got, want := decodeUseNumber(t, arguments), decodeUseNumber(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Fatalf("arguments = %s, want %s", arguments, tt.want)
+			}
+			for _, literal := range []string{"12345678901234567890", "3.14159265358979323846", "9007199254740993"} {
+				if strings.Contains(tt.want, literal) && !strings.Contains(arguments, literal) {
+					t.Fatalf("arguments lost literal %s: %s", literal, arguments)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveClientStream(t *testing.T) {
+	tests := []struct {
+		mode       string
+		accept     string
+		bodyStream bool
+		want       bool
+	}{
+		{mode: "", accept: "application/json", bodyStream: true, want: true},
+		{mode: "", accept: "text/event-stream", bodyStream: false, want: false},
+		{mode: "body", accept: "application/json", bodyStream: true, want: true},
+		{mode: "json", accept: "application/json", bodyStream: true, want: false},
+		{mode: "json", accept: "text/event-stream", bodyStream: false, want: false},
+		{mode: "json", accept: "application/json, text/event-stream", bodyStream: true, want: true},
+		{mode: "accept", accept: "text/event-stream", bodyStream: false, want: true},
+		{mode: "accept", accept: "application/json", bodyStream: true, want: false},
+		{mode: "accept", accept: "*/*", bodyStream: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+tt.accept, func(t *testing.T) {
+			t.Setenv("CODEBUDDY2CC_STREAM_PRECEDENCE", tt.mode)
+			c, _ := newTestContext(http.MethodPost, "/v1/messages", "{}")
+			c.Request.Header.Set("Accept", tt.accept)
+			if got := resolveClientStream(c, tt.bodyStream); got != tt.want {
+				t.Fatalf("resolveClientStream(body=%v) = %v, want %v", tt.bodyStream, got, tt.want)
+			}
+		})
+	}
+}
+
+// useModelMapping 在临时目录写入model.json并加载，测试结束后恢复工作目录并重新加载原映射
+func useModelMapping(t *testing.T, config string) {
+	t.Helper()
+	t.Cleanup(func() { utils.LoadModelMapping() })
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("model.json", []byte(config), 0o644); err != nil {
+		t.Fatalf("write model.json: %v", err)
+	}
+	if err := utils.LoadModelMapping(); err != nil {
+		t.Fatalf("LoadModelMapping: %v", err)
+	}
+}
+
+func TestContextPreflightUsesMappedModelWindow(t *testing.T) {
+	t.Setenv("CODEBUDDY2CC_CONTEXT_PREFLIGHT", "1")
+	useModelMapping(t, `{
+		"models": {"claude-alias": "small-upstream"},
+		"metadata": {"claude-alias": {"context_window": 1000000}, "small-upstream": {"context_window": 200}}
+	}`)
+
+	body := `{"model":"claude-alias","max_tokens":50,"messages":[{"role":"user","content":"` + strings.Repeat("lorem ipsum ", 100) + `"}]}`
+	c, recorder := newTestContext(http.MethodPost, "/v1/messages", body)
+	MessagesHandler(c)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400; body: %s", recorder.Code, recorder.Body.String())
+	}
+	var errResp struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &errResp); err != nil {
+		t.Fatalf("decode error response: %v", err)
+	}
+	if !strings.HasSuffix(errResp.Error.Message, "max_tokens > 200") {
+		t.Fatalf("error should report the mapped model's window: %s", errResp.Error.Message)
+	}
+}
+
+func TestRetryOnEmptyResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		stream       bool
+		retry        string
+		wantRequests int
+		wantText     string
+	}{
+		{name: "stream retries before message_start", stream: true, retry: "1", wantRequests: 2, wantText: "retried answer"},
+		{name: "buffered retries", stream: false, retry: "1", wantRequests: 2, wantText: "retried answer"},
+		{name: "buffered without retry uses fallback", stream: false, retry: "", wantRequests: 1, wantText: utils.FallbackText(utils.FallbackEmptyResponse)},
+		{name: "stream without retry uses fallback", stream: true, retry: "", wantRequests: 1, wantText: utils.FallbackText(utils.FallbackEmptyResponse)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CODEBUDDY2CC_RETRY_ON_EMPTY", tt.retry)
+			upstream := startFakeUpstream(t,
+				upstreamSSE(upstreamChunk(t, map[string]any{"role": "assistant", "content": ""}, ""), upstreamChunk(t, nil, "stop"), "[DONE]"),
+				upstreamSSE(upstreamChunk(t, textDelta("retried answer"), ""), upstreamChunk(t, nil, "stop"), "[DONE]"),
+			)
+
+			body := `{"model":"test-model","max_tokens":16,"stream":` + strconv.FormatBool(tt.stream) +
+				`,"messages":[{"role":"user","content":"hi"}]}`
+			c, recorder := newTestContext(http.MethodPost, "/v1/messages", body)
+			MessagesHandler(c)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, body: %s", recorder.Code, recorder.Body.String())
+			}
+			if got := upstream.requestCount(); got != tt.wantRequests {
+				t.Fatalf("upstream requests = %d, want %d", got, tt.wantRequests)
+			}
+
+			var blocks []utils.ContentBlock
+			if tt.stream {
+				blocks = reconstructMessage(t, parseSSE(t, recorder.Body.String())).blocks
+			} else {
+				var resp utils.AnthropicResponse
+				if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("decode response: %v", err)
+				}
+				blocks = resp.Content
+			}
+			if len(blocks) != 1 || blocks[0].Type != "text" || blocks[0].Text != tt.wantText {
+				t.Fatalf("content = %+v, want single text %q", blocks, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestSSEStreamParserKeepsDataReturnedWithEOF(t *testing.T) {
+	body := upstreamSSE(upstreamChunk(t, textDelta("hello"), ""), "[DONE]")
+	parser := NewSSEStreamParser(iotest.DataErrReader(strings.NewReader(body)))
+
+	var events []string
+	for {
+		event, err := parser.NextEvent(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextEvent: %v", err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 2 || !strings.Contains(events[0], "hello") || events[1] != "data: [DONE]" {
+		t.Fatalf("events = %q", events)
+	}
+}
+
+func TestSSEStreamParserInformationalFrame(t *testing.T) {
+	body := upstreamSSE(
+		upstreamChunk(t, textDelta("Hello, "), ""),
+		"status: warming up",
+		upstreamChunk(t, textDelta("world"), ""),
+		upstreamChunk(t, nil, "stop"),
+		"[DONE]",
+	)
+	tests := []struct {
+		mode      string
+		wantPings int
+		wantLog   bool
+	}{
+		{mode: ""},
+		{mode: "drop"},
+		{mode: "log", wantLog: true},
+		{mode: "ping", wantPings: 1},
+	}
+	for _, tt := range tests {
+		t.Run("mode="+tt.mode, func(t *testing.T) {
+			t.Setenv("CODEBUDDY2CC_UNKNOWN_EVENTS", tt.mode)
+			var logs strings.Builder
+			log.SetOutput(&logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			want := []utils.ContentBlock{{Type: "text", Text: "Hello, world"}}
+			buffered := runBuffered(t, body)
+			if got := normalizeBlocks(t, buffered.ContentBlocks); !reflect.DeepEqual(got, normalizeBlocks(t, want)) {
+				t.Fatalf("buffered content = %v", got)
+			}
+			if buffered.StopReason != "end_turn" {
+				t.Fatalf("buffered stop_reason = %q, want end_turn", buffered.StopReason)
+			}
+
+			c, recorder := newTestContext(http.MethodPost, "/v1/messages", "{}")
+			streamUnifiedResponse(c, newUpstreamResponse(body), NewDefaultToolCallManager("test"), "test", nil, nil, nil)
+			assertSameMessage(t, "informational frame", buffered, reconstructMessage(t, parseSSE(t, recorder.Body.String())))
+			if pings := strings.Count(recorder.Body.String(), "event: ping\n"); pings != tt.wantPings {
+				t.Fatalf("ping events = %d, want %d; body: %s", pings, tt.wantPings, recorder.Body.String())
+			}
+			if logged := strings.Contains(logs.String(), "Unknown upstream event: status: warming up"); logged != tt.wantLog {
+				t.Fatalf("unknown event logged = %v, want %v; logs: %s", logged, tt.wantLog, logs.String())
+			}
+		})
+	}
+}
+
+func TestMalformedUpstreamPastThresholdIsAnError(t *testing.T) {
+	t.Setenv("CODEBUDDY2CC_MAX_MALFORMED_EVENTS", "3")
+	var garbage strings.Builder
+	for i := range 10 {
+		garbage.WriteString("<html>bad gateway " + strconv.Itoa(i) + "</html>\n")
+	}
+	fallback := utils.FallbackText(utils.FallbackEmptyResponse)
+
+	for _, stream := range []bool{false, true} {
+		t.Run("stream="+strconv.FormatBool(stream), func(t *testing.T) {
+			startFakeUpstream(t, garbage.String())
+
+			body := `{"model":"test-model","max_tokens":16,"stream":` + strconv.FormatBool(stream) + `,"messages":[{"role":"user","content":"hi"}]}`
+			c, recorder := newTestContext(http.MethodPost, "/v1/messages", body)
+			MessagesHandler(c)
+
+			response := recorder.Body.String()
+			if strings.Contains(response, fallback) {
+				t.Fatalf("malformed upstream answered with the fallback text: %s", response)
+			}
+			if !stream {
+				if recorder.Code < 500 || !strings.Contains(response, "too many malformed") {
+					t.Fatalf("status = %d, body: %s; want an error response", recorder.Code, response)
+				}
+				return
+			}
+			events := parseSSE(t, response)
+			if len(events) != 1 || events[0].name != "error" || !strings.Contains(response, "too many malformed") {
+				t.Fatalf("events = %+v, want a single malformed upstream error event", events)
+			}
+		})
+	}
+}
+
+func TestMaxTokensCapIsLoggedWithRequestID(t *testing.T) {
+	t.Setenv("CODEBUDDY2CC_MAX_TOKENS_CAP", "100")
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	upstream := startFakeUpstream(t, upstreamSSE(upstreamChunk(t, textDelta("ok"), ""), upstreamChunk(t, nil, "stop"), "[DONE]"))
+
+	body := `{"model":"test-model","max_tokens":500,"messages":[{"role":"user","content":"hi"}]}`
+	c, recorder := newTestContext(http.MethodPost, "/v1/messages", body)
+	MessagesHandler(c)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", recorder.Code, recorder.Body.String())
+	}
+	if _, payload := upstream.upstreamRequest(t, 0); payload.MaxTokens == nil || *payload.MaxTokens != 100 {
+		t.Fatalf("upstream max_tokens = %v, want 100", payload.MaxTokens)
+	}
+	requestID := recorder.Header().Get(requestIDHeader)
+	if want := "[Request:" + requestID + "] Clamping max_tokens 500 to cap 100"; requestID == "" || !strings.Contains(logs.String(), want) {
+		t.Fatalf("logs missing %q without DEBUG; logs: %s", want, logs.String())
+	}
+}
+
+func TestMaxMessagesLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		messages   int
+		wantStatus int
+	}{
+		{name: "at limit", messages: 3, wantStatus: http.StatusOK},
+		{name: "above limit", messages: 4, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CODEBUDDY2CC_MAX_MESSAGES", "3")
+			upstream := startFakeUpstream(t, upstreamSSE(upstreamChunk(t, textDelta("ok"), ""), upstreamChunk(t, nil, "stop"), "[DONE]"))
+
+			messages := make([]string, tt.messages)
+			for i := range messages {
+				role := "user"
+				if i%2 == 1 {
+					role = "assistant"
+				}
+				messages[i] = `{"role":"` + role + `","content":"message ` + strconv.Itoa(i) + `"}`
+			}
+			body := `{"model":"test-model","max_tokens":16,"messages":[` + strings.Join(messages, ",") + `]}`
+			c, recorder := newTestContext(http.MethodPost, "/v1/messages", body)
+			MessagesHandler(c)
+
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body: %s", recorder.Code, tt.wantStatus, recorder.Body.String())
+			}
+			wantRequests := 1
+			if tt.wantStatus != http.StatusOK {
+				wantRequests = 0
+				if !strings.Contains(recorder.Body.String(), "Too many messages: 4 exceeds limit of 3") {
+					t.Fatalf("error body = %s", recorder.Body.String())
+				}
+			}
+			if got := upstream.requestCount(); got != wantRequests {
+				t.Fatalf("upstream requests = %d, want %d", got, wantRequests)
+			}
+		})
+	}
+}
+
+func TestStreamConnectionHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		protoMajor int
+		want       string
+	}{
+		{name: "http/1.1 keeps alive", protoMajor: 1, want: "keep-alive"},
+		{name: "http/2 omits connection header", protoMajor: 2, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startFakeUpstream(t, upstreamSSE(upstreamChunk(t, textDelta("ok"), ""), upstreamChunk(t, nil, "stop"), "[DONE]"))
+
+			body := `{"model":"test-model","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+			c, recorder := newTestContext(http.MethodPost, "/v1/messages", body)
+			c.Request.ProtoMajor = tt.protoMajor
+			MessagesHandler(c)
+
+			if got := recorder.Header().Get("Content-Type"); got != "text/event-stream" {
+				t.Fatalf("Content-Type = %q, body: %s", got, recorder.Body.String())
+			}
+			if got := recorder.Header().Get("Connection"); got != tt.want {
+				t.Fatalf("Connection = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSystemSuffixHeaderOverride(t *testing.T) {
+	custom, empty := "Custom suffix", ""
+	tests := []struct {
+		name   string
+		allow  string
+		header *string
+		want   string // 期望注入的后缀，空表示不注入
+	}{
+		{name: "header overrides suffix", allow: "1", header: &custom, want: "Custom suffix"},
+		{name: "empty header disables suffix", allow: "1", header: &empty, want: ""},
+		{name: "missing header keeps default", allow: "1", want: utils.DefaultSystemSuffix},
+		{name: "header ignored unless allowed", allow: "", header: &custom, want: utils.DefaultSystemSuffix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CODEBUDDY2CC_ALLOW_HEADER_SUFFIX", tt.allow)
+			upstream := startFakeUpstream(t, upstreamSSE(upstreamChunk(t, textDelta("ok"), ""), upstreamChunk(t, nil, "stop"), "[DONE]"))
+
+			body := `{"model":"test-model","max_tokens":16,"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"hi"}]}`
+			c, recorder := newTestContext(http.MethodPost, "/v1/messages", body)
+			if tt.header != nil {
+				c.Request.Header.Set(systemSuffixHeader, *tt.header)
+			}
+			MessagesHandler(c)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, body: %s", recorder.Code, recorder.Body.String())
+			}
+			req, payload := upstream.upstreamRequest(t, 0)
+			if req.Header.Get(systemSuffixHeader) != "" {
+				t.Fatalf("%s forwarded upstream", systemSuffixHeader)
+			}
+			got := systemText(payload)
+			if tt.want == "" {
+				if strings.TrimSpace(got) != "Be brief." {
+					t.Fatalf("system = %q, want original system without suffix", got)
+				}
+				return
+			}
+			if !strings.HasPrefix(got, "Be brief.") || !strings.HasSuffix(got, "--- CodeBuddy Integration ---\n\n"+tt.want) {
+				t.Fatalf("system = %q, want suffix %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamStaticHeaders(t *testing.T) {
+	t.Setenv("CODEBUDDY2CC_UPSTREAM_HEADERS", "X-Gateway-Token=abc, X-Route = blue,malformed,=novalue")
+	t.Setenv("CODEBUDDY2CC_EXTRA_HEADERS", "")
+	upstream := startFakeUpstream(t, upstreamSSE(upstreamChunk(t, textDelta("ok"), ""), upstreamChunk(t, nil, "stop"), "[DONE]"))
+
+	c, recorder := newTestContext(http.MethodPost, "/v1/messages", `{"model":"test-model","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+	c.Request.Header.Set("X-Route", "red")
+	MessagesHandler(c)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", recorder.Code, recorder.Body.String())
+	}
+	req, _ := upstream.upstreamRequest(t, 0)
+	if got := req.Header.Get("X-Gateway-Token"); got != "abc" {
+		t.Fatalf("X-Gateway-Token = %q, want %q", got, "abc")
+	}
+	// 静态头部覆盖客户端同名头部
+	if got := req.Header.Values("X-Route"); !reflect.DeepEqual(got, []string{"blue"}) {
+		t.Fatalf("X-Route = %q, want [blue]", got)
+	}
+	if _, ok := req.Header["Malformed"]; ok {
+		t.Fatalf("malformed entry forwarded: %v", req.Header)
+	}
+}
+
+func TestToolIDMappingIsConsistentWithinRequest(t *testing.T) {
+	t.Run("client ids", func(t *testing.T) {
+		t.Setenv("CODEBUDDY2CC_TOOL_ID_MAPPING", "1")
+		session := newToolCallsSession("test")
+
+		first := session.clientToolID("synthetic_0")
+		if !strings.HasPrefix(first, "toolu_") {
+			t.Fatalf("mapped id = %q, want toolu_ prefix", first)
+		}
+		if again := session.clientToolID("synthetic_0"); again != first {
+			t.Fatalf("second mapping = %q, want %q", again, first)
+		}
+		if other := session.clientToolID("synthetic_1"); other == first || !strings.HasPrefix(other, "toolu_") {
+			t.Fatalf("distinct synthetic id mapped to %q (first %q)", other, first)
+		}
+		if got := session.clientToolID("call_abc"); got != "call_abc" {
+			t.Fatalf("upstream id = %q, want passthrough", got)
+		}
+	})
+
+	t.Run("disabled passes ids through", func(t *testing.T) {
+		t.Setenv("CODEBUDDY2CC_TOOL_ID_MAPPING", "")
+		if got := newToolCallsSession("test").clientToolID("synthetic_0"); got != "synthetic_0" {
+			t.Fatalf("id = %q, want passthrough", got)
+		}
+	})
+
+	t.Run("tool call without upstream id", func(t *testing.T) {
+		t.Setenv("CODEBUDDY2CC_TOOL_ID_MAPPING", "1")
+		body := upstreamSSE(
+			upstreamChunk(t, toolDelta(0, "", "read_file", `{"path":`), ""),
+			upstreamChunk(t, toolDelta(0, "", "", `"a.go"}`), ""),
+			upstreamChunk(t, nil, "tool_calls"),
+			"[DONE]",
+		)
+		buffered := runBuffered(t, body)
+		_, events := runStream(t, body)
+		streamed := reconstructMessage(t, events)
+
+		for label, blocks := range map[string][]utils.ContentBlock{"buffered": buffered.ContentBlocks, "stream": streamed.blocks} {
+			if len(blocks) != 1 || blocks[0].Type != "tool_use" || blocks[0].Name != "read_file" {
+				t.Fatalf("%s blocks = %+v, want one read_file tool_use", label, blocks)
+			}
+			if !strings.HasPrefix(blocks[0].ID, "toolu_") {
+				t.Fatalf("%s tool id = %q, want toolu_ prefix", label, blocks[0].ID)
+			}
+			input, _ := json.Marshal(blocks[0].Input)
+			if string(input) != `{"path":"a.go"}` {
+				t.Fatalf("%s input = %s", label, input)
+			}
+		}
+	})
+}
+
+// endlessUpstream 不断返回文本数据块的上游响应体，记录已读出的数据块数
+type endlessUpstream struct {
+	chunk string
+	reads atomic.Int64
+}
+
+func (u *endlessUpstream) Read(p []byte) (int, error) {
+	u.reads.Add(1)
+	return copy(p, u.chunk), nil
+}
+
+func (u *endlessUpstream) Close() error { return nil }
+
+// brokenClientWriter 首次写入之后的写入均失败，模拟客户端断开
+type brokenClientWriter struct {
+	gin.ResponseWriter
+	writes int
+}
+
+func (w *brokenClientWriter) Write(data []byte) (int, error) {
+	w.writes++
+	if w.writes > 1 {
+		return 0, errors.New("broken pipe")
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *brokenClientWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func TestStreamStopsWhenClientWriteFails(t *testing.T) {
+	t.Setenv("CODEBUDDY2CC_CANCEL_ON_DISCONNECT", "false")
+	c, _ := newTestContext(http.MethodPost, "/v1/messages", "{}")
+	c.Writer = &brokenClientWriter{ResponseWriter: c.Writer}
+	middleware.GuardWriter(c)
+
+	upstream := &endlessUpstream{chunk: "data: " + upstreamChunk(t, textDelta("tick"), "") + "\n\n"}
+	resp := newUpstreamResponse("")
+	resp.Body = upstream
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		streamUnifiedResponse(c, resp, NewDefaultToolCallManager("test"), "test", nil, nil, nil)
+	}()
+	select {
+	case <-middleware.WriteAborted(c):
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteAborted did not fire")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream loop still running after the client write failed (%d upstream reads)", upstream.reads.Load())
+	}
+
+	// 循环退出后上游读取随之停止
+	reads := upstream.reads.Load()
+	time.Sleep(20 * time.Millisecond)
+	if after := upstream.reads.Load(); after > reads+1 {
+		t.Fatalf("upstream reads continued after the stream ended: %d -> %d", reads, after)
+	}
+}
+
+// useBillingSink 将计费记录输出到内存缓冲，测试结束后恢复为未配置
+func useBillingSink(t *testing.T) *strings.Builder {
+	t.Helper()
+	var buf strings.Builder
+	billingSinkOnce.Do(func() {})
+	billingSinkMu.Lock()
+	billingSink = &buf
+	billingSinkMu.Unlock()
+	t.Cleanup(func() {
+		billingSinkMu.Lock()
+		billingSink = nil
+		billingSinkMu.Unlock()
+	})
+	return &buf
+}
+
+func TestBillingRecordAfterCompletedRequest(t *testing.T) {
+	usageChunk := `{"id":"chatcmpl-1","model":"upstream-model","choices":[{"index":0,"delta":{},"finish_reason":"stop"}],` +
+		`"usage":{"prompt_tokens":12,"completion_tokens":5,"prompt_cache_hit_tokens":7,"prompt_cache_miss_tokens":3}}`
+	for _, stream := range []bool{false, true} {
+		t.Run("stream="+strconv.FormatBool(stream), func(t *testing.T) {
+			sink := useBillingSink(t)
+			startFakeUpstream(t, upstreamSSE(upstreamChunk(t, textDelta("ok"), ""), usageChunk, "[DONE]"))
+
+			body := `{"model":"test-model","max_tokens":16,"stream":` + strconv.FormatBool(stream) +
+				`,"metadata":{"user_id":"user-1"},"messages":[{"role":"user","content":"hi"}]}`
+			c, recorder := newTestContext(http.MethodPost, "/v1/messages", body)
+			MessagesHandler(c)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, body: %s", recorder.Code, recorder.Body.String())
+			}
+			lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("billing output = %q, want one record", sink.String())
+			}
+			var record billingRecord
+			if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+				t.Fatalf("decode billing record %q: %v", lines[0], err)
+			}
+			if record.InputTokens != 12 || record.OutputTokens != 5 || record.CacheReadInputTokens != 7 || record.CacheCreationInputTokens != 3 {
+				t.Fatalf("token fields = input %d, output %d, cache_read %d, cache_creation %d; want 12, 5, 7, 3",
+					record.InputTokens, record.OutputTokens, record.CacheReadInputTokens, record.CacheCreationInputTokens)
+			}
+			if record.Model != "test-model" || record.UserID != "user-1" || record.Stream != stream ||
+				record.StopReason != "end_turn" || record.Status != http.StatusOK || !record.Success {
+				t.Fatalf("record = %+v", record)
+			}
+		})
+	}
+}
+
+func TestStreamLimitRejectsExtraConcurrentStream(t *testing.T) {
+	const limit = 2
+	t.Setenv("CODEBUDDY2CC_MAX_STREAMS_PER_CLIENT", strconv.Itoa(limit))
+
+	// 上游先返回一个数据块，之后阻塞到release关闭，使流保持进行中
+	started := make(chan struct{}, limit+1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, upstreamSSE(upstreamChunk(t, textDelta("partial"), "")))
+		w.(http.Flusher).Flush()
+		started <- struct{}{}
+		<-release
+		io.WriteString(w, upstreamSSE(upstreamChunk(t, nil, "stop"), "[DONE]"))
+	}))
+	defer server.Close()
+	t.Setenv("CODEBUDDY2CC_UPSTREAM_URL", server.URL)
+	t.Setenv("CODEBUDDY2CC_KEYS", "")
+	t.Setenv("CODEBUDDY2CC_KEY", "test-key")
+
+	body := `{"model":"test-model","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	var wg sync.WaitGroup
+	recorders := make([]*httptest.ResponseRecorder, limit)
+	for i := range limit {
+		c, recorder := newTestContext(http.MethodPost, "/v1/messages", body)
+		recorders[i] = recorder
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			MessagesHandler(c)
+		}()
+	}
+	for range limit {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			close(release)
+			t.Fatal("concurrent streams did not reach the upstream")
+		}
+	}
+
+	c, rejected := newTestContext(http.MethodPost, "/v1/messages", body)
+	MessagesHandler(c)
+	if rejected.Code != http.StatusTooManyRequests || !strings.Contains(rejected.Body.String(), "rate_limit_error") {
+		close(release)
+		t.Fatalf("extra stream status = %d, body: %s; want 429 rate_limit_error", rejected.Code, rejected.Body.String())
+	}
+
+	close(release)
+	wg.Wait()
+	for i, recorder := range recorders {
+		message := reconstructMessage(t, parseSSE(t, recorder.Body.String()))
+		if recorder.Code != http.StatusOK || message.stopReason != "end_turn" || len(message.blocks) != 1 || message.blocks[0].Text != "partial" {
+			t.Fatalf("stream %d status = %d, message = %+v", i, recorder.Code, message)
+		}
+	}
+	if len(started) != 0 {
+		t.Fatal("rejected stream reached the upstream")
+	}
+}
+
+func TestRetryBudgetSharedByKeyRotationAndEmptyRetry(t *testing.T) {
+	emptyBody := upstreamSSE(upstreamChunk(t, map[string]any{"role": "assistant", "content": ""}, ""), upstreamChunk(t, nil, "stop"), "[DONE]")
+	answerBody := upstreamSSE(upstreamChunk(t, textDelta("answer"), ""), upstreamChunk(t, nil, "stop"), "[DONE]")
+	rateLimited := `{"error":{"message":"slow down"}}`
+
+	tests := []struct {
+		name         string
+		attempts     string
+		statuses     []int
+		bodies       []string
+		wantStatus   int
+		wantRequests int
+		wantText     string
+	}{
+		{
+			name:     "rotation uses the budget meant for the empty retry",
+			attempts: "2", statuses: []int{429, 200, 200}, bodies: []string{rateLimited, emptyBody, answerBody},
+			wantStatus: http.StatusOK, wantRequests: 2, wantText: utils.FallbackText(utils.FallbackEmptyResponse),
+		},
+		{
+			name:     "larger budget covers rotation and empty retry",
+			attempts: "3", statuses: []int{429, 200, 200}, bodies: []string{rateLimited, emptyBody, answerBody},
+			wantStatus: http.StatusOK, wantRequests: 3, wantText: "answer",
+		},
+		{
+			name:     "rotation stops when the budget is spent",
+			attempts: "2", statuses: []int{429, 429, 429}, bodies: []string{rateLimited},
+			wantStatus: http.StatusTooManyRequests, wantRequests: 2,
+		},
+	}
+	for _, tt := range tests {
+		for _, stream := range []bool{false, true} {
+			t.Run(tt.name+" stream="+strconv.FormatBool(stream), func(t *testing.T) {
+				t.Setenv("CODEBUDDY2CC_MAX_ATTEMPTS", tt.attempts)
+				t.Setenv("CODEBUDDY2CC_RETRY_ON_EMPTY", "1")
+				upstream := startFakeUpstream(t, tt.bodies...)
+				upstream.statuses = tt.statuses
+				t.Setenv("CODEBUDDY2CC_KEYS", "key-a,key-b,key-c")
+
+				body := `{"model":"test-model","max_tokens":16,"stream":` + strconv.FormatBool(stream) +
+					`,"messages":[{"role":"user","content":"hi"}]}`
+				c, recorder := newTestContext(http.MethodPost, "/v1/messages", body)
+				MessagesHandler(c)
+
+				if got := upstream.requestCount(); got != tt.wantRequests {
+					t.Fatalf("upstream requests = %d, want %d", got, tt.wantRequests)
+				}
+				// 流式客户端以200状态和error事件接收上游错误
+				wantStatus := tt.wantStatus
+				if stream {
+					wantStatus = http.StatusOK
+				}
+				if recorder.Code != wantStatus {
+					t.Fatalf("status = %d, want %d, body: %s", recorder.Code, wantStatus, recorder.Body.String())
+				}
+				if tt.wantText == "" {
+					if !strings.Contains(recorder.Body.String(), "slow down") {
+						t.Fatalf("body = %s, want the upstream error", recorder.Body.String())
+					}
+					return
+				}
+
+				var blocks []utils.ContentBlock
+				if stream {
+					blocks = reconstructMessage(t, parseSSE(t, recorder.Body.String())).blocks
+				} else {
+					var resp utils.AnthropicResponse
+					if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+						t.Fatalf("decode response: %v", err)
+					}
+					blocks = resp.Content
+				}
+				if len(blocks) != 1 || blocks[0].Text != tt.wantText {
+					t.Fatalf("content = %+v, want single text %q", blocks, tt.wantText)
+				}
+			})
+		}
+	}
+}
+
+func TestBufferedReadStopsWhenClientDisconnects(t *testing.T) {
+	firstChunk := make(chan struct{})
+	upstreamGone := make(chan struct{})
+	stop := make(chan struct{})
+	var chunks atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		// 持续发送数据块且从不结束，直到代理关闭连接
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			io.WriteString(w, upstreamSSE(upstreamChunk(t, textDelta("tick"), "")))
+			w.(http.Flusher).Flush()
+			if chunks.Add(1) == 1 {
+				close(firstChunk)
+			}
+			select {
+			case <-r.Context().Done():
+				close(upstreamGone)
+				return
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}))
+	defer server.Close()
+	// 断言失败时先让上游处理器退出，避免server.Close一直等待连接
+	defer close(stop)
+	t.Setenv("CODEBUDDY2CC_UPSTREAM_URL", server.URL)
+	t.Setenv("CODEBUDDY2CC_KEYS", "")
+	t.Setenv("CODEBUDDY2CC_KEY", "test-key")
+
+	body := `{"model":"test-model","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`
+	c, recorder := newTestContext(http.MethodPost, "/v1/messages", body)
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		MessagesHandler(c)
+	}()
+	select {
+	case <-firstChunk:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream stream did not start")
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still accumulating after the client disconnected")
+	}
+	select {
+	case <-upstreamGone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("upstream connection still open after the client disconnected (%d chunks sent)", chunks.Load())
+	}
+	// 取消可能早于上游响应头到达，此时会写出错误响应，但绝不能写出累积的文本
+	if strings.Contains(recorder.Body.String(), "tick") {
+		t.Fatalf("accumulated message written to a disconnected client: %s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"codebuddy2cc/middleware"
+	"codebuddy2cc/utils"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// wsFirstMessageTimeout 升级后等待客户端发送请求体的最长时间
+const wsFirstMessageTimeout = 60 * time.Second
+
+// wsCancelMessage 客户端发送该文本帧时取消当前请求
+const wsCancelMessage = "cancel"
+
+// wsUpgrader 认证由 /v1 分组的中间件在升级前完成；浏览器会自动携带凭证，因此仍需校验Origin防止跨站连接
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: wsCheckOrigin,
+}
+
+// wsCheckOrigin 校验WebSocket握手的Origin：未携带Origin（非浏览器客户端）时放行，
+// 命中 CODEBUDDY2CC_WS_ALLOWED_ORIGINS（逗号分隔的完整来源，如 https://app.example.com；* 表示全部）时放行，默认仅允许同源
+func wsCheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for allowed := range strings.SplitSeq(os.Getenv("CODEBUDDY2CC_WS_ALLOWED_ORIGINS"), ",") {
+		allowed = strings.TrimSuffix(strings.TrimSpace(allowed), "/")
+		if allowed == "*" || (allowed != "" && strings.EqualFold(allowed, origin)) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// wsEventWriter 将MessagesHandler写出的SSE帧转换为WebSocket文本帧，每个事件的data负载作为一帧发送
+// 非SSE响应（如请求校验失败时的JSON错误）在请求结束时整体作为一帧发送
+type wsEventWriter struct {
+	gin.ResponseWriter
+	conn   *websocket.Conn
+	ctx    context.Context
+	header http.Header
+	status int
+	size   int
+	buf    bytes.Buffer
+}
+
+func newWSEventWriter(ctx context.Context, conn *websocket.Conn, base gin.ResponseWriter) *wsEventWriter {
+	return &wsEventWriter{
+		ResponseWriter: base,
+		conn:           conn,
+		ctx:            ctx,
+		header:         make(http.Header),
+		status:         http.StatusOK,
+		size:           -1,
+	}
+}
+
+func (w *wsEventWriter) Header() http.Header { return w.header }
+
+func (w *wsEventWriter) WriteHeader(code int) {
+	if !w.Written() {
+		w.status = code
+	}
+}
+
+func (w *wsEventWriter) WriteHeaderNow() {
+	if !w.Written() {
+		w.size = 0
+	}
+}
+
+func (w *wsEventWriter) Status() int { return w.status }
+
+func (w *wsEventWriter) Size() int { return w.size }
+
+func (w *wsEventWriter) Written() bool { return w.size != -1 }
+
+func (w *wsEventWriter) Write(data []byte) (int, error) {
+	// 请求已取消（客户端发送cancel或连接断开）时写入失败，由写入守卫通知流式循环中止
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	w.WriteHeaderNow()
+	n, _ := w.buf.Write(data)
+	w.size += n
+	if w.isStream() {
+		if err := w.flushEvents(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (w *wsEventWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *wsEventWriter) Flush() {}
+
+func (w *wsEventWriter) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func (w *wsEventWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrNotSupported
+}
+
+func (w *wsEventWriter) isStream() bool {
+	return strings.HasPrefix(w.header.Get("Content-Type"), "text/event-stream")
+}
+
+// flushEvents 发送缓冲区中所有完整的SSE事件（以空行结尾），不完整的事件留待后续写入
+func (w *wsEventWriter) flushEvents() error {
+	for {
+		end := bytes.Index(w.buf.Bytes(), []byte("\n\n"))
+		if end < 0 {
+			return nil
+		}
+		event := string(w.buf.Next(end + 2))
+
+		var data []string
+		for line := range strings.SplitSeq(event, "\n") {
+			if payload, ok := strings.CutPrefix(line, "data:"); ok {
+				data = append(data, strings.TrimPrefix(payload, " "))
+			}
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if err := w.conn.WriteMessage(websocket.TextMessage, []byte(strings.Join(data, "\n"))); err != nil {
+			return err
+		}
+	}
+}
+
+// finish 请求结束时发送剩余的非SSE响应体
+func (w *wsEventWriter) finish() {
+	if w.buf.Len() == 0 || w.ctx.Err() != nil {
+		return
+	}
+	w.conn.WriteMessage(websocket.TextMessage, w.buf.Bytes())
+	w.buf.Reset()
+}
+
+// MessagesWSHandler 处理 /v1/messages/ws：以WebSocket传输代替SSE
+// 客户端升级后发送的第一条消息为AnthropicRequest，之后的Anthropic事件以data JSON作为文本帧返回；
+// 请求过程中客户端发送 "cancel" 文本帧或断开连接时取消请求。转换与上游调用完全复用MessagesHandler
+func MessagesWSHandler(c *gin.Context) {
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade失败时已向客户端输出错误响应
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(wsFirstMessageTimeout))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// WebSocket传输始终为流式：保留原始请求体的其余字段，仅强制stream为true
+	var fields map[string]json.RawMessage
+	if err := utils.FastUnmarshal(message, &fields); err != nil {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"error","error":{"type":"invalid_request_error","message":"first message must be a JSON request body"}}`))
+		return
+	}
+	fields["stream"] = json.RawMessage("true")
+	body, err := utils.FastMarshal(fields)
+	if err != nil {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"error","error":{"type":"api_error","message":"failed to encode request body"}}`))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	// 读取后续控制帧：cancel帧或读取失败（连接关闭）均取消请求
+	go func() {
+		defer cancel()
+		for {
+			_, frame, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if strings.TrimSpace(string(frame)) == wsCancelMessage {
+				return
+			}
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Request.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	// 复用升级请求的头部（认证、anthropic-*等），去除WebSocket握手相关头部
+	for key, values := range c.Request.Header {
+		if key == "Connection" || key == "Upgrade" || strings.HasPrefix(key, "Sec-Websocket-") {
+			continue
+		}
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	req.RemoteAddr = c.Request.RemoteAddr
+
+	writer := newWSEventWriter(ctx, conn, c.Writer)
+	c.Request = req
+	c.Writer = writer
+	middleware.GuardWriter(c)
+
+	MessagesHandler(c)
+	writer.finish()
+
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
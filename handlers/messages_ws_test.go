@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWSCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string
+		origin  string
+		want    bool
+	}{
+		{name: "no origin from non-browser clients", origin: "", want: true},
+		{name: "same origin by default", origin: "http://proxy.local:8080", want: true},
+		{name: "cross origin rejected by default", origin: "https://evil.example", want: false},
+		{name: "allow-listed origin", allowed: "https://app.example.com, https://other.example", origin: "https://app.example.com", want: true},
+		{name: "allow-list is exact", allowed: "https://app.example.com", origin: "https://app.example.com.evil.example", want: false},
+		{name: "wildcard", allowed: "*", origin: "https://evil.example", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CODEBUDDY2CC_WS_ALLOWED_ORIGINS", tt.allowed)
+			req := httptest.NewRequest(http.MethodGet, "http://proxy.local:8080/v1/messages/ws", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if got := wsCheckOrigin(req); got != tt.want {
+				t.Fatalf("wsCheckOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
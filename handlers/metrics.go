@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// upstreamLatencyBuckets 上游往返耗时直方图的桶边界（秒）
+var upstreamLatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// latencyHistogram 单个标签组合的直方图数据
+type latencyHistogram struct {
+	counts []uint64 // 与upstreamLatencyBuckets一一对应（非累计）
+	sum    float64
+	count  uint64
+}
+
+// proxyMetrics 进程内指标注册表，以Prometheus文本格式导出
+// 标签组合数量受模型数量限制，使用简单的map+互斥锁即可
+type proxyMetrics struct {
+	mu               sync.Mutex
+	requests         map[string]uint64 // model, stream
+	upstreamStatuses map[string]uint64 // model, stream, status
+	responseTypes    map[string]uint64 // model, stream, type
+	upstreamLatency  map[string]*latencyHistogram
+}
+
+var metrics = &proxyMetrics{
+	requests:         make(map[string]uint64),
+	upstreamStatuses: make(map[string]uint64),
+	responseTypes:    make(map[string]uint64),
+	upstreamLatency:  make(map[string]*latencyHistogram),
+}
+
+// metricLabels 将标签键值对格式化为Prometheus标签字符串（按传入顺序）
+func metricLabels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// escapeLabelValue 按Prometheus文本格式转义标签值
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+// streamLabel 流式/非流式标签值
+func streamLabel(stream bool) string {
+	if stream {
+		return "stream"
+	}
+	return "non_stream"
+}
+
+// recordRequest 记录一次发往上游的请求（model为映射后的上游模型）
+func (m *proxyMetrics) recordRequest(model string, stream bool) {
+	labels := metricLabels("model", model, "stream", streamLabel(stream))
+	m.mu.Lock()
+	m.requests[labels]++
+	m.mu.Unlock()
+}
+
+// recordUpstream 记录上游响应状态码与往返耗时，status为0表示请求未得到响应
+func (m *proxyMetrics) recordUpstream(model string, stream bool, status int, elapsed time.Duration) {
+	statusValue := "error"
+	if status > 0 {
+		statusValue = strconv.Itoa(status)
+	}
+	statusLabels := metricLabels("model", model, "stream", streamLabel(stream), "status", statusValue)
+	latencyLabels := metricLabels("model", model, "stream", streamLabel(stream))
+	seconds := elapsed.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.upstreamStatuses[statusLabels]++
+
+	h, ok := m.upstreamLatency[latencyLabels]
+	if !ok {
+		h = &latencyHistogram{counts: make([]uint64, len(upstreamLatencyBuckets))}
+		m.upstreamLatency[latencyLabels] = h
+	}
+	for i, bound := range upstreamLatencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// recordResponseType 记录成功响应的类型（工具调用或文本）
+func (m *proxyMetrics) recordResponseType(model string, stream bool, isToolCall bool) {
+	responseType := "text"
+	if isToolCall {
+		responseType = "tool_use"
+	}
+	labels := metricLabels("model", model, "stream", streamLabel(stream), "type", responseType)
+	m.mu.Lock()
+	m.responseTypes[labels]++
+	m.mu.Unlock()
+}
+
+// writeCounter 输出一个counter指标族，标签组合按字典序排列保证输出稳定
+func writeCounter(b *strings.Builder, name, help string, values map[string]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s{%s} %d\n", name, k, values[k])
+	}
+}
+
+// render 以Prometheus文本格式导出全部指标
+func (m *proxyMetrics) render() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	writeCounter(&b, "codebuddy2cc_requests_total", "Total requests forwarded to the upstream.", m.requests)
+	writeCounter(&b, "codebuddy2cc_upstream_responses_total", "Upstream responses by status code (status=\"error\" for transport failures).", m.upstreamStatuses)
+	writeCounter(&b, "codebuddy2cc_responses_by_type_total", "Successful responses by content type (tool_use or text).", m.responseTypes)
+
+	name := "codebuddy2cc_upstream_latency_seconds"
+	fmt.Fprintf(&b, "# HELP %s Upstream round-trip latency until response headers are received.\n# TYPE %s histogram\n", name, name)
+	keys := make([]string, 0, len(m.upstreamLatency))
+	for k := range m.upstreamLatency {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := m.upstreamLatency[k]
+		var cumulative uint64
+		for i, bound := range upstreamLatencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "%s_bucket{%s,le=\"%s\"} %d\n", name, k, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(&b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, k, h.count)
+		fmt.Fprintf(&b, "%s_sum{%s} %s\n", name, k, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "%s_count{%s} %d\n", name, k, h.count)
+	}
+
+	return b.String()
+}
+
+// MetricsHandler 处理 GET /metrics 请求，输出Prometheus文本格式指标
+func MetricsHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(metrics.render()))
+}
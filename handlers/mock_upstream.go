@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"codebuddy2cc/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// mockToolPhrase 用户消息包含该短语且请求带有工具定义时，mock上游返回工具调用
+const mockToolPhrase = "mock:tool_call"
+
+// mockUpstreamEnabled 是否启用进程内mock上游（仅用于本地开发和演示）
+func mockUpstreamEnabled() bool {
+	return utils.EnvBool("CODEBUDDY2CC_MOCK_UPSTREAM")
+}
+
+// mockUpstreamTransport 进程内mock上游，按OpenAI流式格式回显最后一条用户消息
+// 作为http.RoundTripper接入，保证离线时也能走完整的SSE解析和转换链路
+type mockUpstreamTransport struct{}
+
+func (mockUpstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var openAIReq utils.OpenAIRequest
+	if err := utils.FastUnmarshal(body, &openAIReq); err != nil {
+		return mockResponse(req, http.StatusBadRequest, "application/json",
+			fmt.Sprintf(`{"error":{"message":"mock upstream: invalid request: %v"}}`, err)), nil
+	}
+
+	return mockResponse(req, http.StatusOK, "text/event-stream", buildMockStream(&openAIReq)), nil
+}
+
+// mockResponse 构建mock上游响应
+func mockResponse(req *http.Request, status int, contentType, body string) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": []string{contentType}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
+
+// buildMockStream 生成OpenAI格式的SSE流：回显文本或模拟一次工具调用
+func buildMockStream(openAIReq *utils.OpenAIRequest) string {
+	messageID := fmt.Sprintf("chatcmpl-mock-%d", time.Now().UnixNano())
+	lastUserText := lastUserMessageText(openAIReq.Messages)
+
+	var sb strings.Builder
+	writeChunk := func(choice map[string]any, usage map[string]any) {
+		chunk := map[string]any{
+			"id":      messageID,
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   openAIReq.Model,
+			"choices": []any{},
+		}
+		if choice != nil {
+			chunk["choices"] = []any{choice}
+		}
+		if usage != nil {
+			chunk["usage"] = usage
+		}
+		data, _ := utils.FastMarshal(chunk)
+		sb.WriteString("data: ")
+		sb.Write(data)
+		sb.WriteString("\n\n")
+	}
+
+	if strings.Contains(lastUserText, mockToolPhrase) && len(openAIReq.Tools) > 0 {
+		tool := openAIReq.Tools[0]
+		writeChunk(map[string]any{
+			"index": 0,
+			"delta": map[string]any{
+				"role": "assistant",
+				"tool_calls": []any{map[string]any{
+					"index": 0,
+					"id":    fmt.Sprintf("call_mock_%d", time.Now().UnixNano()),
+					"type":  "function",
+					"function": map[string]any{
+						"name":      tool.Function.Name,
+						"arguments": "{}",
+					},
+				}},
+			},
+		}, nil)
+		writeChunk(map[string]any{"index": 0, "delta": map[string]any{}, "finish_reason": "tool_calls"}, nil)
+	} else {
+		reply := "Echo: " + lastUserText
+		for _, chunk := range splitUTF8SafeChunks(reply, 16) {
+			writeChunk(map[string]any{"index": 0, "delta": map[string]any{"content": chunk}}, nil)
+		}
+		writeChunk(map[string]any{"index": 0, "delta": map[string]any{}, "finish_reason": "stop"}, nil)
+	}
+
+	promptTokens := len(lastUserText)/4 + 1
+	writeChunk(nil, map[string]any{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": 1,
+		"total_tokens":      promptTokens + 1,
+	})
+	sb.WriteString("data: [DONE]\n\n")
+	return sb.String()
+}
+
+// lastUserMessageText 提取最后一条用户消息的文本内容
+func lastUserMessageText(messages []utils.OpenAIMessage) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role != "user" {
+			continue
+		}
+		switch content := messages[i].Content.(type) {
+		case string:
+			return content
+		case []any:
+			var sb strings.Builder
+			for _, item := range content {
+				if block, ok := item.(map[string]any); ok {
+					if text, ok := block["text"].(string); ok {
+						sb.WriteString(text)
+					}
+				}
+			}
+			return sb.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestMockUpstreamProducesValidAnthropicStream(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		wantType       string
+		wantText       string
+		wantStopReason string
+	}{
+		{
+			name:           "echoes the last user message",
+			body:           `{"model":"test-model","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hello mock upstream"}]}`,
+			wantType:       "text",
+			wantText:       "Echo: hello mock upstream",
+			wantStopReason: "end_turn",
+		},
+		{
+			name: "simulates a tool call",
+			body: `{"model":"test-model","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"please ` + mockToolPhrase + `"}],` +
+				`"tools":[{"name":"read_file","description":"read a file","input_schema":{"type":"object","properties":{}}}]}`,
+			wantType:       "tool_use",
+			wantStopReason: "tool_use",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CODEBUDDY2CC_MOCK_UPSTREAM", "1")
+			t.Setenv("CODEBUDDY2CC_KEYS", "")
+			t.Setenv("CODEBUDDY2CC_KEY", "test-key")
+
+			c, recorder := newTestContext(http.MethodPost, "/v1/messages", tt.body)
+			MessagesHandler(c)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, body: %s", recorder.Code, recorder.Body.String())
+			}
+			message := reconstructMessage(t, parseSSE(t, recorder.Body.String()))
+			if message.stopReason != tt.wantStopReason {
+				t.Fatalf("stop_reason = %q, want %q", message.stopReason, tt.wantStopReason)
+			}
+			if len(message.blocks) != 1 || message.blocks[0].Type != tt.wantType {
+				t.Fatalf("blocks = %+v, want one %s block", message.blocks, tt.wantType)
+			}
+
+			block := message.blocks[0]
+			switch tt.wantType {
+			case "text":
+				if block.Text != tt.wantText {
+					t.Fatalf("text = %q, want %q", block.Text, tt.wantText)
+				}
+			case "tool_use":
+				input, _ := json.Marshal(block.Input)
+				if block.Name != "read_file" || block.ID == "" || string(input) != `{}` {
+					t.Fatalf("tool_use = %+v (input %s), want read_file with empty input", block, input)
+				}
+			}
+		})
+	}
+}
@@ -2,6 +2,9 @@ package handlers
 
 import (
 	"codebuddy2cc/utils"
+	"fmt"
+	"net/http"
+	"slices"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -21,6 +24,9 @@ type ModelsResponse struct {
 	Data   []ModelObject `json:"data"`
 }
 
+// modelsCreatedAt 模型列表的created时间戳，取进程启动时间保证多次请求结果稳定
+var modelsCreatedAt = time.Now().Unix()
+
 // ModelsHandler 处理 GET /v1/models 请求
 // 符合OpenAI API规范，返回model.json中配置的所有模型
 func ModelsHandler(c *gin.Context) {
@@ -29,13 +35,23 @@ func ModelsHandler(c *gin.Context) {
 
 	// 构建OpenAI格式的模型列表
 	models := make([]ModelObject, 0, len(modelMappings))
-	currentTime := time.Now().Unix()
 
+	// 按ID排序，避免map遍历顺序导致列表每次不同
+	modelIDs := make([]string, 0, len(modelMappings))
 	for modelID := range modelMappings {
+		// 正则/通配符规则不是具体模型，不对外列出
+		if utils.IsModelPattern(modelID) {
+			continue
+		}
+		modelIDs = append(modelIDs, modelID)
+	}
+	slices.Sort(modelIDs)
+
+	for _, modelID := range modelIDs {
 		models = append(models, ModelObject{
 			ID:      modelID,
 			Object:  "model",
-			Created: currentTime,
+			Created: modelsCreatedAt,
 			OwnedBy: "codebuddy2cc",
 		})
 	}
@@ -49,3 +65,21 @@ func ModelsHandler(c *gin.Context) {
 	utils.DebugLog("Returning %d models from model.json", len(models))
 	c.JSON(200, response)
 }
+
+// ModelHandler 处理 GET /v1/models/:id 请求，返回单个模型对象
+// 仅model.json中配置的具体模型ID视为存在（正则/通配符规则除外），否则返回404
+func ModelHandler(c *gin.Context) {
+	modelID := c.Param("id")
+
+	if _, exists := utils.GetModelMappings()[modelID]; !exists || utils.IsModelPattern(modelID) {
+		writeAnthropicError(c, http.StatusNotFound, "", fmt.Sprintf("model: %s", modelID))
+		return
+	}
+
+	c.JSON(http.StatusOK, ModelObject{
+		ID:      modelID,
+		Object:  "model",
+		Created: modelsCreatedAt,
+		OwnedBy: "codebuddy2cc",
+	})
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestModelsHandlerCreatedIsStable(t *testing.T) {
+	useModelMapping(t, `{"models":{"claude-a":"upstream-a","claude-b":"upstream-b","claude-*":"upstream-x"}}`)
+
+	list := func() ModelsResponse {
+		t.Helper()
+		c, recorder := newTestContext(http.MethodGet, "/v1/models", "")
+		ModelsHandler(c)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status = %d, body: %s", recorder.Code, recorder.Body.String())
+		}
+		var response ModelsResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode models response: %v", err)
+		}
+		return response
+	}
+
+	first := list()
+	// 等到下一秒再请求，按请求时间生成created会在两次响应间变化
+	start := time.Now().Unix()
+	for time.Now().Unix() == start {
+		time.Sleep(10 * time.Millisecond)
+	}
+	second := list()
+
+	if len(first.Data) != 2 {
+		t.Fatalf("models = %+v, want the two concrete models", first.Data)
+	}
+	for _, model := range first.Data {
+		if model.Created != first.Data[0].Created {
+			t.Fatalf("created differs between models: %+v", first.Data)
+		}
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("models response changed between calls:\nfirst:  %+v\nsecond: %+v", first, second)
+	}
+}
@@ -0,0 +1,581 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"codebuddy2cc/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// blockSink 响应内容块的输出目标
+// 流式路径将内容块直接写为SSE事件，非流式路径累积为内容块；两者都由responseAssembler驱动，保证输出相同的块序列
+type blockSink interface {
+	// begin 收到有效数据块时调用，可重复调用（流式路径据此发送message_start）
+	begin(messageID, model string, usage *utils.Usage)
+	// startBlock 开启内容块，tool_use块需要id与name
+	startBlock(blockType, id, name string)
+	// delta 向当前打开的块追加增量（text_delta/thinking_delta/signature_delta/input_json_delta）
+	delta(deltaType, content string)
+	// stopBlock 关闭当前打开的块
+	stopBlock()
+}
+
+// bufferedBlockSink 将内容块累积在内存中，供非流式响应一次性输出
+type bufferedBlockSink struct {
+	blocks    []utils.ContentBlock
+	content   strings.Builder // 当前块已累积的增量
+	signature strings.Builder // 当前thinking块的签名
+}
+
+func (s *bufferedBlockSink) begin(string, string, *utils.Usage) {}
+
+func (s *bufferedBlockSink) startBlock(blockType, id, name string) {
+	s.blocks = append(s.blocks, utils.ContentBlock{Type: blockType, ID: id, Name: name})
+	s.content.Reset()
+	s.signature.Reset()
+}
+
+func (s *bufferedBlockSink) delta(deltaType, content string) {
+	if deltaType == "signature_delta" {
+		s.signature.WriteString(content)
+		return
+	}
+	s.content.WriteString(content)
+}
+
+// stopBlock 将累积的增量写入当前块；tool_use块的input保留参数原文（组装器已保证为JSON对象）
+func (s *bufferedBlockSink) stopBlock() {
+	block := &s.blocks[len(s.blocks)-1]
+	switch block.Type {
+	case "text":
+		block.Text = s.content.String()
+	case "thinking":
+		block.Thinking = s.content.String()
+		block.Signature = s.signature.String()
+	case "tool_use":
+		block.Input = json.RawMessage(s.content.String())
+	}
+	s.content.Reset()
+}
+
+// streamBlockSink 将内容块实时写为Anthropic SSE事件
+type streamBlockSink struct {
+	c         *gin.Context
+	flusher   http.Flusher
+	formatter *utils.AnthropicSSEFormatter
+	state     *SSEStreamState
+
+	// deferStart 为true时message_start推迟到首个内容块开启时发送，此前上游返回空响应仍可重新请求
+	deferStart   bool
+	startPending bool // 已收到有效数据块但message_start尚未发送
+	messageID    string
+	model        string
+	usage        *utils.Usage
+}
+
+func (s *streamBlockSink) begin(messageID, model string, usage *utils.Usage) {
+	s.messageID, s.model, s.usage = messageID, model, usage
+	s.startPending = true
+	if !s.deferStart {
+		s.flushStart()
+	}
+}
+
+// flushStart 发送推迟的message_start，未收到有效数据块时不发送
+func (s *streamBlockSink) flushStart() {
+	if !s.startPending {
+		return
+	}
+	s.state.EnsureMessageStart(s.c, s.flusher, s.formatter, s.messageID, s.model, s.usage)
+	s.startPending = false
+}
+
+func (s *streamBlockSink) startBlock(blockType, id, name string) {
+	s.flushStart()
+	if blockType == "tool_use" {
+		s.state.StartToolUseBlock(s.c, s.flusher, s.formatter, id, name)
+		return
+	}
+	s.state.EnsureContentBlockStart(s.c, s.flusher, s.formatter, blockType)
+}
+
+func (s *streamBlockSink) delta(deltaType, content string) {
+	switch deltaType {
+	case "text_delta":
+		s.state.SendTextDelta(s.c, s.flusher, s.formatter, content)
+	case "thinking_delta":
+		s.state.SendThinkingDelta(s.c, s.flusher, s.formatter, content)
+	case "signature_delta":
+		s.state.SendSignatureDelta(s.c, s.flusher, s.formatter, content)
+	case "input_json_delta":
+		s.state.SendInputJSONDelta(s.c, s.flusher, s.formatter, content)
+	}
+}
+
+func (s *streamBlockSink) stopBlock() {
+	s.state.FinishContentBlock(s.c, s.flusher, s.formatter)
+}
+
+// responseAssembler 将上游OpenAI增量组装为Anthropic内容块，流式与非流式路径共用
+// 文本、推理按到达顺序成块；工具调用默认累积到结束时统一输出，开启实时模式时逐片段转发
+type responseAssembler struct {
+	requestID       string
+	stopSequences   []string
+	session         *ToolCallsSession
+	sink            blockSink
+	forwardThinking bool
+	liveToolArgs    bool
+
+	messageID    string
+	messageModel string
+	stopReason   string
+	stopSequence *string
+	usage        *utils.Usage
+	isToolCall   bool // 收到过finish_reason=tool_calls
+	finishSeen   bool // 收到过finish_reason
+
+	openBlock   string          // 当前打开的块类型，空表示没有
+	pendingText strings.Builder // 尚未开启文本块的纯空白文本，避免输出空文本块
+	signature   strings.Builder // 当前thinking块的上游签名，关闭块时以signature_delta输出
+	textSent    bool            // 已输出包含非空白文本的文本块
+	blocks      int             // 已开启的块数
+	toolBlocks  int             // 已开启的tool_use块数
+	emittedIDs  map[string]bool // 已输出的工具ID，上游重复index/ID时每个ID只输出一次
+
+	// 实时转发工具参数的输出状态
+	liveTool     *AnthropicToolCall          // 当前已开启tool_use块的工具
+	liveSent     int                         // 当前工具已转发的参数字节数
+	liveCapped   bool                        // 当前工具参数已超出大小上限，不再转发后续片段
+	liveOverflow bool                        // 超出上限前已转发部分参数，块内参数无法补成合法JSON
+	liveStreamed map[*AnthropicToolCall]bool // 已开启过tool_use块的工具
+
+	err error // 无法继续输出的错误（实时工具参数超出上限），流式路径据此以error事件结束
+}
+
+// newResponseAssembler 创建响应组装器，liveToolArgs仅对流式客户端生效
+func newResponseAssembler(requestID string, stopSequences []string, session *ToolCallsSession, sink blockSink, liveToolArgs bool) *responseAssembler {
+	return &responseAssembler{
+		requestID:       requestID,
+		stopSequences:   stopSequences,
+		session:         session,
+		sink:            sink,
+		forwardThinking: forwardThinkingEnabled(),
+		liveToolArgs:    liveToolArgs,
+		stopReason:      "end_turn",
+		emittedIDs:      make(map[string]bool),
+		liveStreamed:    make(map[*AnthropicToolCall]bool),
+	}
+}
+
+// handleData 处理一个上游数据事件，返回是否应向流式客户端发送ping
+func (a *responseAssembler) handleData(rawData string) bool {
+	// 处理流结束信号
+	if rawData == "[DONE]" {
+		return false
+	}
+	if r, found := strings.CutPrefix(rawData, "finish_reason:"); found {
+		a.applyFinish(r, nil)
+		return false
+	}
+
+	var openAIChunk utils.OpenAIResponse
+	if err := utils.FastUnmarshal([]byte(rawData), &openAIChunk); err != nil || isInformationalChunk(&openAIChunk) {
+		return handleUnknownUpstreamEvent(a.requestID, rawData)
+	}
+
+	if openAIChunk.Usage != nil {
+		a.usage = collectUsageInfo(openAIChunk.Usage)
+	}
+
+	choice, ok := primaryChoice(openAIChunk.Choices, a.requestID)
+	if !ok {
+		return false
+	}
+	a.begin(openAIChunk.ID, openAIChunk.Model)
+	a.handleChoice(&choice)
+	return false
+}
+
+// begin 记录首个有效数据块的消息ID与模型，并通知输出目标（流式路径发送message_start）
+func (a *responseAssembler) begin(messageID, model string) {
+	if a.messageID == "" {
+		a.messageID = messageID
+		a.messageModel = model
+	}
+	a.ensureIdentity()
+	a.sink.begin(a.messageID, a.messageModel, a.usage)
+}
+
+// ensureIdentity 上游未提供消息ID或模型时生成一次回退值，保证流式与非流式路径输出同一ID
+func (a *responseAssembler) ensureIdentity() {
+	if a.messageID == "" {
+		a.messageID = fmt.Sprintf("msg_%d", time.Now().UnixNano())
+	}
+	if a.messageModel == "" {
+		a.messageModel = "claude-unknown"
+	}
+}
+
+// handleChoice 按到达顺序处理推理、文本与工具调用增量
+func (a *responseAssembler) handleChoice(choice *utils.OpenAIChoice) {
+	delta := choice.Delta
+	toolDelta := (delta != nil && len(delta.ToolCalls) > 0) || (choice.FinishReason != nil && *choice.FinishReason == "tool_calls")
+
+	// 工具块开启后不再输出推理与文本，避免出现在工具块之后
+	if delta != nil && a.acceptsContent() {
+		if a.forwardThinking && delta.ReasoningContent != "" {
+			a.appendThinking(delta.ReasoningContent)
+		}
+		if a.forwardThinking && delta.ReasoningSignature != "" {
+			a.appendSignature(delta.ReasoningSignature)
+		}
+		// 上游标记文本分段时（文本之后出现推理内容，或重新声明assistant角色），后续文本作为新的文本块
+		if textBoundaryDelta(delta) && a.openBlock == "text" {
+			a.closeBlock()
+		}
+		// 与首个工具调用同一增量携带的说明文本保留为工具块之前的文本
+		if text, _ := delta.Content.(string); !toolDelta || len(a.session.toolCallsOrder) == 0 {
+			a.appendText(text)
+		}
+	}
+
+	if toolDelta {
+		if a.liveToolArgs {
+			a.streamToolCallsLive(choice)
+		} else {
+			a.session.processToolCallsUnified(choice, true)
+		}
+	}
+
+	if choice.FinishReason != nil {
+		a.applyFinish(*choice.FinishReason, choice)
+	}
+}
+
+// applyFinish 记录finish_reason对应的stop_reason；choice非nil时识别命中的停止序列
+func (a *responseAssembler) applyFinish(finishReason string, choice *utils.OpenAIChoice) {
+	a.finishSeen = true
+	if mapped := stopReasonFromFinish(finishReason); mapped != "" {
+		a.stopReason = mapped
+	}
+	if finishReason == "tool_calls" {
+		a.isToolCall = true
+	}
+	if choice == nil {
+		return
+	}
+	if seq := matchedStopSequence(choice, a.stopSequences); seq != nil {
+		a.stopReason = "stop_sequence"
+		a.stopSequence = seq
+	}
+}
+
+// acceptsContent 是否仍可输出推理与文本：工具调用结束或实时工具块开启后返回false
+func (a *responseAssembler) acceptsContent() bool {
+	return !a.isToolCall && len(a.liveStreamed) == 0
+}
+
+// appendThinking 追加推理增量，当前不是thinking块时开启新的thinking块
+func (a *responseAssembler) appendThinking(thinking string) {
+	if a.openBlock != "thinking" {
+		a.startBlock("thinking", "", "")
+	}
+	a.sink.delta("thinking_delta", thinking)
+}
+
+// appendSignature 累积当前thinking块的签名；签名到达时thinking块已关闭则无法再输出
+func (a *responseAssembler) appendSignature(signature string) {
+	if a.openBlock != "thinking" {
+		a.session.debugLog("[Thinking] Dropping signature without an open thinking block")
+		return
+	}
+	a.signature.WriteString(signature)
+}
+
+// appendText 追加文本增量；纯空白文本暂存到出现非空白文本时再开启文本块，保证不输出空文本块
+func (a *responseAssembler) appendText(text string) {
+	if text == "" {
+		return
+	}
+	if a.openBlock != "text" {
+		if strings.TrimSpace(text) == "" {
+			a.pendingText.WriteString(text)
+			return
+		}
+		a.startBlock("text", "", "")
+		if a.pendingText.Len() > 0 {
+			text = a.pendingText.String() + text
+			a.pendingText.Reset()
+		}
+		a.textSent = true
+	}
+	a.sink.delta("text_delta", text)
+}
+
+// startBlock 关闭当前块后开启新块
+func (a *responseAssembler) startBlock(blockType, id, name string) {
+	a.closeBlock()
+	if blockType != "text" {
+		a.pendingText.Reset()
+	}
+	a.sink.startBlock(blockType, id, name)
+	a.openBlock = blockType
+	a.blocks++
+	if blockType == "tool_use" {
+		a.toolBlocks++
+	}
+}
+
+// closeBlock 关闭当前打开的块；thinking块在关闭前输出签名（上游未提供时为空），
+// 实时工具块未收到任何参数时补发"{}"，保证客户端得到合法input
+func (a *responseAssembler) closeBlock() {
+	if a.openBlock == "" {
+		return
+	}
+	if a.openBlock == "thinking" {
+		a.sink.delta("signature_delta", a.signature.String())
+		a.signature.Reset()
+	}
+	if a.liveTool != nil {
+		if a.liveSent == 0 {
+			a.sink.delta("input_json_delta", "{}")
+		}
+		a.liveTool = nil
+		a.liveSent = 0
+		a.liveCapped = false
+		a.liveOverflow = false
+	}
+	a.sink.stopBlock()
+	a.openBlock = ""
+}
+
+// streamToolCallsLive 累积工具调用的同时实时转发参数片段
+// 工具首次获得名称时开启tool_use块，之后的参数片段原样作为input_json_delta输出，出现新工具时关闭上一个块
+func (a *responseAssembler) streamToolCallsLive(choice *utils.OpenAIChoice) {
+	session := a.session
+	if choice.Delta == nil || len(choice.Delta.ToolCalls) == 0 {
+		session.processToolCallsUnified(choice, true)
+		return
+	}
+
+	for _, openaiTool := range choice.Delta.ToolCalls {
+		// 逐个片段累积，便于定位片段所属的工具
+		fragment := &utils.OpenAIChoice{Index: choice.Index, Delta: &utils.OpenAIMessage{ToolCalls: []utils.OpenAIToolCall{openaiTool}}}
+		if result := session.processToolCallsUnified(fragment, true); result == ToolProcessError {
+			return
+		}
+
+		var tool *AnthropicToolCall
+		if openaiTool.ID != "" {
+			tool = session.toolCallsMap[openaiTool.ID]
+		} else if indexed := session.toolByIndex(openaiTool.Index); indexed != nil {
+			tool = indexed
+		} else if len(session.toolCallsOrder) > 0 {
+			tool = session.toolCallsOrder[len(session.toolCallsOrder)-1]
+		}
+		if tool == nil || tool.Name == "" {
+			continue // 名称未知前无法开启tool_use块，参数继续累积
+		}
+
+		if tool != a.liveTool {
+			if a.liveStreamed[tool] {
+				// 已关闭的块无法重新打开，后续片段只累积不输出
+				session.debugLog("[ToolCall] Late fragment for closed tool block: id=%s", tool.ID)
+				continue
+			}
+			toolID := session.clientToolID(tool.ID)
+			if a.emittedIDs[toolID] {
+				session.debugLog("[ToolCall] Skipping duplicate tool_use ID: %s", toolID)
+				continue
+			}
+			a.emittedIDs[toolID] = true
+			a.startBlock("tool_use", toolID, tool.Name)
+			a.liveTool = tool
+			a.liveSent = 0
+			a.liveStreamed[tool] = true
+		}
+
+		// 🔧 参数超出上限：截断后的片段不转发；尚未转发任何参数时与非流式路径一致以错误对象作为input，
+		// 已转发部分参数时块内无法再得到合法JSON，记录错误由流式路径以error事件结束
+		if tool.ArgsTruncated {
+			if !a.liveCapped {
+				a.liveCapped = true
+				if a.liveSent == 0 {
+					args := tool.argumentsJSON()
+					a.sink.delta("input_json_delta", args)
+					a.liveSent = len(args)
+				} else {
+					a.liveOverflow = true
+					a.err = fmt.Errorf("arguments of tool %s exceeded the %d byte limit after %d bytes were streamed", tool.Name, session.maxArgBytes, a.liveSent)
+				}
+			}
+			continue
+		}
+
+		// 转发尚未输出的参数（包含名称到达前已累积的部分）
+		if args := tool.Arguments.String(); len(args) > a.liveSent {
+			a.sink.delta("input_json_delta", args[a.liveSent:])
+			a.liveSent = len(args)
+		}
+	}
+}
+
+// writeToolBlock 输出完整的tool_use块，参数按UTF-8安全的分块作为input_json_delta输出
+func (a *responseAssembler) writeToolBlock(id, name, argsJSON string) {
+	a.startBlock("tool_use", id, name)
+	for _, chunk := range splitUTF8SafeChunks(argsJSON, streamChunkSize) {
+		if chunk != "" {
+			a.sink.delta("input_json_delta", chunk)
+		}
+	}
+	a.closeBlock()
+}
+
+// emitToolCalls 关闭实时工具块，并输出尚未输出的已累积工具调用
+func (a *responseAssembler) emitToolCalls() {
+	a.closeBlock()
+	for _, tool := range a.session.toolCallsOrder {
+		if tool.Name == "" || a.liveStreamed[tool] {
+			continue
+		}
+		// 🎯 [重复ID修复] 上游重复index/ID时可能产生相同ID的工具，每个ID只输出一次，保持首次出现的顺序
+		toolID := a.session.clientToolID(tool.ID)
+		if a.emittedIDs[toolID] {
+			a.session.debugLog("[ToolCall] Skipping duplicate tool_use ID: %s", toolID)
+			continue
+		}
+		a.emittedIDs[toolID] = true
+		a.writeToolBlock(toolID, tool.Name, toolInputJSON(tool))
+	}
+	a.discardToolCalls()
+}
+
+// abort 上游中途出错时关闭打开的块，输出参数已完整的已累积工具调用（残缺的参数丢弃），返回结束流使用的stop_reason
+// 实时工具块已转发的参数残缺时保持块打开，由AbortWithError在error事件之后关闭
+func (a *responseAssembler) abort() string {
+	if a.liveArgsBroken() {
+		a.session.debugLog("[ToolCall] Live tool block %s left incomplete by the stream error", a.liveTool.ID)
+		a.discardToolCalls()
+		return toolCallStopReason(a.stopReason)
+	}
+	a.closeBlock()
+	for _, tool := range a.session.toolCallsOrder {
+		if tool.Name == "" || a.liveStreamed[tool] || !toolArgsComplete(tool) {
+			continue
+		}
+		toolID := a.session.clientToolID(tool.ID)
+		if a.emittedIDs[toolID] {
+			continue
+		}
+		a.emittedIDs[toolID] = true
+		a.writeToolBlock(toolID, tool.Name, toolInputJSON(tool))
+	}
+	a.discardToolCalls()
+	if a.toolBlocks > 0 {
+		return toolCallStopReason(a.stopReason)
+	}
+	return a.stopReason
+}
+
+// liveArgsBroken 实时工具块已转发的参数无法构成合法JSON（超出上限或上游中断）
+func (a *responseAssembler) liveArgsBroken() bool {
+	if a.liveTool == nil || a.liveSent == 0 {
+		return false
+	}
+	return a.liveOverflow || !toolArgsComplete(a.liveTool)
+}
+
+// toolArgsComplete 判断已累积的参数是否为完整的JSON对象；超出上限被截断的参数以错误对象输出，同样视为完整
+func toolArgsComplete(tool *AnthropicToolCall) bool {
+	if tool.ArgsTruncated {
+		return true
+	}
+	args := strings.TrimSpace(tool.Arguments.String())
+	return strings.HasPrefix(args, "{") && utils.FastValid([]byte(args))
+}
+
+// empty 上游尚未产生任何内容块或具名的工具调用
+func (a *responseAssembler) empty() bool {
+	return a.blocks == 0 && !slices.ContainsFunc(a.session.toolCallsOrder, func(tool *AnthropicToolCall) bool { return tool.Name != "" })
+}
+
+// discardToolCalls 清理已累积的工具调用与实时输出状态
+func (a *responseAssembler) discardToolCalls() {
+	clear(a.liveStreamed)
+	a.session.clearToolCallsWithLogging()
+}
+
+// toolInputJSON 返回tool_use块的input：空参数为"{}"，不是JSON对象的参数包装为{"raw_args":...}，保证客户端总能得到对象
+func toolInputJSON(tool *AnthropicToolCall) string {
+	args := tool.argumentsJSON()
+	if args == "" {
+		return "{}"
+	}
+	// 🔧 关键修复：确保JSON字符串是有效的UTF-8编码
+	args = strings.ToValidUTF8(args, "\uFFFD")
+	if strings.HasPrefix(args, "{") && utils.FastValid([]byte(args)) {
+		return args
+	}
+	data, err := utils.FastMarshal(map[string]string{"raw_args": args})
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// finish 输出累积的工具调用与默认文本，返回最终响应数据（内容块由输出目标持有）
+func (a *responseAssembler) finish() *ResponseData {
+	a.ensureIdentity()
+	a.sink.begin(a.messageID, a.messageModel, a.usage)
+
+	// 上游未发送finish_reason（也可能没有[DONE]）就关闭了流时，已累积的工具调用仍作为tool_use块输出
+	if !a.finishSeen && len(a.session.toolCallsOrder) > 0 {
+		a.session.debugLog("Upstream closed the stream without finish_reason, emitting %d accumulated tool call(s)", len(a.session.toolCallsOrder))
+	}
+	// 参数因max_tokens截断时仍输出已累积的工具调用，stop_reason保留max_tokens
+	if len(a.session.toolCallsOrder) > 0 || len(a.liveStreamed) > 0 {
+		a.emitToolCalls()
+		a.stopReason = toolCallStopReason(a.stopReason)
+	}
+	a.closeBlock()
+
+	// 🔧 工具调用结束但没有产生任何tool_use块（如工具名均为空）时回退为end_turn，避免stop_reason与内容不一致
+	if a.stopReason == "tool_use" && a.toolBlocks == 0 {
+		a.session.debugLog("No tool_use blocks produced for tool_calls finish, falling back to end_turn")
+		a.stopReason = "end_turn"
+	}
+
+	// 无有效内容时提供默认文本
+	empty := a.blocks == 0
+	if !a.textSent && a.toolBlocks == 0 {
+		a.startBlock("text", "", "")
+		a.sink.delta("text_delta", utils.FallbackText(utils.FallbackEmptyResponse))
+		a.closeBlock()
+	}
+
+	if a.stopReason != "stop_sequence" {
+		a.stopSequence = nil
+	}
+	// 上游未返回usage时提供空用量，保证响应中始终包含usage对象
+	usage := a.usage
+	if usage == nil {
+		usage = &utils.Usage{}
+	}
+
+	return &ResponseData{
+		MessageID:    a.messageID,
+		MessageModel: a.messageModel,
+		StopReason:   a.stopReason,
+		StopSequence: a.stopSequence,
+		Usage:        usage,
+		IsToolCall:   a.toolBlocks > 0,
+		Empty:        empty,
+		ToolCalls:    a.toolBlocks,
+	}
+}
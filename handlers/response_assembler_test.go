@@ -0,0 +1,806 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"codebuddy2cc/utils"
+)
+
+// upstreamChunk 构造OpenAI流式数据块，delta为nil时只携带finish_reason
+func upstreamChunk(t *testing.T, delta map[string]any, finishReason string) string {
+	t.Helper()
+	choice := map[string]any{"index": 0, "delta": delta}
+	if delta == nil {
+		choice["delta"] = map[string]any{}
+	}
+	if finishReason != "" {
+		choice["finish_reason"] = finishReason
+	}
+	data, err := json.Marshal(map[string]any{"id": "chatcmpl-1", "model": "upstream-model", "choices": []any{choice}})
+	if err != nil {
+		t.Fatalf("marshal chunk: %v", err)
+	}
+	return string(data)
+}
+
+// textDelta 文本增量
+func textDelta(text string) map[string]any {
+	return map[string]any{"content": text}
+}
+
+// toolDelta 工具调用增量，id与name为空时表示参数续片
+func toolDelta(index int, id, name, args string) map[string]any {
+	call := map[string]any{"index": index, "function": map[string]any{"arguments": args}}
+	if id != "" {
+		call["id"] = id
+		call["type"] = "function"
+	}
+	if name != "" {
+		call["function"].(map[string]any)["name"] = name
+	}
+	return map[string]any{"tool_calls": []any{call}}
+}
+
+// upstreamSSE 将数据块拼接为上游SSE响应体
+func upstreamSSE(chunks ...string) string {
+	var b strings.Builder
+	for _, chunk := range chunks {
+		b.WriteString("data: " + chunk + "\n\n")
+	}
+	return b.String()
+}
+
+// newUpstreamResponse 构造上游SSE响应
+func newUpstreamResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// runBuffered 以非流式路径处理上游响应
+func runBuffered(t *testing.T, body string) *ResponseData {
+	t.Helper()
+	data, err := processUnifiedResponse(context.Background(), newUpstreamResponse(body), NewDefaultToolCallManager("test"), "test", nil, nil)
+	if err != nil {
+		t.Fatalf("processUnifiedResponse: %v", err)
+	}
+	return data
+}
+
+// runStream 以流式路径处理上游响应，返回响应数据与客户端收到的SSE事件
+func runStream(t *testing.T, body string) (*ResponseData, []sseEvent) {
+	t.Helper()
+	c, recorder := newTestContext(http.MethodPost, "/v1/messages", "{}")
+	data := streamUnifiedResponse(c, newUpstreamResponse(body), NewDefaultToolCallManager("test"), "test", nil, nil, nil)
+	return data, parseSSE(t, recorder.Body.String())
+}
+
+// sseEvent 客户端收到的一个SSE事件
+type sseEvent struct {
+	name string
+	data map[string]any
+}
+
+// parseSSE 解析SSE响应体，忽略ping事件
+func parseSSE(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	for _, raw := range strings.Split(body, "\n\n") {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		var event sseEvent
+		for _, line := range strings.Split(raw, "\n") {
+			if name, ok := strings.CutPrefix(line, "event: "); ok {
+				event.name = name
+			} else if data, ok := strings.CutPrefix(line, "data: "); ok {
+				if err := json.Unmarshal([]byte(data), &event.data); err != nil {
+					t.Fatalf("decode SSE data %q: %v", data, err)
+				}
+			}
+		}
+		if event.name != "ping" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// streamedMessage 由SSE事件重建的消息
+type streamedMessage struct {
+	id           string
+	blocks       []utils.ContentBlock
+	stopReason   string
+	stopSequence any
+	errorMessage string
+}
+
+// reconstructMessage 按Anthropic SDK的方式由SSE事件重建消息，同时校验事件顺序与块索引
+func reconstructMessage(t *testing.T, events []sseEvent) streamedMessage {
+	t.Helper()
+	var msg streamedMessage
+	var partialJSON strings.Builder
+	open := -1
+	started, stopped := false, false
+	for i, event := range events {
+		if stopped {
+			t.Fatalf("event %d (%s) after message_stop", i, event.name)
+		}
+		if event.name != "message_start" && event.name != "error" && !started {
+			t.Fatalf("event %d (%s) before message_start", i, event.name)
+		}
+		index := -1
+		if v, ok := event.data["index"].(float64); ok {
+			index = int(v)
+		}
+		switch event.name {
+		case "message_start":
+			if started {
+				t.Fatalf("duplicate message_start")
+			}
+			started = true
+			msg.id, _ = event.data["message"].(map[string]any)["id"].(string)
+		case "content_block_start":
+			if open != -1 || index != len(msg.blocks) {
+				t.Fatalf("content_block_start index %d while block %d open and %d blocks seen", index, open, len(msg.blocks))
+			}
+			open = index
+			cb := event.data["content_block"].(map[string]any)
+			block := utils.ContentBlock{Type: cb["type"].(string)}
+			block.ID, _ = cb["id"].(string)
+			block.Name, _ = cb["name"].(string)
+			msg.blocks = append(msg.blocks, block)
+			partialJSON.Reset()
+		case "content_block_delta":
+			if index != open {
+				t.Fatalf("delta for block %d while block %d open", index, open)
+			}
+			block := &msg.blocks[index]
+			delta := event.data["delta"].(map[string]any)
+			switch delta["type"] {
+			case "text_delta":
+				block.Text += delta["text"].(string)
+			case "thinking_delta":
+				block.Thinking += delta["thinking"].(string)
+			case "signature_delta":
+				block.Signature += delta["signature"].(string)
+			case "input_json_delta":
+				partialJSON.WriteString(delta["partial_json"].(string))
+			default:
+				t.Fatalf("unexpected delta type %v", delta["type"])
+			}
+		case "content_block_stop":
+			if index != open {
+				t.Fatalf("content_block_stop for block %d while block %d open", index, open)
+			}
+			// error事件之后客户端已停止解析，残缺的块不再校验
+			if block := &msg.blocks[index]; block.Type == "tool_use" && msg.errorMessage == "" {
+				if !json.Valid([]byte(partialJSON.String())) {
+					t.Fatalf("tool_use block %d ended with invalid JSON: %s", index, partialJSON.String())
+				}
+				block.Input = json.RawMessage(partialJSON.String())
+			}
+			open = -1
+		case "message_delta":
+			if open != -1 {
+				t.Fatalf("message_delta while block %d open", open)
+			}
+			delta := event.data["delta"].(map[string]any)
+			msg.stopReason, _ = delta["stop_reason"].(string)
+			msg.stopSequence = delta["stop_sequence"]
+		case "message_stop":
+			stopped = true
+		case "error":
+			msg.errorMessage, _ = event.data["error"].(map[string]any)["message"].(string)
+		default:
+			t.Fatalf("unexpected event %q", event.name)
+		}
+	}
+	if !stopped {
+		t.Fatalf("stream ended without message_stop")
+	}
+	return msg
+}
+
+// normalizeBlocks 将内容块序列化后按json.Number解码，便于比较不同路径的输出
+func normalizeBlocks(t *testing.T, blocks []utils.ContentBlock) any {
+	t.Helper()
+	data, err := json.Marshal(blocks)
+	if err != nil {
+		t.Fatalf("marshal blocks: %v", err)
+	}
+	return decodeUseNumber(t, string(data))
+}
+
+// assertSameMessage 断言流式输出重建的消息与非流式响应一致
+func assertSameMessage(t *testing.T, label string, buffered *ResponseData, streamed streamedMessage) {
+	t.Helper()
+	if streamed.errorMessage != "" {
+		t.Fatalf("%s: unexpected error event: %s", label, streamed.errorMessage)
+	}
+	if got, want := normalizeBlocks(t, streamed.blocks), normalizeBlocks(t, buffered.ContentBlocks); !reflect.DeepEqual(got, want) {
+		t.Fatalf("%s: content differs\n stream: %v\nbuffered: %v", label, got, want)
+	}
+	if streamed.stopReason != buffered.StopReason {
+		t.Fatalf("%s: stop_reason = %q, buffered %q", label, streamed.stopReason, buffered.StopReason)
+	}
+}
+
+func TestStreamAndBufferedPathsProduceSameMessage(t *testing.T) {
+	tests := []struct {
+		name           string
+		chunks         func(t *testing.T) []string
+		wantStopReason string
+		wantTypes      []string
+	}{
+		{
+			name: "text in fragments",
+			chunks: func(t *testing.T) []string {
+				return []string{
+					upstreamChunk(t, map[string]any{"role": "assistant", "content": ""}, ""),
+					upstreamChunk(t, textDelta("Hello, "), ""),
+					upstreamChunk(t, textDelta("world"), ""),
+					upstreamChunk(t, nil, "stop"),
+					"[DONE]",
+				}
+			},
+			wantStopReason: "end_turn",
+			wantTypes:      []string{"text"},
+		},
+		{
+			name: "leading whitespace is kept with the text",
+			chunks: func(t *testing.T) []string {
+				return []string{
+					upstreamChunk(t, textDelta("\n\n"), ""),
+					upstreamChunk(t, textDelta("answer"), ""),
+					upstreamChunk(t, nil, "stop"),
+				}
+			},
+			wantStopReason: "end_turn",
+			wantTypes:      []string{"text"},
+		},
+		{
+			name: "preamble text and split tool arguments",
+			chunks: func(t *testing.T) []string {
+				first := toolDelta(0, "call_1", "read_file", `{"path":`)
+				first["content"] = "Let me check."
+				return []string{
+					upstreamChunk(t, first, ""),
+					upstreamChunk(t, toolDelta(0, "", "", `"a.go","limit":12345678901234567890}`), ""),
+					upstreamChunk(t, toolDelta(1, "call_2", "list", ""), ""),
+					upstreamChunk(t, toolDelta(1, "", "", `{"dir":"."}`), ""),
+					upstreamChunk(t, nil, "tool_calls"),
+					"[DONE]",
+				}
+			},
+			wantStopReason: "tool_use",
+			wantTypes:      []string{"text", "tool_use", "tool_use"},
+		},
+		{
+			name: "tool arguments that are not an object",
+			chunks: func(t *testing.T) []string {
+				return []string{
+					upstreamChunk(t, toolDelta(0, "call_1", "run", `[1,2`), ""),
+					upstreamChunk(t, nil, "tool_calls"),
+				}
+			},
+			wantStopReason: "tool_use",
+			wantTypes:      []string{"tool_use"},
+		},
+		{
+			name: "tool call without finish_reason",
+			chunks: func(t *testing.T) []string {
+				return []string{
+					upstreamChunk(t, toolDelta(0, "call_1", "run", `{"cmd":"ls"}`), ""),
+				}
+			},
+			wantStopReason: "tool_use",
+			wantTypes:      []string{"tool_use"},
+		},
+		{
+			name: "tool arguments cut by max_tokens",
+			chunks: func(t *testing.T) []string {
+				return []string{
+					upstreamChunk(t, toolDelta(0, "call_1", "write", `{"content":"abc`), ""),
+					upstreamChunk(t, nil, "length"),
+				}
+			},
+			wantStopReason: "max_tokens",
+			wantTypes:      []string{"tool_use"},
+		},
+		{
+			name: "empty response falls back to default text",
+			chunks: func(t *testing.T) []string {
+				return []string{
+					upstreamChunk(t, textDelta("  "), ""),
+					upstreamChunk(t, nil, "stop"),
+				}
+			},
+			wantStopReason: "end_turn",
+			wantTypes:      []string{"text"},
+		},
+	}
+	for _, tt := range tests {
+		for _, upstreamID := range []bool{true, false} {
+			name := tt.name
+			if !upstreamID {
+				name += " without upstream id"
+			}
+			t.Run(name, func(t *testing.T) {
+				chunks := tt.chunks(t)
+				if !upstreamID {
+					for i := range chunks {
+						chunks[i] = strings.Replace(chunks[i], `,"id":"chatcmpl-1"`, "", 1)
+					}
+				}
+				body := upstreamSSE(chunks...)
+
+				buffered := runBuffered(t, body)
+				var types []string
+				for _, block := range buffered.ContentBlocks {
+					types = append(types, block.Type)
+				}
+				if !reflect.DeepEqual(types, tt.wantTypes) {
+					t.Fatalf("buffered block types = %v, want %v", types, tt.wantTypes)
+				}
+				if buffered.StopReason != tt.wantStopReason {
+					t.Fatalf("buffered stop_reason = %q, want %q", buffered.StopReason, tt.wantStopReason)
+				}
+
+				streamData, events := runStream(t, body)
+				streamed := reconstructMessage(t, events)
+				assertSameMessage(t, "live stream", buffered, streamed)
+				if streamData.ToolCalls != buffered.ToolCalls || streamData.Empty != buffered.Empty {
+					t.Fatalf("stream result = %+v, buffered %+v", streamData, buffered)
+				}
+				// 客户端收到的ID必须与流式路径记录的ID一致，缺少上游ID时两条路径生成相同格式的回退ID
+				if streamed.id != streamData.MessageID {
+					t.Fatalf("message_start id = %q, stream result id %q", streamed.id, streamData.MessageID)
+				}
+				for _, id := range []string{buffered.MessageID, streamData.MessageID} {
+					if upstreamID && id != "chatcmpl-1" {
+						t.Fatalf("message id = %q, want the upstream id", id)
+					}
+					if !upstreamID && (!strings.HasPrefix(id, "msg_") || strings.HasPrefix(id, "msg_interim_")) {
+						t.Fatalf("fallback message id = %q, want msg_<n>", id)
+					}
+				}
+
+				// 缓存的响应数据重放为SSE时也必须得到同一消息
+				c, recorder := newTestContext(http.MethodPost, "/v1/messages", "{}")
+				writeStreamResponse(c, buffered)
+				replayed := reconstructMessage(t, parseSSE(t, recorder.Body.String()))
+				assertSameMessage(t, "replayed stream", buffered, replayed)
+				if replayed.id != buffered.MessageID {
+					t.Fatalf("replayed message_start id = %q, want %q", replayed.id, buffered.MessageID)
+				}
+			})
+		}
+	}
+}
+
+func TestThinkingInterleavedWithTextKeepsArrivalOrder(t *testing.T) {
+	t.Setenv("CODEBUDDY2CC_FORWARD_THINKING", "1")
+	body := upstreamSSE(
+		upstreamChunk(t, map[string]any{"role": "assistant", "reasoning_content": "Plan the answer."}, ""),
+		upstreamChunk(t, map[string]any{"reasoning_signature": "sig-1"}, ""),
+		upstreamChunk(t, textDelta("First part."), ""),
+		upstreamChunk(t, map[string]any{"reasoning_content": "Check the second part."}, ""),
+		upstreamChunk(t, textDelta("Second part."), ""),
+		upstreamChunk(t, nil, "stop"),
+		"[DONE]",
+	)
+	want := []utils.ContentBlock{
+		{Type: "thinking", Thinking: "Plan the answer.", Signature: "sig-1"},
+		{Type: "text", Text: "First part."},
+		{Type: "thinking", Thinking: "Check the second part."},
+		{Type: "text", Text: "Second part."},
+	}
+
+	buffered := runBuffered(t, body)
+	if got, wantNorm := normalizeBlocks(t, buffered.ContentBlocks), normalizeBlocks(t, want); !reflect.DeepEqual(got, wantNorm) {
+		t.Fatalf("buffered content = %v, want %v", got, wantNorm)
+	}
+
+	_, events := runStream(t, body)
+	assertSameMessage(t, "live stream", buffered, reconstructMessage(t, events))
+	// 每个thinking块都在content_block_stop之前输出signature_delta
+	for i, event := range events {
+		if event.name != "content_block_start" || event.data["content_block"].(map[string]any)["type"] != "thinking" {
+			continue
+		}
+		for j := i + 1; j < len(events); j++ {
+			if events[j].name != "content_block_stop" {
+				continue
+			}
+			if delta, _ := events[j-1].data["delta"].(map[string]any); delta["type"] != "signature_delta" {
+				t.Fatalf("thinking block starting at event %d closed without signature_delta: %v", i, events[j-1].data)
+			}
+			break
+		}
+	}
+
+	c, recorder := newTestContext(http.MethodPost, "/v1/messages", "{}")
+	writeStreamResponse(c, buffered)
+	assertSameMessage(t, "replayed stream", buffered, reconstructMessage(t, parseSSE(t, recorder.Body.String())))
+}
+
+func TestJSONUpstreamThinkingWithSignature(t *testing.T) {
+	t.Setenv("CODEBUDDY2CC_FORWARD_THINKING", "1")
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body: io.NopCloser(strings.NewReader(`{"id":"chatcmpl-1","model":"m","choices":[{"index":0,"finish_reason":"stop",` +
+			`"message":{"role":"assistant","reasoning_content":"think","reasoning_signature":"sig-json","content":"answer"}}]}`)),
+	}
+	data, err := processUnifiedResponse(context.Background(), resp, NewDefaultToolCallManager("test"), "test", nil, nil)
+	if err != nil {
+		t.Fatalf("processUnifiedResponse: %v", err)
+	}
+	want := []utils.ContentBlock{
+		{Type: "thinking", Thinking: "think", Signature: "sig-json"},
+		{Type: "text", Text: "answer"},
+	}
+	if got, wantNorm := normalizeBlocks(t, data.ContentBlocks), normalizeBlocks(t, want); !reflect.DeepEqual(got, wantNorm) {
+		t.Fatalf("content = %v, want %v", got, wantNorm)
+	}
+}
+
+func TestStreamOpensNewTextBlockAtBoundary(t *testing.T) {
+	t.Setenv("CODEBUDDY2CC_FORWARD_THINKING", "")
+	body := upstreamSSE(
+		upstreamChunk(t, map[string]any{"role": "assistant", "content": "Intro."}, ""),
+		upstreamChunk(t, map[string]any{"role": "assistant", "content": ""}, ""),
+		upstreamChunk(t, textDelta("After role."), ""),
+		upstreamChunk(t, map[string]any{"reasoning_content": "hidden"}, ""),
+		upstreamChunk(t, textDelta("After reasoning."), ""),
+		upstreamChunk(t, map[string]any{"role": "assistant", "content": " same block"}, ""),
+		upstreamChunk(t, nil, "stop"),
+	)
+	want := []utils.ContentBlock{
+		{Type: "text", Text: "Intro."},
+		{Type: "text", Text: "After role."},
+		{Type: "text", Text: "After reasoning. same block"},
+	}
+
+	_, events := runStream(t, body)
+	streamed := reconstructMessage(t, events)
+	if got, wantNorm := normalizeBlocks(t, streamed.blocks), normalizeBlocks(t, want); !reflect.DeepEqual(got, wantNorm) {
+		t.Fatalf("streamed content = %v, want %v", got, wantNorm)
+	}
+	assertSameMessage(t, "live stream", runBuffered(t, body), streamed)
+}
+
+// failingBody 先返回给定内容，之后以err失败，模拟上游连接中途出错
+type failingBody struct {
+	data *strings.Reader
+	err  error
+}
+
+func (b *failingBody) Read(p []byte) (int, error) {
+	if b.data.Len() > 0 {
+		return b.data.Read(p)
+	}
+	return 0, b.err
+}
+
+func (b *failingBody) Close() error { return nil }
+
+func TestStreamErrorFlushesCompletedToolCalls(t *testing.T) {
+	tests := []struct {
+		name           string
+		chunks         func(t *testing.T) []string
+		wantBlocks     []utils.ContentBlock
+		wantStopReason string
+	}{
+		{
+			name: "completed tool call is emitted and partial one dropped",
+			chunks: func(t *testing.T) []string {
+				return []string{
+					upstreamChunk(t, toolDelta(0, "call_1", "read_file", `{"path":"a.go"}`), ""),
+					upstreamChunk(t, toolDelta(1, "call_2", "write_file", `{"path":"b.go","content":"par`), ""),
+				}
+			},
+			wantBlocks:     []utils.ContentBlock{{Type: "tool_use", ID: "call_1", Name: "read_file", Input: json.RawMessage(`{"path":"a.go"}`)}},
+			wantStopReason: "tool_use",
+		},
+		{
+			name: "open text block is closed",
+			chunks: func(t *testing.T) []string {
+				return []string{upstreamChunk(t, textDelta("partial answer"), "")}
+			},
+			wantBlocks:     []utils.ContentBlock{{Type: "text", Text: "partial answer"}},
+			wantStopReason: "end_turn",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := newUpstreamResponse("")
+			resp.Body = &failingBody{data: strings.NewReader(upstreamSSE(tt.chunks(t)...)), err: errors.New("connection reset by peer")}
+			c, recorder := newTestContext(http.MethodPost, "/v1/messages", "{}")
+			validationErrors := stats.validationErrors.Load()
+			data := streamUnifiedResponse(c, resp, NewDefaultToolCallManager("test"), "test", nil, nil, nil)
+			if got := stats.validationErrors.Load() - validationErrors; got != 0 {
+				t.Fatalf("stream recorded %d sequence validation error(s)", got)
+			}
+
+			streamed := reconstructMessage(t, parseSSE(t, recorder.Body.String()))
+			if !strings.Contains(streamed.errorMessage, "connection reset by peer") {
+				t.Fatalf("error event message = %q", streamed.errorMessage)
+			}
+			if got, want := normalizeBlocks(t, streamed.blocks), normalizeBlocks(t, tt.wantBlocks); !reflect.DeepEqual(got, want) {
+				t.Fatalf("streamed content = %v, want %v", got, want)
+			}
+			if streamed.stopReason != tt.wantStopReason || data.StopReason != tt.wantStopReason {
+				t.Fatalf("stop_reason = %q (result %q), want %q", streamed.stopReason, data.StopReason, tt.wantStopReason)
+			}
+		})
+	}
+}
+
+func TestStreamErrorBeforeAnyData(t *testing.T) {
+	resp := newUpstreamResponse("")
+	resp.Body = &failingBody{data: strings.NewReader(""), err: errors.New("connection reset by peer")}
+	c, recorder := newTestContext(http.MethodPost, "/v1/messages", "{}")
+	streamUnifiedResponse(c, resp, NewDefaultToolCallManager("test"), "test", nil, nil, nil)
+
+	events := parseSSE(t, recorder.Body.String())
+	if len(events) != 1 || events[0].name != "error" {
+		t.Fatalf("events = %+v, want a single error event", events)
+	}
+}
+
+func TestLiveToolArgsEnforceSizeCap(t *testing.T) {
+	t.Setenv("CODEBUDDY2CC_STREAM_TOOL_ARGS", "1")
+	t.Setenv("CODEBUDDY2CC_MAX_TOOL_ARG_BYTES", "16")
+
+	t.Run("first fragment over the cap becomes the error object", func(t *testing.T) {
+		body := upstreamSSE(
+			upstreamChunk(t, toolDelta(0, "call_1", "write_file", ""), ""),
+			upstreamChunk(t, toolDelta(0, "", "", `{"content":"far more than sixteen bytes"}`), ""),
+			upstreamChunk(t, nil, "tool_calls"),
+		)
+		buffered := runBuffered(t, body)
+		var input map[string]any
+		if err := json.Unmarshal(buffered.ContentBlocks[0].Input.(json.RawMessage), &input); err != nil || input["error"] == nil {
+			t.Fatalf("buffered input = %s, want error object", buffered.ContentBlocks[0].Input)
+		}
+		_, events := runStream(t, body)
+		assertSameMessage(t, "live stream", buffered, reconstructMessage(t, events))
+	})
+
+	t.Run("overflow after streamed fragments ends with an error", func(t *testing.T) {
+		body := upstreamSSE(
+			upstreamChunk(t, toolDelta(0, "call_1", "write_file", `{"a":"12345"`), ""),
+			upstreamChunk(t, toolDelta(0, "", "", `,"b":"67890"}`), ""),
+			upstreamChunk(t, textDelta("never sent"), ""),
+			upstreamChunk(t, nil, "tool_calls"),
+		)
+		_, events := runStream(t, body)
+		streamed := reconstructMessage(t, events)
+		if !strings.Contains(streamed.errorMessage, "exceeded the 16 byte limit") {
+			t.Fatalf("error event message = %q", streamed.errorMessage)
+		}
+
+		var partial strings.Builder
+		errorSeen := false
+		for _, event := range events {
+			switch event.name {
+			case "error":
+				errorSeen = true
+			case "content_block_delta":
+				if errorSeen {
+					t.Fatalf("delta after error event: %v", event.data)
+				}
+				partial.WriteString(event.data["delta"].(map[string]any)["partial_json"].(string))
+			case "content_block_stop":
+				if !errorSeen {
+					t.Fatalf("incomplete tool block closed before the error event")
+				}
+			}
+		}
+		if partial.String() != `{"a":"12345"` {
+			t.Fatalf("streamed arguments = %q, want only fragments within the cap", partial.String())
+		}
+	})
+}
+
+func TestLiveToolArgsMatchBufferedArguments(t *testing.T) {
+	t.Setenv("CODEBUDDY2CC_STREAM_TOOL_ARGS", "1")
+	body := upstreamSSE(
+		// 名称到达前的参数片段在开启块时一并转发
+		upstreamChunk(t, toolDelta(0, "call_1", "", `{"path":"src/`), ""),
+		upstreamChunk(t, toolDelta(0, "", "edit_file", `main.go","line":9007199254740993,`), ""),
+		upstreamChunk(t, toolDelta(0, "", "", `"ratio":0.10,"text":"多字节 ✓ \"quoted\""}`), ""),
+		upstreamChunk(t, toolDelta(1, "call_2", "list", ""), ""),
+		upstreamChunk(t, toolDelta(1, "", "", `{"dir":"."}`), ""),
+		upstreamChunk(t, toolDelta(2, "call_3", "pwd", ""), ""),
+		upstreamChunk(t, nil, "tool_calls"),
+		"[DONE]",
+	)
+
+	buffered := runBuffered(t, body)
+	_, events := runStream(t, body)
+	assertSameMessage(t, "live stream", buffered, reconstructMessage(t, events))
+
+	// 逐块拼接input_json_delta，与非流式路径的input原文逐字一致
+	var streamedArgs []string
+	for _, event := range events {
+		switch event.name {
+		case "content_block_start":
+			streamedArgs = append(streamedArgs, "")
+		case "content_block_delta":
+			streamedArgs[len(streamedArgs)-1] += event.data["delta"].(map[string]any)["partial_json"].(string)
+		}
+	}
+	if len(streamedArgs) != len(buffered.ContentBlocks) {
+		t.Fatalf("streamed %d blocks, buffered %d", len(streamedArgs), len(buffered.ContentBlocks))
+	}
+	for i, block := range buffered.ContentBlocks {
+		if want := string(block.Input.(json.RawMessage)); streamedArgs[i] != want {
+			t.Fatalf("block %d arguments = %s, buffered %s", i, streamedArgs[i], want)
+		}
+	}
+}
+
+func TestDuplicateToolIndex(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunks    func(t *testing.T) []string
+		wantTools []string // 期望的"名称 input"，按块顺序
+	}{
+		{
+			name: "distinct ids repeat index 0",
+			chunks: func(t *testing.T) []string {
+				return []string{
+					upstreamChunk(t, toolDelta(0, "call_1", "read_file", `{"path":"a.go"}`), ""),
+					upstreamChunk(t, toolDelta(0, "call_2", "list", `{"dir":"."}`), ""),
+					upstreamChunk(t, nil, "tool_calls"),
+					"[DONE]",
+				}
+			},
+			wantTools: []string{`read_file {"path":"a.go"}`, `list {"dir":"."}`},
+		},
+		{
+			name: "same id re-announced",
+			chunks: func(t *testing.T) []string {
+				return []string{
+					upstreamChunk(t, toolDelta(0, "call_1", "read_file", `{"path":`), ""),
+					upstreamChunk(t, toolDelta(0, "call_1", "read_file", `"a.go"}`), ""),
+					upstreamChunk(t, toolDelta(1, "call_2", "list", `{}`), ""),
+					upstreamChunk(t, nil, "tool_calls"),
+					"[DONE]",
+				}
+			},
+			wantTools: []string{`read_file {"path":"a.go"}`, `list {}`},
+		},
+	}
+	for _, tt := range tests {
+		for _, live := range []string{"", "1"} {
+			t.Run(tt.name+" live="+live, func(t *testing.T) {
+				t.Setenv("CODEBUDDY2CC_STREAM_TOOL_ARGS", live)
+				body := upstreamSSE(tt.chunks(t)...)
+
+				buffered := runBuffered(t, body)
+				_, events := runStream(t, body)
+				// reconstructMessage校验块索引从0开始连续递增
+				streamed := reconstructMessage(t, events)
+				assertSameMessage(t, "duplicate index", buffered, streamed)
+
+				if streamed.stopReason != "tool_use" {
+					t.Fatalf("stop_reason = %q, want tool_use", streamed.stopReason)
+				}
+				seen := make(map[string]bool)
+				var got []string
+				for _, block := range streamed.blocks {
+					if block.Type != "tool_use" || seen[block.ID] {
+						t.Fatalf("blocks = %+v, want tool_use blocks with unique ids", streamed.blocks)
+					}
+					seen[block.ID] = true
+					input, _ := json.Marshal(block.Input)
+					got = append(got, block.Name+" "+string(input))
+				}
+				if !reflect.DeepEqual(got, tt.wantTools) {
+					t.Fatalf("tools = %q, want %q", got, tt.wantTools)
+				}
+			})
+		}
+	}
+}
+
+func TestAbruptEOFMidToolCall(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "connection dropped mid-body", err: io.ErrUnexpectedEOF},
+		{name: "closed without finish_reason or [DONE]", err: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := upstreamSSE(
+				upstreamChunk(t, textDelta("Reading the file."), ""),
+				upstreamChunk(t, toolDelta(0, "call_1", "read_file", `{"path":`), ""),
+				upstreamChunk(t, toolDelta(0, "", "", `"a.go"}`), ""),
+			)
+			newResp := func() *http.Response {
+				resp := newUpstreamResponse("")
+				resp.Body = &failingBody{data: strings.NewReader(body), err: tt.err}
+				return resp
+			}
+			want := []utils.ContentBlock{
+				{Type: "text", Text: "Reading the file."},
+				{Type: "tool_use", ID: "call_1", Name: "read_file", Input: json.RawMessage(`{"path":"a.go"}`)},
+			}
+
+			buffered, err := processUnifiedResponse(context.Background(), newResp(), NewDefaultToolCallManager("test"), "test", nil, nil)
+			if err != nil {
+				t.Fatalf("processUnifiedResponse: %v", err)
+			}
+			if got := normalizeBlocks(t, buffered.ContentBlocks); !reflect.DeepEqual(got, normalizeBlocks(t, want)) {
+				t.Fatalf("buffered content = %v", got)
+			}
+			if buffered.StopReason != "tool_use" {
+				t.Fatalf("buffered stop_reason = %q, want tool_use", buffered.StopReason)
+			}
+
+			c, recorder := newTestContext(http.MethodPost, "/v1/messages", "{}")
+			streamUnifiedResponse(c, newResp(), NewDefaultToolCallManager("test"), "test", nil, nil, nil)
+			assertSameMessage(t, "abrupt eof", buffered, reconstructMessage(t, parseSSE(t, recorder.Body.String())))
+		})
+	}
+}
+
+func TestToolCallsWithOnlyEmptyNamesEndTurn(t *testing.T) {
+	tests := []struct {
+		name string
+		text string // 工具调用前的文本，为空时期望默认文本
+		want string
+	}{
+		{name: "no text falls back to default text", want: utils.FallbackText(utils.FallbackEmptyResponse)},
+		{name: "text is kept", text: "Let me check.", want: "Let me check."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var chunks []string
+			if tt.text != "" {
+				chunks = append(chunks, upstreamChunk(t, textDelta(tt.text), ""))
+			}
+			chunks = append(chunks,
+				upstreamChunk(t, toolDelta(0, "call_1", "", `{"path":"a.go"}`), ""),
+				upstreamChunk(t, toolDelta(1, "call_2", "", `{}`), ""),
+				upstreamChunk(t, nil, "tool_calls"),
+				"[DONE]",
+			)
+			body := upstreamSSE(chunks...)
+			want := []utils.ContentBlock{{Type: "text", Text: tt.want}}
+
+			buffered := runBuffered(t, body)
+			if buffered.StopReason != "end_turn" {
+				t.Fatalf("buffered stop_reason = %q, want end_turn", buffered.StopReason)
+			}
+			if got := normalizeBlocks(t, buffered.ContentBlocks); !reflect.DeepEqual(got, normalizeBlocks(t, want)) {
+				t.Fatalf("buffered content = %v, want %v", got, normalizeBlocks(t, want))
+			}
+			if buffered.IsToolCall || buffered.ToolCalls != 0 {
+				t.Fatalf("buffered tool calls = %d (IsToolCall %v), want none", buffered.ToolCalls, buffered.IsToolCall)
+			}
+
+			_, events := runStream(t, body)
+			streamed := reconstructMessage(t, events)
+			if streamed.stopReason != "end_turn" {
+				t.Fatalf("streamed stop_reason = %q, want end_turn", streamed.stopReason)
+			}
+			assertSameMessage(t, "empty tool names", buffered, streamed)
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"time"
+
+	"codebuddy2cc/utils"
+)
+
+// defaultMaxUpstreamAttempts 单个请求默认最多向上游发起的次数（首次请求+一次换密钥重试）
+const defaultMaxUpstreamAttempts = 2
+
+// retryBudget 单个请求共享的上游尝试预算，所有重试路径都从同一预算扣减，保证总次数和总耗时有界
+// 单goroutine使用，无需并发保护
+type retryBudget struct {
+	remaining int
+	deadline  time.Time
+}
+
+// newRetryBudget 按 CODEBUDDY2CC_MAX_ATTEMPTS 与 CODEBUDDY2CC_RETRY_BUDGET（秒）创建预算
+// 时间预算未配置或超过请求超时时以请求超时为准
+func newRetryBudget() *retryBudget {
+	attempts := utils.EnvInt("CODEBUDDY2CC_MAX_ATTEMPTS", defaultMaxUpstreamAttempts)
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	window := requestTimeout
+	if seconds := utils.EnvInt("CODEBUDDY2CC_RETRY_BUDGET", 0); seconds > 0 && time.Duration(seconds)*time.Second < window {
+		window = time.Duration(seconds) * time.Second
+	}
+
+	return &retryBudget{remaining: attempts, deadline: time.Now().Add(window)}
+}
+
+// take 尝试消耗一次上游请求机会，次数或时间预算耗尽时返回false
+func (b *retryBudget) take() bool {
+	if b.remaining <= 0 || time.Now().After(b.deadline) {
+		return false
+	}
+	b.remaining--
+	return true
+}
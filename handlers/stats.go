@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"codebuddy2cc/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serviceStats 进程级请求统计，汇总各请求独立的会话/流状态数据，用于容量规划
+type serviceStats struct {
+	startedAt        time.Time
+	inFlight         atomic.Int64  // 正在处理的 /v1/messages 请求数
+	requestsTotal    atomic.Uint64 // 已处理完成的请求总数
+	toolCallsTotal   atomic.Uint64 // 输出给客户端的tool_use块总数
+	validationErrors atomic.Uint64 // SSE事件序列验证失败总数
+}
+
+var stats = &serviceStats{startedAt: time.Now()}
+
+// beginRequest 记录请求开始，返回的函数在请求结束时调用
+func (s *serviceStats) beginRequest() func() {
+	s.inFlight.Add(1)
+	return func() {
+		s.inFlight.Add(-1)
+		s.requestsTotal.Add(1)
+	}
+}
+
+// recordStream 汇总单个SSE流状态的工具调用数与验证错误数（流输出结束时调用）
+func (s *serviceStats) recordStream(state *SSEStreamState) {
+	s.toolCallsTotal.Add(uint64(state.toolUseBlocks))
+	s.validationErrors.Add(uint64(state.errorCount))
+}
+
+// recordContentBlocks 汇总非流式响应中的tool_use块数
+func (s *serviceStats) recordContentBlocks(blocks []utils.ContentBlock) {
+	for _, block := range blocks {
+		if block.Type == "tool_use" {
+			s.toolCallsTotal.Add(1)
+		}
+	}
+}
+
+// ServiceStatsHandler 处理 /service/stats：返回进行中的请求数及累计统计
+func ServiceStatsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"in_flight_requests":      stats.inFlight.Load(),
+		"requests_total":          stats.requestsTotal.Load(),
+		"tool_calls_total":        stats.toolCallsTotal.Load(),
+		"validation_errors_total": stats.validationErrors.Load(),
+		"uptime_seconds":          int64(time.Since(stats.startedAt).Seconds()),
+		"timestamp":               utils.GetCurrentTimestamp(),
+	})
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"sync"
+
+	"codebuddy2cc/utils"
+)
+
+// clientStreamCounter 按客户端统计进行中的流式请求数
+type clientStreamCounter struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+var clientStreams = &clientStreamCounter{active: make(map[string]int)}
+
+// maxStreamsPerClient 单个客户端允许同时进行的流式请求数，0表示不限制
+func maxStreamsPerClient() int {
+	return utils.EnvInt("CODEBUDDY2CC_MAX_STREAMS_PER_CLIENT", 0)
+}
+
+// acquire 为客户端占用一个流式名额，超出limit时返回false
+func (s *clientStreamCounter) acquire(client string, limit int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active[client] >= limit {
+		return false
+	}
+	s.active[client]++
+	return true
+}
+
+// release 释放客户端的流式名额，计数归零时删除记录避免内存增长
+func (s *clientStreamCounter) release(client string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active[client] <= 1 {
+		delete(s.active, client)
+		return
+	}
+	s.active[client]--
+}
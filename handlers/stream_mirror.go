@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"codebuddy2cc/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamMirrorWriter 将写给客户端的SSE帧原样复制到镜像目标，用于排查客户端收到的格式异常的流
+type streamMirrorWriter struct {
+	gin.ResponseWriter
+	out io.Writer
+}
+
+func (w *streamMirrorWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	if n > 0 {
+		w.out.Write(data[:n])
+	}
+	return n, err
+}
+
+func (w *streamMirrorWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	if n > 0 {
+		io.WriteString(w.out, s[:n])
+	}
+	return n, err
+}
+
+// debugFileMirror 以请求ID为前缀写入debug文件，多个请求的帧可能交错
+type debugFileMirror struct {
+	requestID string
+}
+
+func (m debugFileMirror) Write(data []byte) (int, error) {
+	utils.WriteDebugFileRaw("[Request:" + m.requestID + "] [Mirror]\n" + string(data))
+	return len(data), nil
+}
+
+// enableStreamMirror 启用 CODEBUDDY2CC_MIRROR_STREAM 时包装c.Writer，未启用时不做任何处理
+// 配置 CODEBUDDY2CC_MIRROR_DIR 时每个请求写入 <requestID>.sse，否则写入debug文件（需启用DEBUG与DEBUG_FILE）
+func enableStreamMirror(c *gin.Context) {
+	if !utils.EnvBool("CODEBUDDY2CC_MIRROR_STREAM") {
+		return
+	}
+	if _, mirrored := c.Writer.(*streamMirrorWriter); mirrored {
+		return
+	}
+
+	requestID := c.GetString(utils.RequestIDKey)
+	if requestID == "" {
+		requestID = generateRequestID()
+	}
+
+	var out io.Writer = debugFileMirror{requestID: requestID}
+	if dir := strings.TrimSpace(os.Getenv("CODEBUDDY2CC_MIRROR_DIR")); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("Warning: failed to create stream mirror dir %s: %v", dir, err)
+			return
+		}
+		path := filepath.Join(dir, requestID+".sse")
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Printf("Warning: failed to open stream mirror file %s: %v", path, err)
+			return
+		}
+		out = f
+	}
+
+	c.Writer = &streamMirrorWriter{ResponseWriter: c.Writer, out: out}
+}
+
+// closeStreamMirror 请求结束时关闭镜像文件
+func closeStreamMirror(c *gin.Context) {
+	if w, ok := c.Writer.(*streamMirrorWriter); ok {
+		if closer, ok := w.out.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStreamMirrorFileMatchesResponse(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CODEBUDDY2CC_MIRROR_STREAM", "1")
+	t.Setenv("CODEBUDDY2CC_MIRROR_DIR", dir)
+	startFakeUpstream(t, upstreamSSE(
+		upstreamChunk(t, textDelta("Hello, "), ""),
+		upstreamChunk(t, textDelta("world"), ""),
+		upstreamChunk(t, toolDelta(0, "call_1", "get_weather", `{"city":"Paris"}`), ""),
+		upstreamChunk(t, nil, "tool_calls"),
+		"[DONE]",
+	))
+
+	body := `{"model":"test-model","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	c, recorder := newTestContext(http.MethodPost, "/v1/messages", body)
+	MessagesHandler(c)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", recorder.Code, recorder.Body.String())
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.sse"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("mirror files = %v (err %v), want exactly one", files, err)
+	}
+	mirrored, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("read mirror file: %v", err)
+	}
+	if len(parseSSE(t, recorder.Body.String())) == 0 {
+		t.Fatalf("no SSE frames in response: %s", recorder.Body.String())
+	}
+	if string(mirrored) != recorder.Body.String() {
+		t.Fatalf("mirror file differs from response\nmirror:\n%s\nresponse:\n%s", mirrored, recorder.Body.String())
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"codebuddy2cc/utils"
+)
+
+// defaultTraceMaxBytes 单个追踪文件中上游事件的默认字节上限
+const defaultTraceMaxBytes = 10 << 20
+
+// requestTrace 单个请求的调试追踪，请求结束时写入 CODEBUDDY2CC_TRACE_DIR/<requestID>.json
+// 所有方法对nil接收者安全，未配置追踪目录时为nil
+type requestTrace struct {
+	dir      string
+	maxBytes int
+	size     int
+
+	RequestID        string          `json:"request_id"`
+	Timestamp        string          `json:"timestamp"`
+	AnthropicRequest json.RawMessage `json:"anthropic_request,omitempty"`
+	OpenAIRequest    json.RawMessage `json:"openai_request,omitempty"`
+	UpstreamStatus   int             `json:"upstream_status,omitempty"`
+	UpstreamEvents   []string        `json:"upstream_events"`
+	Truncated        bool            `json:"truncated,omitempty"`
+}
+
+// newRequestTrace 未配置 CODEBUDDY2CC_TRACE_DIR 时返回nil
+func newRequestTrace(requestID string) *requestTrace {
+	dir := strings.TrimSpace(os.Getenv("CODEBUDDY2CC_TRACE_DIR"))
+	if dir == "" {
+		return nil
+	}
+	maxBytes := utils.EnvInt("CODEBUDDY2CC_TRACE_MAX_BYTES", defaultTraceMaxBytes)
+	if maxBytes <= 0 {
+		maxBytes = defaultTraceMaxBytes
+	}
+	return &requestTrace{
+		dir:            dir,
+		maxBytes:       maxBytes,
+		RequestID:      requestID,
+		Timestamp:      utils.GetCurrentTimestamp(),
+		UpstreamEvents: make([]string, 0, 64),
+	}
+}
+
+// setAnthropicRequest 记录客户端原始请求（调用时立即序列化，之后的修改不影响追踪内容）
+func (t *requestTrace) setAnthropicRequest(req *utils.AnthropicRequest) {
+	if t == nil {
+		return
+	}
+	if data, err := utils.FastMarshal(req); err == nil {
+		t.AnthropicRequest = data
+	}
+}
+
+// setOpenAIRequest 记录实际发送给上游的请求体
+func (t *requestTrace) setOpenAIRequest(body []byte) {
+	if t == nil {
+		return
+	}
+	t.OpenAIRequest = json.RawMessage(body)
+}
+
+// setUpstreamStatus 记录上游响应状态码
+func (t *requestTrace) setUpstreamStatus(status int) {
+	if t == nil {
+		return
+	}
+	t.UpstreamStatus = status
+}
+
+// recordEvent 记录一个原始上游事件，累计超过字节上限后丢弃后续事件并标记截断
+func (t *requestTrace) recordEvent(event string) {
+	if t == nil || t.Truncated {
+		return
+	}
+	if t.size+len(event) > t.maxBytes {
+		t.Truncated = true
+		return
+	}
+	t.size += len(event)
+	t.UpstreamEvents = append(t.UpstreamEvents, event)
+}
+
+// write 将追踪写入文件，失败时仅记录日志
+func (t *requestTrace) write() {
+	if t == nil {
+		return
+	}
+	data, err := utils.PrettyMarshal(t)
+	if err != nil {
+		log.Printf("Warning: failed to encode trace for %s: %v", t.RequestID, err)
+		return
+	}
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		log.Printf("Warning: failed to create trace dir %s: %v", t.dir, err)
+		return
+	}
+	path := filepath.Join(t.dir, t.RequestID+".json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		log.Printf("Warning: failed to write trace %s: %v", path, err)
+	}
+}
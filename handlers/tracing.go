@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName 本服务span的instrumentation名称
+const tracerName = "codebuddy2cc"
+
+// InitTracing 配置 OTEL_EXPORTER_OTLP_ENDPOINT 时启用OTLP/HTTP链路追踪，返回退出时调用的flush函数
+// 未配置时保持otel默认的no-op实现，span创建几乎没有开销；其余 OTEL_* 环境变量由SDK按规范读取
+func InitTracing() func(context.Context) error {
+	noop := func(context.Context) error { return nil }
+	if strings.TrimSpace(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")) == "" {
+		return noop
+	}
+
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		log.Printf("Warning: failed to create OTLP trace exporter, tracing disabled: %v", err)
+		return noop
+	}
+
+	// OTEL_SERVICE_NAME / OTEL_RESOURCE_ATTRIBUTES 优先于默认服务名
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", tracerName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		log.Printf("Warning: failed to build trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	log.Printf("OpenTelemetry tracing enabled (OTLP endpoint: %s)", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	return provider.Shutdown
+}
+
+// startSpan 以ctx中的span为父创建子span
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// startRequestSpan 创建请求的根span，父上下文取自客户端请求头（如网关传入的traceparent）
+func startRequestSpan(c *gin.Context, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// endRequestSpan 结束根span，请求记录了错误信息时标记为错误状态
+func endRequestSpan(c *gin.Context, span trace.Span) {
+	if message := c.GetString(errorMessageKey); message != "" {
+		span.SetStatus(codes.Error, message)
+	}
+	span.End()
+}
+
+// withSpanFrom 将src中的当前span附加到dst（dst的取消与超时不受影响）
+func withSpanFrom(dst, src context.Context) context.Context {
+	return trace.ContextWithSpan(dst, trace.SpanFromContext(src))
+}
+
+// injectTraceContext 将ctx中的链路上下文写入上游请求头，覆盖客户端转发来的同名头部
+func injectTraceContext(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"codebuddy2cc/utils"
+)
+
+// 上游连接池默认参数
+const (
+	defaultMaxIdleConns          = 100
+	defaultMaxConnsPerHost       = 50
+	defaultMaxIdleConnsPerHost   = 20
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
+	defaultIdleConnTimeout       = 90 * time.Second
+)
+
+var (
+	// upstreamClient 所有请求共享的上游HTTP客户端，复用连接池；首次使用时按环境变量创建
+	upstreamClient     *http.Client
+	upstreamClientOnce sync.Once
+)
+
+// mockUpstreamClient 启用mock上游时使用的客户端，不发起真实网络请求
+var mockUpstreamClient = &http.Client{Transport: mockUpstreamTransport{}}
+
+// InitUpstreamClient 启动时按环境变量创建共享上游客户端和并发信号量，使配置错误的警告在启动阶段输出
+func InitUpstreamClient() {
+	sharedUpstreamClient()
+	upstreamSemaphore()
+}
+
+// sharedUpstreamClient 返回共享上游客户端，未初始化时创建
+func sharedUpstreamClient() *http.Client {
+	upstreamClientOnce.Do(func() {
+		upstreamClient = newUpstreamClient()
+	})
+	return upstreamClient
+}
+
+// newUpstreamClient 创建上游HTTP客户端，连接池参数可通过环境变量调整
+func newUpstreamClient() *http.Client {
+	tlsConfig := upstreamTLSConfig()
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:       tlsConfig,
+			ForceAttemptHTTP2:     tlsConfig != nil,                                                                 // 自定义TLS配置时保持HTTP/2协商
+			TLSHandshakeTimeout:   envSeconds("CODEBUDDY2CC_TLS_HANDSHAKE_TIMEOUT", defaultTLSHandshakeTimeout),     // TLS握手超时
+			ResponseHeaderTimeout: envSeconds("CODEBUDDY2CC_RESPONSE_HEADER_TIMEOUT", defaultResponseHeaderTimeout), // 响应头超时
+			IdleConnTimeout:       envSeconds("CODEBUDDY2CC_IDLE_CONN_TIMEOUT", defaultIdleConnTimeout),             // 空闲连接超时
+			MaxIdleConns:          envNonNegative("CODEBUDDY2CC_MAX_IDLE_CONNS", defaultMaxIdleConns),               // 🔧 最大空闲连接数，支持并发
+			MaxConnsPerHost:       envNonNegative("CODEBUDDY2CC_MAX_CONNS_PER_HOST", defaultMaxConnsPerHost),        // 🔧 每个主机最大连接数，支持高并发
+			MaxIdleConnsPerHost:   envNonNegative("CODEBUDDY2CC_MAX_IDLE_CONNS_PER_HOST", defaultMaxIdleConnsPerHost),
+			DisableKeepAlives:     false,                   // 确保保持连接活跃
+			DisableCompression:    false,                   // 启用压缩
+			ExpectContinueTimeout: expectContinueTimeout(), // 100-continue超时
+		},
+	}
+}
+
+// upstreamTLSConfig 按环境变量构建上游TLS配置，均未配置时返回nil使用默认配置
+// CODEBUDDY2CC_CA_CERT：额外信任的CA证书（PEM）路径，追加到系统根证书池，适用于私有CA签发证书的自建网关
+// CODEBUDDY2CC_INSECURE_SKIP_VERIFY：跳过上游证书校验，仅用于测试环境
+func upstreamTLSConfig() *tls.Config {
+	caPath := strings.TrimSpace(os.Getenv("CODEBUDDY2CC_CA_CERT"))
+	skipVerify := utils.EnvBool("CODEBUDDY2CC_INSECURE_SKIP_VERIFY")
+	if caPath == "" && !skipVerify {
+		return nil
+	}
+
+	config := &tls.Config{}
+	if caPath != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(caPath)
+		if err != nil {
+			log.Printf("Warning: failed to read CODEBUDDY2CC_CA_CERT %s: %v", caPath, err)
+		} else if !pool.AppendCertsFromPEM(pem) {
+			log.Printf("Warning: no valid PEM certificates found in CODEBUDDY2CC_CA_CERT %s", caPath)
+		} else {
+			config.RootCAs = pool
+			log.Printf("Loaded upstream CA certificates from %s", caPath)
+		}
+	}
+	if skipVerify {
+		config.InsecureSkipVerify = true
+		log.Printf("WARNING: CODEBUDDY2CC_INSECURE_SKIP_VERIFY is enabled, upstream TLS certificates are NOT verified. Do not use this in production!")
+	}
+	return config
+}
+
+// envNonNegative 读取非负整数配置（0表示不限制），负值回退到默认值
+func envNonNegative(key string, defaultValue int) int {
+	value := utils.EnvInt(key, defaultValue)
+	if value < 0 {
+		log.Printf("Warning: invalid %s %d (must be >= 0), using default %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+// envSeconds 读取以秒为单位的超时配置（0表示不限制），负值回退到默认值
+func envSeconds(key string, defaultValue time.Duration) time.Duration {
+	return time.Duration(envNonNegative(key, int(defaultValue/time.Second))) * time.Second
+}
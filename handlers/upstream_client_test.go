@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startIgnoringExpectUpstream 启动不响应 100 Continue 的原始HTTP上游：读完请求体才回复，返回地址与收到的Expect头
+func startIgnoringExpectUpstream(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	expects := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		expects <- req.Header.Get("Expect")
+		io.Copy(io.Discard, req.Body)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+	}()
+	return "http://" + listener.Addr().String(), expects
+}
+
+func TestExpectContinueAgainstUpstreamIgnoringIt(t *testing.T) {
+	tests := []struct {
+		name       string
+		disabled   string
+		wantExpect string
+		slow       bool // 未禁用时需等待ExpectContinueTimeout才发送请求体
+	}{
+		{name: "disabled strips the header", disabled: "1", wantExpect: ""},
+		{name: "enabled waits for the timeout", disabled: "", wantExpect: "100-continue", slow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CODEBUDDY2CC_DISABLE_EXPECT_CONTINUE", tt.disabled)
+			t.Setenv("CODEBUDDY2CC_FORWARD_HEADERS", "*")
+			targetURL, expects := startIgnoringExpectUpstream(t)
+
+			c, _ := newTestContext(http.MethodPost, "/v1/messages", "{}")
+			c.Request.Header.Set("Expect", "100-continue")
+			upstreamReq, err := newUpstreamRequest(c.Request.Context(), c, targetURL, bytes.Repeat([]byte("x"), 4096), "test-key")
+			if err != nil {
+				t.Fatalf("newUpstreamRequest: %v", err)
+			}
+
+			client := newUpstreamClient()
+			defer client.CloseIdleConnections()
+			start := time.Now()
+			resp, err := client.Do(upstreamReq)
+			if err != nil {
+				t.Fatalf("upstream request: %v", err)
+			}
+			resp.Body.Close()
+			elapsed := time.Since(start)
+
+			if got := <-expects; got != tt.wantExpect {
+				t.Fatalf("upstream Expect header = %q, want %q", got, tt.wantExpect)
+			}
+			if stalled := elapsed >= 500*time.Millisecond; stalled != tt.slow {
+				t.Fatalf("request took %s, want stalled = %v", elapsed, tt.slow)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+)
+
+var (
+	// upstreamSlots 限制同时进行的上游请求数的信号量，nil表示不限制；首次使用时按环境变量创建
+	upstreamSlots     chan struct{}
+	upstreamSlotsOnce sync.Once
+)
+
+// upstreamSemaphore 返回上游并发信号量，CODEBUDDY2CC_MAX_CONCURRENCY 为0或未设置时返回nil
+func upstreamSemaphore() chan struct{} {
+	upstreamSlotsOnce.Do(func() {
+		if limit := envNonNegative("CODEBUDDY2CC_MAX_CONCURRENCY", 0); limit > 0 {
+			upstreamSlots = make(chan struct{}, limit)
+		}
+	})
+	return upstreamSlots
+}
+
+// acquireUpstreamSlot 占用一个上游并发名额，名额已满时阻塞至请求ctx超时或客户端断开
+// 成功时返回释放函数（必须调用），未获得名额时返回false
+func acquireUpstreamSlot(ctx, clientCtx context.Context) (func(), bool) {
+	slots := upstreamSemaphore()
+	if slots == nil {
+		return func() {}, true
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	case <-ctx.Done():
+		return nil, false
+	case <-clientCtx.Done():
+		return nil, false
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"codebuddy2cc/handlers"
 	"codebuddy2cc/middleware"
@@ -15,14 +17,17 @@ import (
 )
 
 func main() {
-	if err := godotenv.Load(); err != nil {
+	loadEnvErr := godotenv.Load()
+	// 初始化日志格式（需在其他日志输出前完成）
+	utils.InitLogFormat()
+	if loadEnvErr != nil {
 		log.Printf("Warning: .env file not found")
 	}
 
 	authToken := os.Getenv("CODEBUDDY2CC_AUTH")
 
-	if authToken == "" {
-		log.Fatal("CODEBUDDY2CC_AUTH environment variable is required")
+	if authToken == "" && os.Getenv("CODEBUDDY2CC_JWT_SECRET") == "" {
+		log.Fatal("CODEBUDDY2CC_AUTH or CODEBUDDY2CC_JWT_SECRET environment variable is required")
 	}
 	// 初始化debug模式
 	utils.InitDebugMode()
@@ -31,12 +36,30 @@ func main() {
 	if err := utils.LoadModelMapping(); err != nil {
 		log.Printf("Warning: Failed to load model mapping: %v", err)
 	}
-
-	// 验证上游API密钥
-	upstreamKey := os.Getenv("CODEBUDDY2CC_KEY")
-	if upstreamKey == "" {
+	// 轮询热加载model.json（容器环境无法发送SIGHUP时使用）
+	utils.StartModelMappingWatcher(time.Duration(utils.EnvInt("CODEBUDDY2CC_MODEL_RELOAD_INTERVAL", 5)) * time.Second)
+
+	// 初始化流式分块大小
+	handlers.InitStreamChunkSize()
+	// 初始化请求超时时间
+	handlers.InitRequestTimeout()
+	// 初始化共享上游HTTP客户端（连接池）
+	handlers.InitUpstreamClient()
+	// 配置 OTEL_EXPORTER_OTLP_ENDPOINT 时启用链路追踪
+	shutdownTracing := handlers.InitTracing()
+
+	// 验证上游API密钥（支持逗号分隔的多个密钥轮询）
+	upstreamKeys := utils.UpstreamKeys()
+	if len(upstreamKeys) == 0 {
 		log.Fatal("CODEBUDDY2CC_KEY environment variable is required")
 	}
+	if len(upstreamKeys) > 1 {
+		log.Printf("Loaded %d upstream API keys (round-robin)", len(upstreamKeys))
+	}
+
+	if utils.EnvBool("CODEBUDDY2CC_MOCK_UPSTREAM") {
+		log.Printf("WARNING: Mock upstream mode ENABLED, requests will not reach the real upstream")
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -44,14 +67,21 @@ func main() {
 	}
 
 	router := gin.New()
-	router.Use(gin.Logger())
+	router.Use(middleware.LoggerMiddleware())
 	router.Use(gin.Recovery())
+	router.Use(middleware.WriteGuardMiddleware())
 
 	v1 := router.Group("/v1")
+	v1.Use(middleware.RateLimitMiddleware())
 	v1.Use(middleware.AuthMiddleware())
 	{
 		v1.POST("/messages", handlers.MessagesHandler)
+		v1.POST("/complete", handlers.CompleteHandler)
+		v1.GET("/messages/ws", handlers.MessagesWSHandler)
 		v1.GET("/models", handlers.ModelsHandler)
+		v1.GET("/models/:id", handlers.ModelHandler)
+		// 调试用：仅转换请求不调用上游（DEBUG关闭时返回404）
+		v1.POST("/debug/convert", handlers.DebugConvertHandler)
 	}
 
 	router.GET("/health", func(c *gin.Context) {
@@ -63,15 +93,25 @@ func main() {
 		}
 
 		// 简化的密钥验证
-		if os.Getenv("CODEBUDDY2CC_KEY") != "" {
+		if len(utils.UpstreamKeys()) > 0 {
 			healthData["upstream_key"] = "configured"
 		} else {
 			healthData["upstream_key"] = "missing"
 		}
 
+		// 深度检查：探测上游可达性（结果短时间缓存）
+		if c.Query("deep") == "1" {
+			upstream := handlers.CheckUpstreamHealth(c.Request.Context())
+			healthData["upstream_reachable"] = upstream.Reachable
+			healthData["upstream_latency_ms"] = upstream.Latency.Milliseconds()
+		}
+
 		c.JSON(200, healthData)
 	})
 
+	// Prometheus指标端点（与/health一致无需认证，便于监控系统抓取）
+	router.GET("/metrics", handlers.MetricsHandler)
+
 	// 服务信息端点（用于macOS服务监控）
 	router.GET("/service/info", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -84,6 +124,11 @@ func main() {
 		})
 	})
 
+	// 运行统计端点（进行中请求数、累计请求/工具调用/SSE验证错误数，用于容量规划）
+	router.GET("/service/stats", handlers.ServiceStatsHandler)
+	// model.json校验端点（需认证）
+	router.GET("/service/config-check", middleware.AuthMiddleware(), handlers.ConfigCheckHandler)
+
 	// 优雅的信号处理，支持macOS LaunchAgent服务模式
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
@@ -107,6 +152,10 @@ func main() {
 			log.Printf("Configuration reloaded successfully")
 			return // 不退出，继续运行
 		case syscall.SIGINT, syscall.SIGTERM:
+			// 退出前导出缓冲中的span
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			shutdownTracing(shutdownCtx)
+			cancel()
 			log.Printf("Graceful shutdown completed")
 			os.Exit(0)
 		}
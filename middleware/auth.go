@@ -4,22 +4,28 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
+
+	"codebuddy2cc/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
+// AuthMiddleware 校验客户端令牌：配置 CODEBUDDY2CC_JWT_SECRET 时接受HMAC签名的JWT，
+// 其余令牌（X-API-Key或非JWT的Bearer令牌）按 CODEBUDDY2CC_AUTH 静态token校验
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		apiKey := c.GetHeader("X-API-Key")
 		expectedToken := os.Getenv("CODEBUDDY2CC_AUTH")
+		secret := jwtSecret()
 
-		if expectedToken == "" {
+		if expectedToken == "" && secret == "" {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server configuration error"})
 			c.Abort()
 			return
 		}
 
-		if apiKey != "" && apiKey == expectedToken {
+		if apiKey != "" && expectedToken != "" && apiKey == expectedToken {
 			c.Next()
 			return
 		}
@@ -39,7 +45,20 @@ func AuthMiddleware() gin.HandlerFunc {
 
 		token := strings.TrimPrefix(authHeader, "Bearer ")
 
-		if token != expectedToken {
+		if secret != "" && looksLikeJWT(token) {
+			claims, err := parseJWT(token, secret, time.Now())
+			if err != nil {
+				utils.DebugLog("JWT validation failed: %v", err)
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+				c.Abort()
+				return
+			}
+			setAuthClaims(c, claims)
+			c.Next()
+			return
+		}
+
+		if expectedToken == "" || token != expectedToken {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+	"time"
+
+	"codebuddy2cc/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jwtClockSkew 校验exp/nbf时允许的时钟偏差
+const jwtClockSkew = 30 * time.Second
+
+// jwtHashes 支持的HMAC签名算法
+var jwtHashes = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// jwtSecret 读取JWT签名密钥，未配置时不启用JWT认证
+func jwtSecret() string {
+	return os.Getenv("CODEBUDDY2CC_JWT_SECRET")
+}
+
+// looksLikeJWT 判断Bearer令牌是否为JWT格式（header.payload.signature），其余令牌按静态token校验
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// parseJWT 校验HMAC签名与有效期，返回JWT的claims
+func parseJWT(token, secret string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	}
+	newHash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid signature encoding")
+	}
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("signature mismatch")
+	}
+
+	var claims map[string]any
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid payload: %v", err)
+	}
+
+	// exp/nbf为可选的NumericDate（秒），存在时必须有效
+	if exp, ok := claims["exp"]; ok {
+		expiry, ok := exp.(float64)
+		if !ok {
+			return nil, errors.New("invalid exp claim")
+		}
+		if now.After(time.Unix(int64(expiry), 0).Add(jwtClockSkew)) {
+			return nil, errors.New("token expired")
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		notBefore, ok := nbf.(float64)
+		if !ok {
+			return nil, errors.New("invalid nbf claim")
+		}
+		if now.Add(jwtClockSkew).Before(time.Unix(int64(notBefore), 0)) {
+			return nil, errors.New("token not yet valid")
+		}
+	}
+	return claims, nil
+}
+
+// decodeJWTSegment 解码base64url编码的JSON段
+func decodeJWTSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return utils.FastUnmarshal(data, v)
+}
+
+// jwtSubject 返回claims中的sub，不存在时返回空字符串
+func jwtSubject(claims map[string]any) string {
+	sub, _ := claims["sub"].(string)
+	return sub
+}
+
+// setAuthClaims 将已验证的claims写入gin上下文，供日志与限流等下游使用
+func setAuthClaims(c *gin.Context, claims map[string]any) {
+	c.Set(utils.AuthClaimsKey, claims)
+	if sub := jwtSubject(claims); sub != "" {
+		c.Set(utils.AuthSubjectKey, sub)
+	}
+}
+
+// verifiedJWTSubject 请求携带有效JWT时返回其sub，用于认证之前执行的限流中间件
+func verifiedJWTSubject(c *gin.Context) string {
+	secret := jwtSecret()
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if secret == "" || !ok || !looksLikeJWT(token) {
+		return ""
+	}
+	claims, err := parseJWT(token, secret, time.Now())
+	if err != nil {
+		return ""
+	}
+	return jwtSubject(claims)
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"time"
+
+	"codebuddy2cc/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LoggerMiddleware 请求访问日志中间件
+// 默认使用gin的文本访问日志；CODEBUDDY2CC_LOG_FORMAT=json 时每个请求完成后输出一行JSON，并携带请求ID便于与调试日志关联
+func LoggerMiddleware() gin.HandlerFunc {
+	if !utils.IsJSONLogFormat() {
+		return gin.Logger()
+	}
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+		if raw := c.Request.URL.RawQuery; raw != "" {
+			path += "?" + raw
+		}
+
+		c.Next()
+
+		fields := map[string]any{
+			"method":     c.Request.Method,
+			"path":       path,
+			"status":     c.Writer.Status(),
+			"latency_ms": time.Since(start).Milliseconds(),
+			"client_ip":  c.ClientIP(),
+			"bytes":      c.Writer.Size(),
+		}
+		if userID := c.GetString(utils.UserIDKey); userID != "" {
+			fields["user_id"] = userID
+		}
+		if subject := c.GetString(utils.AuthSubjectKey); subject != "" {
+			fields["subject"] = subject
+		}
+		if len(c.Errors) > 0 {
+			fields["errors"] = c.Errors.String()
+		}
+		utils.LogJSON("info", c.GetString(utils.RequestIDKey), "request completed", fields)
+	}
+}
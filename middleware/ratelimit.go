@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"codebuddy2cc/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// bucketIdleTTL 空闲超过该时长的令牌桶会被回收
+	bucketIdleTTL = 10 * time.Minute
+	// bucketSweepInterval 回收空闲令牌桶的最小间隔
+	bucketSweepInterval = time.Minute
+)
+
+// tokenBucket 单个限流键（客户端IP或用户）的令牌桶
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// ipRateLimiter 按限流键（客户端IP或用户）限流的令牌桶集合
+type ipRateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // 每秒补充的令牌数
+	burst     float64 // 桶容量
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// allow 在keys对应的每个令牌桶中各消耗一个令牌，任一桶令牌不足时均不消耗，并返回需要等待的最长时长
+func (l *ipRateLimiter) allow(now time.Time, keys ...string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	var wait time.Duration
+	buckets := make([]*tokenBucket, 0, len(keys))
+	for _, key := range keys {
+		bucket, ok := l.buckets[key]
+		if !ok {
+			bucket = &tokenBucket{tokens: l.burst, lastSeen: now}
+			l.buckets[key] = bucket
+		} else {
+			elapsed := now.Sub(bucket.lastSeen).Seconds()
+			bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+			bucket.lastSeen = now
+		}
+		if bucket.tokens < 1 {
+			wait = max(wait, time.Duration((1-bucket.tokens)/l.rate*float64(time.Second)))
+		}
+		buckets = append(buckets, bucket)
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true, 0
+}
+
+// sweep 回收长时间空闲的令牌桶，避免IP数量增长导致内存无限增长（调用方持有锁）
+func (l *ipRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for ip, bucket := range l.buckets {
+		if now.Sub(bucket.lastSeen) > bucketIdleTTL {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// rateLimitConfig 读取限流配置：CODEBUDDY2CC_RATE 为每秒请求数（支持小数），CODEBUDDY2CC_BURST 为突发容量
+func rateLimitConfig() (rate float64, burst int) {
+	v := strings.TrimSpace(os.Getenv("CODEBUDDY2CC_RATE"))
+	if v == "" {
+		return 0, 0
+	}
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate <= 0 {
+		utils.DebugLog("Invalid CODEBUDDY2CC_RATE %q, rate limiting disabled", v)
+		return 0, 0
+	}
+
+	burst = utils.EnvInt("CODEBUDDY2CC_BURST", int(math.Ceil(rate)))
+	if burst < 1 {
+		burst = 1
+	}
+	return rate, burst
+}
+
+// rateLimitKeys 限流键：启用 CODEBUDDY2CC_RATE_LIMIT_BY_USER 时，已验证JWT的sub单独作为限流键；
+// 未认证的metadata.user_id可由客户端任意填写，只作为客户端IP之外的附加限流键，IP令牌桶始终生效
+func rateLimitKeys(c *gin.Context, byUser bool) []string {
+	if !byUser {
+		return []string{c.ClientIP()}
+	}
+	if subject := verifiedJWTSubject(c); subject != "" {
+		return []string{"sub:" + subject}
+	}
+	keys := []string{c.ClientIP()}
+	if userID := requestUserID(c); userID != "" {
+		keys = append(keys, "user:"+userID)
+	}
+	return keys
+}
+
+// requestUserID 读取JSON请求体中的metadata.user_id，读取后恢复请求体供处理器绑定
+func requestUserID(c *gin.Context) string {
+	if c.Request.Body == nil || c.Request.Method != http.MethodPost {
+		return ""
+	}
+	// 超过请求体上限时不读取完整内容，按IP限流，由处理器返回413
+	limit := utils.MaxRequestBodyBytes()
+	if limit > 0 && c.Request.ContentLength > limit {
+		return ""
+	}
+	reader := io.Reader(c.Request.Body)
+	if limit > 0 {
+		reader = io.LimitReader(c.Request.Body, limit+1)
+	}
+	body, err := io.ReadAll(reader)
+	c.Request.Body = readCloser{io.MultiReader(bytes.NewReader(body), c.Request.Body), c.Request.Body}
+	if err != nil || (limit > 0 && int64(len(body)) > limit) {
+		return ""
+	}
+
+	var payload struct {
+		Metadata *struct {
+			UserID string `json:"user_id"`
+		} `json:"metadata"`
+	}
+	if utils.FastUnmarshal(body, &payload) != nil || payload.Metadata == nil {
+		return ""
+	}
+	return strings.TrimSpace(payload.Metadata.UserID)
+}
+
+// readCloser 将已读取的请求体前缀与剩余部分拼接，关闭时关闭原始请求体
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// RateLimitMiddleware 按客户端IP（或可选的已认证用户、metadata.user_id）进行令牌桶限流，未配置 CODEBUDDY2CC_RATE 时不做限制
+// 超出限制时返回429、Anthropic格式的rate_limit_error以及Retry-After头
+func RateLimitMiddleware() gin.HandlerFunc {
+	rate, burst := rateLimitConfig()
+	if rate <= 0 {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+
+	limiter := &ipRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+	byUser := utils.EnvBool("CODEBUDDY2CC_RATE_LIMIT_BY_USER")
+
+	return func(c *gin.Context) {
+		allowed, wait := limiter.allow(time.Now(), rateLimitKeys(c, byUser)...)
+		if allowed {
+			c.Next()
+			return
+		}
+
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"type": "error",
+			"error": gin.H{
+				"type":    "rate_limit_error",
+				"message": fmt.Sprintf("Rate limit exceeded, retry after %d seconds", retryAfter),
+			},
+		})
+		c.Abort()
+	}
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// signJWT 用HS256签发只包含sub的测试JWT
+func signJWT(secret, subject string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	unsigned := encode([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encode([]byte(`{"sub":"`+subject+`"}`))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + encode(mac.Sum(nil))
+}
+
+// newRateLimitedRouter 构造挂载限流中间件的路由，令牌几乎不补充
+func newRateLimitedRouter(t *testing.T, burst string) *gin.Engine {
+	t.Helper()
+	t.Setenv("CODEBUDDY2CC_RATE", "0.001")
+	t.Setenv("CODEBUDDY2CC_BURST", burst)
+	t.Setenv("CODEBUDDY2CC_RATE_LIMIT_BY_USER", "1")
+	t.Setenv("CODEBUDDY2CC_JWT_SECRET", "test-secret")
+
+	router := gin.New()
+	router.POST("/v1/messages", RateLimitMiddleware(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	return router
+}
+
+// sendRequest 从给定IP发送请求，返回状态码
+func sendRequest(router *gin.Engine, ip, userID, bearer string) int {
+	body := `{"model":"m","messages":[],"metadata":{"user_id":"` + userID + `"}}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	req.RemoteAddr = ip + ":40000"
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func TestRateLimitByUserKeepsIPFloor(t *testing.T) {
+	const ip, otherIP = "203.0.113.7", "203.0.113.8"
+
+	t.Run("rotating user_id is still limited by IP", func(t *testing.T) {
+		router := newRateLimitedRouter(t, "2")
+		for i, userID := range []string{"user-a", "user-b"} {
+			if code := sendRequest(router, ip, userID, ""); code != http.StatusOK {
+				t.Fatalf("request %d status = %d, want 200", i, code)
+			}
+		}
+		if code := sendRequest(router, ip, "user-c", ""); code != http.StatusTooManyRequests {
+			t.Fatalf("rotated user_id status = %d, want 429", code)
+		}
+	})
+
+	t.Run("user_id is limited across IPs", func(t *testing.T) {
+		router := newRateLimitedRouter(t, "1")
+		if code := sendRequest(router, ip, "user-a", ""); code != http.StatusOK {
+			t.Fatalf("first request status = %d, want 200", code)
+		}
+		if code := sendRequest(router, otherIP, "user-a", ""); code != http.StatusTooManyRequests {
+			t.Fatalf("same user_id from another IP status = %d, want 429", code)
+		}
+		// 被拒绝的请求不消耗其他IP的令牌
+		if code := sendRequest(router, otherIP, "user-b", ""); code != http.StatusOK {
+			t.Fatalf("other user from other IP status = %d, want 200", code)
+		}
+	})
+
+	t.Run("verified JWT subjects have their own buckets", func(t *testing.T) {
+		router := newRateLimitedRouter(t, "2")
+		for i := range 2 {
+			if code := sendRequest(router, ip, "", ""); code != http.StatusOK {
+				t.Fatalf("anonymous request %d status = %d, want 200", i, code)
+			}
+		}
+		for _, subject := range []string{"alice", "bob"} {
+			if code := sendRequest(router, ip, "", signJWT("test-secret", subject)); code != http.StatusOK {
+				t.Fatalf("%s status = %d, want 200 despite exhausted IP bucket", subject, code)
+			}
+		}
+		if code := sendRequest(router, ip, "", signJWT("wrong-secret", "mallory")); code != http.StatusTooManyRequests {
+			t.Fatalf("forged JWT status = %d, want 429", code)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"log"
+	"sync"
+
+	"codebuddy2cc/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeGuardKey gin上下文中保存写入守卫的键
+const writeGuardKey = "codebuddy2cc_write_guard"
+
+// guardedWriter 记录首次写入客户端失败的错误，之后的写入直接返回该错误，不再写入已断开的连接
+type guardedWriter struct {
+	gin.ResponseWriter
+	c       *gin.Context
+	err     error
+	aborted chan struct{}
+	once    sync.Once
+}
+
+func (w *guardedWriter) Write(data []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.ResponseWriter.Write(data)
+	if err != nil {
+		w.fail(err)
+	}
+	return n, err
+}
+
+func (w *guardedWriter) WriteString(s string) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.ResponseWriter.WriteString(s)
+	if err != nil {
+		w.fail(err)
+	}
+	return n, err
+}
+
+// fail 记录首个写入错误，仅输出一次日志并通知处理器中止
+func (w *guardedWriter) fail(err error) {
+	w.once.Do(func() {
+		w.err = err
+		log.Printf("[Request:%s] Client write failed, aborting response: %v", w.c.GetString(utils.RequestIDKey), err)
+		close(w.aborted)
+	})
+}
+
+// WriteGuardMiddleware 捕获写入客户端的错误（客户端断开等），首次失败后停止写入并通过 WriteAborted 通知处理器
+func WriteGuardMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		GuardWriter(c)
+		c.Next()
+	}
+}
+
+// GuardWriter 以写入守卫包装当前c.Writer，供替换了c.Writer的处理器（如WebSocket传输）重新启用守卫
+func GuardWriter(c *gin.Context) {
+	w := &guardedWriter{ResponseWriter: c.Writer, c: c, aborted: make(chan struct{})}
+	c.Writer = w
+	c.Set(writeGuardKey, w)
+}
+
+// WriteAborted 返回写入客户端失败时关闭的通道；未启用 WriteGuardMiddleware 时返回nil（永不就绪）
+func WriteAborted(c *gin.Context) <-chan struct{} {
+	if w, ok := c.Get(writeGuardKey); ok {
+		return w.(*guardedWriter).aborted
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// failingWriter 前ok次写入成功，之后的写入均返回错误，模拟客户端中途断开
+type failingWriter struct {
+	gin.ResponseWriter
+	ok     int
+	writes int
+}
+
+func (w *failingWriter) Write(data []byte) (int, error) {
+	w.writes++
+	if w.writes > w.ok {
+		return 0, errors.New("broken pipe")
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *failingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func TestWriteGuardAbortsStreamOnWriteFailure(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	failing := &failingWriter{ResponseWriter: c.Writer, ok: 2}
+	c.Writer = failing
+
+	var events int
+	WriteGuardMiddleware()(c)
+	aborted := WriteAborted(c)
+	if aborted == nil {
+		t.Fatal("WriteAborted returned nil with the guard installed")
+	}
+
+	// 模拟处理器的流式循环：每轮写一个事件，写入失败后经WriteAborted退出
+loop:
+	for events < 100 {
+		select {
+		case <-aborted:
+			break loop
+		default:
+		}
+		events++
+		c.Writer.WriteString("event: ping\ndata: {}\n\n")
+	}
+
+	if events != 3 {
+		t.Fatalf("stream loop wrote %d events, want it to stop after the first failure (3)", events)
+	}
+	if _, err := c.Writer.WriteString("late"); err == nil {
+		t.Fatal("write after failure succeeded")
+	}
+	if failing.writes != 3 {
+		t.Fatalf("underlying writer saw %d writes, want no writes after the failure", failing.writes)
+	}
+}
+
+func TestWriteAbortedWithoutGuard(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	if WriteAborted(c) != nil {
+		t.Fatal("WriteAborted without the guard should return nil")
+	}
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EnvInt 读取整数类型的环境变量，未设置或格式非法时返回默认值
+func EnvInt(key string, defaultValue int) int {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		DebugLog("Invalid integer for %s: %q, using default %d", key, v, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// EnvBool 读取布尔类型的环境变量，true/1/on/yes 视为启用
+func EnvBool(key string) bool {
+	v := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+	return v == "true" || v == "1" || v == "on" || v == "yes"
+}
+
+// UpstreamKeys 读取上游API密钥列表
+// 优先使用 CODEBUDDY2CC_KEYS，其次 CODEBUDDY2CC_KEY，均支持逗号分隔多个密钥
+func UpstreamKeys() []string {
+	raw := os.Getenv("CODEBUDDY2CC_KEYS")
+	if strings.TrimSpace(raw) == "" {
+		raw = os.Getenv("CODEBUDDY2CC_KEY")
+	}
+
+	var keys []string
+	for key := range strings.SplitSeq(raw, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// defaultMaxRequestBodyBytes 请求体默认大小上限（10MB）
+const defaultMaxRequestBodyBytes = 10 << 20
+
+// MaxRequestBodyBytes 请求体大小上限，由 CODEBUDDY2CC_MAX_BODY_BYTES 配置，0或负数表示不限制
+func MaxRequestBodyBytes() int64 {
+	return int64(EnvInt("CODEBUDDY2CC_MAX_BODY_BYTES", defaultMaxRequestBodyBytes))
+}
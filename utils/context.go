@@ -0,0 +1,20 @@
+package utils
+
+import "context"
+
+// requestIDKey context中保存请求ID的键类型，避免与其他包的键冲突
+type requestIDKey struct{}
+
+// WithRequestID 返回携带请求ID的context
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext 从context中读取请求ID，不存在时返回空字符串
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
@@ -1,11 +1,15 @@
 package utils
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"os"
 	"slices"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // 🎯 移除工具ID映射机制 - 直接透传简化架构
@@ -13,11 +17,67 @@ import (
 type AnthropicRequest struct {
 	Model       string           `json:"model"`
 	Messages    []Message        `json:"messages"`
+	System      any              `json:"system,omitempty"` // 顶层system提示词：字符串或文本内容块数组（Anthropic官方格式）
 	Tools       []Tool           `json:"tools,omitempty"`
 	Temperature *float64         `json:"temperature,omitempty"`
+	TopP        *float64         `json:"top_p,omitempty"`
+	TopK        *int             `json:"top_k,omitempty"`
 	MaxTokens   *int             `json:"max_tokens,omitempty"`
 	Stream      bool             `json:"stream,omitempty"`
 	Metadata    *RequestMetadata `json:"metadata,omitempty"` // 🔧 新增：支持metadata
+	// StopSequences 自定义停止序列，转发为OpenAI的stop字段
+	StopSequences []string `json:"stop_sequences,omitempty"`
+	// N 非Anthropic标准字段（沿用OpenAI习惯的客户端会传入），不支持多个候选，大于1时拒绝请求
+	N *int `json:"n,omitempty"`
+	// ToolChoice 工具选择配置，type映射为OpenAI的tool_choice，disable_parallel_tool_use 映射为OpenAI的parallel_tool_calls
+	ToolChoice *ToolChoice `json:"tool_choice,omitempty"`
+
+	// SystemSuffix 覆盖注入到system消息末尾的后缀，nil表示使用配置的后缀，空字符串表示不注入
+	SystemSuffix *string `json:"-"`
+}
+
+// DefaultSystemSuffix 默认注入到system消息末尾的CodeBuddy指令
+const DefaultSystemSuffix = "You are CodeBuddy Code, Tencent's official CLI for CodeBuddy."
+
+// configuredSystemSuffix 返回 CODEBUDDY2CC_SYSTEM_SUFFIX 配置的system后缀
+// 未设置时使用默认后缀，设置为空字符串表示不注入
+func configuredSystemSuffix() string {
+	if suffix, ok := os.LookupEnv("CODEBUDDY2CC_SYSTEM_SUFFIX"); ok {
+		return strings.TrimSpace(suffix)
+	}
+	return DefaultSystemSuffix
+}
+
+// ToolChoice Anthropic工具选择配置
+type ToolChoice struct {
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse *bool  `json:"disable_parallel_tool_use,omitempty"`
+}
+
+// openAIToolChoice 将Anthropic tool_choice转换为OpenAI格式，未设置或无法识别时返回nil（不转发）
+// auto→"auto"，any→"required"，none→"none"，tool→{"type":"function","function":{"name":"x"}}
+func openAIToolChoice(ctx context.Context, tc *ToolChoice) any {
+	if tc == nil {
+		return nil
+	}
+	switch tc.Type {
+	case "auto":
+		return "auto"
+	case "any":
+		return "required"
+	case "none":
+		return "none"
+	case "tool":
+		if tc.Name != "" {
+			return map[string]any{
+				"type":     "function",
+				"function": map[string]any{"name": tc.Name},
+			}
+		}
+	}
+	DebugLogCtx(ctx, "Ignoring unsupported tool_choice: %+v", *tc)
+	return nil
 }
 
 // RequestMetadata 请求元数据，用于session追踪和调试
@@ -34,9 +94,12 @@ type Message struct {
 }
 
 type ContentBlock struct {
-	Type     string    `json:"type"`
-	Text     string    `json:"text,omitempty"`
-	ImageURL *ImageURL `json:"image_url,omitempty"`
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	Thinking string `json:"thinking,omitempty"` // thinking块的推理内容
+	// Signature thinking块的签名，客户端回传thinking块时需要原样携带
+	Signature string    `json:"signature,omitempty"`
+	ImageURL  *ImageURL `json:"image_url,omitempty"`
 	// 工具调用支持
 	ID   string `json:"id,omitempty"`
 	Name string `json:"name,omitempty"`
@@ -46,6 +109,28 @@ type ContentBlock struct {
 	ToolUseID string `json:"tool_use_id,omitempty"`
 	Content   any    `json:"content,omitempty"`
 	IsError   *bool  `json:"is_error,omitempty"`
+	// 提示词缓存标记，原样转发给上游以启用prompt caching
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+}
+
+// CacheControl 内容块的提示词缓存标记，如 {"type":"ephemeral"}
+type CacheControl struct {
+	Type string `json:"type"`
+	TTL  string `json:"ttl,omitempty"`
+}
+
+// parseCacheControl 解析内容块中的cache_control字段，缺失或格式非法时返回nil
+func parseCacheControl(v any) *CacheControl {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil
+	}
+	cacheType, _ := m["type"].(string)
+	if cacheType == "" {
+		return nil
+	}
+	ttl, _ := m["ttl"].(string)
+	return &CacheControl{Type: cacheType, TTL: ttl}
 }
 
 // MarshalJSON 自定义JSON序列化，确保文本块包含text字段
@@ -61,6 +146,17 @@ func (cb ContentBlock) MarshalJSON() ([]byte, error) {
 			Alias: Alias(cb),
 			Text:  cb.Text,
 		})
+	case "thinking":
+		// thinking块必须包含thinking与signature字段，上游未提供签名时为空字符串
+		return FastMarshal(struct {
+			Alias
+			Thinking  string `json:"thinking"`
+			Signature string `json:"signature"`
+		}{
+			Alias:     Alias(cb),
+			Thinking:  cb.Thinking,
+			Signature: cb.Signature,
+		})
 	default:
 		return FastMarshal(Alias(cb))
 	}
@@ -79,10 +175,17 @@ type Tool struct {
 type OpenAIRequest struct {
 	Model       string          `json:"model"`
 	Messages    []OpenAIMessage `json:"messages"`
-	Tools       []OpenAITool    `json:"tools,omitempty"`
+	Tools       []OpenAITool    `json:"tools,omitempty"` // 无工具时（null或[]）整个字段省略，部分上游对"tools":[]的处理与未传不同
 	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
+	TopK        *int            `json:"top_k,omitempty"` // 非OpenAI标准字段，兼容上游支持时生效
 	MaxTokens   *int            `json:"max_tokens,omitempty"`
 	Stream      bool            `json:"stream,omitempty"`
+	Stop        []string        `json:"stop,omitempty"`
+	// ParallelToolCalls 是否允许并行工具调用，nil表示使用上游默认值
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+	// ToolChoice "auto"/"required"/"none" 或 {"type":"function","function":{"name":"x"}}，nil表示使用上游默认值
+	ToolChoice any `json:"tool_choice,omitempty"`
 }
 
 type OpenAIMessage struct {
@@ -91,6 +194,10 @@ type OpenAIMessage struct {
 	Agent      string           `json:"agent,omitempty"`
 	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
 	ToolCallID string           `json:"tool_call_id,omitempty"`
+	// ReasoningContent 部分上游模型单独返回的推理内容，仅用于解析响应
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+	// ReasoningSignature 上游为推理内容返回的签名，转发为thinking块的signature
+	ReasoningSignature string `json:"reasoning_signature,omitempty"`
 }
 
 type OpenAITool struct {
@@ -131,6 +238,8 @@ type OpenAIChoice struct {
 	Message      *OpenAIMessage `json:"message,omitempty"`
 	Delta        *OpenAIMessage `json:"delta,omitempty"`
 	FinishReason *string        `json:"finish_reason,omitempty"`
+	// StopReason 部分上游（如vLLM）在finish_reason为stop时返回命中的停止序列（字符串）或停止token（数字）
+	StopReason any `json:"stop_reason,omitempty"`
 }
 
 type Usage struct {
@@ -148,6 +257,20 @@ type Usage struct {
 	PromptCacheMissTokens int `json:"prompt_cache_miss_tokens,omitempty"`
 }
 
+// UnmarshalJSON 以json.Number解码usage后经ParseUsageFromResponse统一映射字段
+// 大整数保持精度，浮点或字符串形式的计数也能解析，不会因单个字段类型不符导致整个chunk解码失败
+func (u *Usage) UnmarshalJSON(data []byte) error {
+	var raw map[string]any
+	if err := FastUnmarshalUseNumber(data, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		return nil
+	}
+	*u = *ParseUsageFromResponse(raw)
+	return nil
+}
+
 type AnthropicResponse struct {
 	ID           string         `json:"id"`
 	Type         string         `json:"type"`
@@ -190,7 +313,7 @@ func sanitizeContentBlocks(blocks []ContentBlock) []ContentBlock {
 }
 
 // ConvertAnthropicToOpenAI 转换Anthropic请求为OpenAI格式
-func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
+func ConvertAnthropicToOpenAI(ctx context.Context, req *AnthropicRequest) (*OpenAIRequest, error) {
 	// // Debug: 输出工具转换信息
 	// if len(req.Tools) > 0 {
 	// 	DebugLog("Converting %d tools from Anthropic to OpenAI format", len(req.Tools))
@@ -211,32 +334,25 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 		Model:       mappedModel,
 		Messages:    make([]OpenAIMessage, 0, len(req.Messages)+1),
 		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		TopK:        req.TopK,
 		MaxTokens:   req.MaxTokens,
 		Stream:      req.Stream,
+		Stop:        req.StopSequences,
 	}
 
-	// 提取并保留原始system消息内容
-	var originalSystemContent string
+	// 提取并保留原始system内容：顶层system字段在前，其后合并messages中role为system的消息
+	originalSystemContent := systemContentText(req.System)
 	var otherMessages []Message
 
 	for _, msg := range req.Messages {
 		if msg.Role == "system" {
 			// 合并所有system消息
-			if content, ok := msg.Content.(string); ok {
-				originalSystemContent += content + "\n\n"
-			} else if contentBlocks, ok := msg.Content.([]any); ok {
-				for _, block := range contentBlocks {
-					if blockMap, ok := block.(map[string]any); ok {
-						if text, exists := blockMap["text"].(string); exists {
-							originalSystemContent += text + "\n\n"
-						}
-					}
-				}
-			}
+			originalSystemContent += systemContentText(msg.Content)
 		} else {
 			// 🔧 新增：过滤空内容的用户消息，但保留工具调用结果消息
 			if msg.Role == "user" && isContentEmpty(msg.Content) && msg.ToolCallID == "" && !hasToolResult(msg.Content) {
-				DebugLog("Filtering empty user message")
+				DebugLogCtx(ctx, "Filtering empty user message")
 				continue // 跳过空内容且没有tool_call_id且没有tool_result的用户消息
 			}
 			otherMessages = append(otherMessages, msg)
@@ -244,20 +360,38 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 	}
 
 	// 构建增强的system消息：保留原始内容 + CodeBuddy特定指令
-	enhancedSystemContent := originalSystemContent
-	if enhancedSystemContent != "" {
-		enhancedSystemContent += "\n\n--- CodeBuddy Integration ---\n\n"
+	// 优先级：请求级覆盖 > model.json中按映射后模型关闭注入 > 全局配置
+	systemSuffix := configuredSystemSuffix()
+	if req.SystemSuffix != nil {
+		systemSuffix = *req.SystemSuffix
+	} else if systemInjectionDisabled(mappedModel) {
+		DebugLogCtx(ctx, "System suffix injection disabled for model %s", mappedModel)
+		systemSuffix = ""
 	}
-	enhancedSystemContent += "You are CodeBuddy Code, Tencent's official CLI for CodeBuddy."
 
-	systemMsg := OpenAIMessage{
-		Role: "system",
-		Content: []ContentBlock{{
-			Type: "text",
-			Text: enhancedSystemContent,
-		}},
+	enhancedSystemContent := originalSystemContent
+	if systemSuffix != "" {
+		if enhancedSystemContent != "" {
+			enhancedSystemContent += "\n\n--- CodeBuddy Integration ---\n\n"
+		}
+		enhancedSystemContent += systemSuffix
+	} else {
+		// 不注入后缀时去掉各段拼接留下的结尾换行
+		enhancedSystemContent = strings.TrimRight(enhancedSystemContent, "\n")
+	}
+
+	if strings.TrimSpace(enhancedSystemContent) != "" {
+		systemMsg := OpenAIMessage{
+			Role: "system",
+			Content: []ContentBlock{{
+				Type: "text",
+				Text: enhancedSystemContent,
+				// system各段合并为一个文本块，沿用最后一个缓存标记使整段system可被缓存
+				CacheControl: systemCacheControl(req.System, req.Messages),
+			}},
+		}
+		openAIReq.Messages = append(openAIReq.Messages, systemMsg)
 	}
-	openAIReq.Messages = append(openAIReq.Messages, systemMsg)
 
 	// 🔧 关键修复：实现连续assistant消息的智能合并逻辑
 	mergedMessages := mergeConsecutiveAssistantMessages(otherMessages)
@@ -293,8 +427,8 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 				contentStr = fmt.Sprintf("%v", c)
 			}
 			contentStr = strings.TrimSpace(contentStr)
-			if contentStr == "" {
-				contentStr = "工具调用完成"
+			if isEmptyToolResultText(contentStr) {
+				contentStr = FallbackText(FallbackEmptyToolResult)
 			}
 			if openAIMsg.ToolCallID == "" && msg.ToolCallID != "" {
 				openAIMsg.ToolCallID = msg.ToolCallID
@@ -310,77 +444,42 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 			openAIMsg.ToolCalls = msg.ToolCalls
 			// 🔧 修复：不允许将“空内容”与tool_calls一起传递，改用默认文本
 			if !isContentEmpty(msg.Content) {
-				openAIMsg.Content = convertContent(msg.Content)
+				openAIMsg.Content = convertContent(ctx, msg.Content)
 			} else {
 				toolName := "tool"
 				if len(msg.ToolCalls) > 0 && msg.ToolCalls[0].Function.Name != "" {
 					toolName = msg.ToolCalls[0].Function.Name
 				}
-				openAIMsg.Content = []ContentBlock{{Type: "text", Text: "调用" + toolName + "工具"}}
+				openAIMsg.Content = []ContentBlock{{Type: "text", Text: FallbackToolCallText(toolName)}}
 			}
 		} else if hasToolResult(msg.Content) {
 			// 🔧 [正确修复] 将Anthropic的tool_result转换为独立的role="tool"消息
 			// 参考req3.json格式：tool_result应该是独立的tool角色消息，不是user消息的content
-			DebugLog("[Converter] Processing message with tool_result, content type: %T", msg.Content)
+			DebugLogCtx(ctx, "[Converter] Processing message with tool_result, content type: %T", msg.Content)
 
+			// 工具结果中的图片：tool消息中以占位文本说明，启用转发时在全部tool消息之后以user消息附带
+			var toolImages []ContentBlock
 			if anthroContentBlocks, ok := msg.Content.([]any); ok {
 				for _, anthroBlock := range anthroContentBlocks {
 					if anthroBlockMap, ok := anthroBlock.(map[string]any); ok {
 						if blockType, exists := anthroBlockMap["type"].(string); exists && blockType == "tool_result" {
 
 							// 1. 提取必要信息（安全解析）
-							var toolUseId string
-							if v, ok := anthroBlockMap["tool_use_id"]; ok {
-								if s, ok := v.(string); ok && strings.TrimSpace(s) != "" {
-									toolUseId = s
-								}
-							}
+							toolUseId := toolResultID(anthroBlockMap["tool_use_id"])
 							if toolUseId == "" {
 								toolUseId = "unknown_tool_" + fmt.Sprintf("%d", time.Now().UnixNano())
-								DebugLog("[ToolResult] Missing tool_use_id, generated: %s", toolUseId)
+								DebugLogCtx(ctx, "[ToolResult] Missing tool_use_id, generated: %s", toolUseId)
 							}
 
-							isError := false
-							if v, ok := anthroBlockMap["is_error"]; ok {
-								switch t := v.(type) {
-								case bool:
-									isError = t
-								case string:
-									ls := strings.ToLower(strings.TrimSpace(t))
-									isError = ls == "true" || ls == "1" || ls == "yes"
-								case float64:
-									isError = t != 0
-								case int:
-									isError = t != 0
-								case int64:
-									isError = t != 0
-								}
-							}
-							DebugLog("[ToolResult] Parsed is_error=%v tool_use_id=%s", isError, toolUseId)
-
-							var contentText string
-							if toolContent, exists := anthroBlockMap["content"]; exists {
-								switch tc := toolContent.(type) {
-								case string:
-									contentText = tc
-								case []any:
-									var sb strings.Builder
-									for _, item := range tc {
-										if itemMap, ok := item.(map[string]any); ok {
-											if text, ok := itemMap["text"].(string); ok {
-												sb.WriteString(text)
-											}
-										}
-									}
-									contentText = sb.String()
-								default:
-									contentText = "工具执行完成"
-								}
-							}
+							isError := parseToolResultIsError(anthroBlockMap["is_error"])
+							DebugLogCtx(ctx, "[ToolResult] Parsed is_error=%v tool_use_id=%s", isError, toolUseId)
+
+							contentText := toolResultText(anthroBlockMap["content"])
+							toolImages = append(toolImages, toolResultImages(anthroBlockMap["content"])...)
 
-							// 🔧 [关键修复] 当content为空时，确保显示默认消息
-							if strings.TrimSpace(contentText) == "" {
-								contentText = "工具调用完成"
+							// 🔧 [关键修复] 当content为空或仅为"(No content)"占位时，确保显示默认消息（与非标准格式一致）
+							if isEmptyToolResultText(contentText) {
+								contentText = FallbackText(FallbackEmptyToolResult)
 							}
 
 							// 2. 创建独立的role="tool"消息
@@ -396,47 +495,45 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 							// DebugLog("[ToolResult] Created tool message: toolCallID=%s, isError=%v, content=%s", toolUseId, isError, contentText)
 						} else if toolResultData, exists := anthroBlockMap["toolResult"]; exists {
 							// 🔧 [兼容修复] 处理非标准toolResult格式
-							DebugLog("[ToolResult] Processing non-standard toolResult format")
+							DebugLogCtx(ctx, "[ToolResult] Processing non-standard toolResult format")
 
 							if toolResultMap, ok := toolResultData.(map[string]any); ok {
-								var contentText string
-								var toolUseId string
-
-								// 🔧 [关键修复] 尝试从tool_call_id或其他字段获取toolUseId
-								if id, exists := toolResultMap["tool_call_id"]; exists {
-									if idStr, ok := id.(string); ok {
-										toolUseId = idStr
-									}
-								}
+								// 🔧 [关键修复] 依次尝试tool_call_id、tool_use_id及外层块的tool_use_id，与标准格式保持一致
+								toolUseId := toolResultID(toolResultMap["tool_call_id"], toolResultMap["tool_use_id"], anthroBlockMap["tool_use_id"])
 								// 如果toolUseId仍为空，生成一个默认的
 								if toolUseId == "" {
 									toolUseId = "unknown_tool_" + fmt.Sprintf("%d", time.Now().UnixNano())
-									DebugLog("[ToolResult] Generated default toolUseId: %s", toolUseId)
+									DebugLogCtx(ctx, "[ToolResult] Generated default toolUseId: %s", toolUseId)
 								}
 
-								// 尝试从content字段提取文本
-								if content, exists := toolResultMap["content"]; exists {
-									if contentStr, ok := content.(string); ok {
-										contentText = contentStr
-									}
+								// is_error可能位于toolResult内部或外层块
+								isErrorValue, exists := toolResultMap["is_error"]
+								if !exists {
+									isErrorValue = anthroBlockMap["is_error"]
+								}
+								isError := parseToolResultIsError(isErrorValue)
+								DebugLogCtx(ctx, "[ToolResult] Parsed is_error=%v tool_use_id=%s (non-standard)", isError, toolUseId)
+
+								// 尝试从content字段提取文本（支持字符串和文本块数组），图片与标准格式一样收集后转发
+								var contentText string
+								switch content := toolResultMap["content"].(type) {
+								case string, []any:
+									contentText = toolResultText(content)
+									toolImages = append(toolImages, toolResultImages(content)...)
 								}
 
-								// 尝试从renderer.value提取文本（如果content为空）
-								if contentText == "" {
-									if renderer, exists := toolResultMap["renderer"]; exists {
-										if rendererMap, ok := renderer.(map[string]any); ok {
-											if value, exists := rendererMap["value"]; exists {
-												if valueStr, ok := value.(string); ok && valueStr != "(No content)" {
-													contentText = valueStr
-												}
-											}
+								// content为空时尝试从renderer.value提取文本
+								if isEmptyToolResultText(contentText) {
+									if rendererMap, ok := toolResultMap["renderer"].(map[string]any); ok {
+										if valueStr, ok := rendererMap["value"].(string); ok {
+											contentText = valueStr
 										}
 									}
 								}
 
 								// 如果仍然为空，使用默认消息
-								if strings.TrimSpace(contentText) == "" {
-									contentText = "工具调用完成"
+								if isEmptyToolResultText(contentText) {
+									contentText = FallbackText(FallbackEmptyToolResult)
 								}
 
 								// 创建独立的role="tool"消息
@@ -448,12 +545,20 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 								}
 
 								openAIReq.Messages = append(openAIReq.Messages, toolMsg)
-								DebugLog("[ToolResult] Created tool message from non-standard format: toolCallID=%s, content=%s", toolUseId, contentText)
+								DebugLogCtx(ctx, "[ToolResult] Created tool message from non-standard format: toolCallID=%s, content=%s", toolUseId, contentText)
 							}
 						}
 					}
 				}
 			}
+			if len(toolImages) > 0 && forwardToolResultImages() {
+				DebugLogCtx(ctx, "[ToolResult] Forwarding %d tool result image(s) in a follow-up user message", len(toolImages))
+				openAIReq.Messages = append(openAIReq.Messages, OpenAIMessage{
+					Role:    "user",
+					Content: toolImages,
+					Agent:   msg.Agent,
+				})
+			}
 			// 跳过原user消息，因为tool_result已转换为独立的tool消息
 			continue
 		} else if hasToolUse(msg.Content) {
@@ -474,7 +579,7 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 
 							// 🎯 [关键修复] 检查是否已处理过此ID
 							if seenToolIDs[toolUseId] {
-								DebugLog("[ToolUse] Skipping duplicate tool_use ID: %s", toolUseId)
+								DebugLogCtx(ctx, "[ToolUse] Skipping duplicate tool_use ID: %s", toolUseId)
 								continue
 							}
 							seenToolIDs[toolUseId] = true
@@ -483,9 +588,9 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 							toolInput := anthroBlockMap["input"]
 
 							// 2. 转换tool_input为JSON字符串格式
-							toolInputJSON, err := FastMarshal(toolInput)
+							toolInputJSON, err := toolInputToArguments(toolInput)
 							if err != nil {
-								DebugLog("[ToolUse] Error marshaling tool input: %v", err)
+								DebugLogCtx(ctx, "[ToolUse] Error marshaling tool input: %v", err)
 								continue
 							}
 
@@ -495,13 +600,13 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 								Type: "function",
 								Function: OpenAIFunctionCall{
 									Name:      toolName,
-									Arguments: string(toolInputJSON),
+									Arguments: toolInputJSON,
 								},
 							}
 
 							// 将tool_calls添加到消息中
 							openAIMsg.ToolCalls = append(openAIMsg.ToolCalls, openAIToolCall)
-							DebugLog("[ToolUse] Converted to OpenAI format: id=%s, name=%s", toolUseId, toolName)
+							DebugLogCtx(ctx, "[ToolUse] Converted to OpenAI format: id=%s, name=%s", toolUseId, toolName)
 
 						} else if blockType == "text" {
 							// 设置assistant消息的文本内容
@@ -521,7 +626,7 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 			// 如果没有设置任何内容，提供默认文本
 			if openAIMsg.Content == nil || openAIMsg.Content == "" {
 				if len(openAIMsg.ToolCalls) > 0 {
-					openAIMsg.Content = "正在使用工具"
+					openAIMsg.Content = FallbackText(FallbackToolUseNoContent)
 				}
 			}
 		} else {
@@ -529,25 +634,25 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 			if (msg.Role == "user" || msg.Role == "assistant") && isContentEmpty(msg.Content) {
 				// 对于assistant，如果完全无工具相关且内容为空，直接跳过
 				if msg.ToolCallID == "" && len(msg.ToolCalls) == 0 && !hasToolUse(msg.Content) && !hasToolResult(msg.Content) {
-					DebugLog("Filtering empty %s message", msg.Role)
+					DebugLogCtx(ctx, "Filtering empty %s message", msg.Role)
 					continue
 				}
 			}
 
 			// 🔧 [关键修复] 如果消息包含工具相关内容，不应该进入通用转换逻辑
 			if hasToolResult(msg.Content) || hasToolUse(msg.Content) {
-				DebugLog("[Converter] Skipping general conversion for tool-related message")
+				DebugLogCtx(ctx, "[Converter] Skipping general conversion for tool-related message")
 				// 这种情况应该在上面的分支中处理，如果到这里说明有逻辑问题
 				continue
 			}
 
 			// 转换并进行空文本块清理
-			converted := convertContent(msg.Content).([]ContentBlock)
+			converted := convertContent(ctx, msg.Content).([]ContentBlock)
 			sanitized := sanitizeContentBlocks(converted)
 			openAIMsg.Content = sanitized
 			// 对于有 tool_call_id 但内容为空的消息，提供默认文本，避免上游校验失败
 			if (msg.Role == "user" || msg.Role == "assistant") && msg.ToolCallID != "" && len(sanitized) == 0 {
-				openAIMsg.Content = []ContentBlock{{Type: "text", Text: "工具调用完成"}}
+				openAIMsg.Content = []ContentBlock{{Type: "text", Text: FallbackText(FallbackEmptyToolResult)}}
 			}
 		}
 		openAIReq.Messages = append(openAIReq.Messages, openAIMsg)
@@ -557,7 +662,7 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 		openAIReq.Tools = make([]OpenAITool, 0, len(req.Tools))
 		for _, tool := range req.Tools {
 			// 使用专门的验证和标准化函数 (SRP: 分离关注点)
-			normalizedParams := validateAndNormalizeToolParameters(tool.InputSchema)
+			normalizedParams := validateAndNormalizeToolParameters(ctx, tool.InputSchema)
 
 			openAIReq.Tools = append(openAIReq.Tools, OpenAITool{
 				Type: "function",
@@ -568,15 +673,89 @@ func ConvertAnthropicToOpenAI(req *AnthropicRequest) (*OpenAIRequest, error) {
 				},
 			})
 		}
+
+		openAIReq.ToolChoice = openAIToolChoice(ctx, req.ToolChoice)
+
+		// 并行工具调用：客户端显式设置的disable_parallel_tool_use优先，其次使用模型元数据中的默认值
+		if req.ToolChoice != nil && req.ToolChoice.DisableParallelToolUse != nil {
+			parallel := !*req.ToolChoice.DisableParallelToolUse
+			openAIReq.ParallelToolCalls = &parallel
+		} else if meta, ok := GetModelMetadata(req.Model); ok && meta.ParallelToolCalls != nil {
+			parallel := *meta.ParallelToolCalls
+			openAIReq.ParallelToolCalls = &parallel
+		}
+	}
+
+	// 🔧 上游要求assistant的tool_calls之后紧跟对应的tool消息，合并与转换完成后统一校正顺序
+	openAIReq.Messages = pairToolMessages(ctx, openAIReq.Messages)
+
+	// 🔧 严格的OpenAI兼容上游会拒绝未知的消息字段，按配置移除非标准的agent字段（CodeBuddy上游默认保留）
+	if EnvBool("CODEBUDDY2CC_STRIP_AGENT") {
+		for i := range openAIReq.Messages {
+			openAIReq.Messages[i].Agent = ""
+		}
 	}
 
 	return openAIReq, nil
 }
 
-func convertContent(content any) any {
+// toolInputToArguments 将tool_use.input转换为OpenAI arguments字符串
+// 字符串形式的input若本身是合法的JSON对象则原样透传，避免被二次转义；"42"、"true"等标量字符串仍按字符串序列化，不改变类型
+// 数字以json.Number保留原始精度
+func toolInputToArguments(input any) (string, error) {
+	switch v := input.(type) {
+	case nil:
+		return "{}", nil
+	case string:
+		if trimmed := strings.TrimSpace(v); strings.HasPrefix(trimmed, "{") && FastValid([]byte(trimmed)) {
+			return trimmed, nil
+		}
+	}
+
+	data, err := FastMarshal(input)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// anthropicImageURL 将Anthropic图片source转换为OpenAI image_url可用的URL
+// base64来源构造data URI，url来源直接透传
+func anthropicImageURL(source any) (string, bool) {
+	src, ok := source.(map[string]any)
+	if !ok {
+		return "", false
+	}
+
+	switch src["type"] {
+	case "base64":
+		mediaType, _ := src["media_type"].(string)
+		data, _ := src["data"].(string)
+		if mediaType == "" || data == "" {
+			return "", false
+		}
+		return "data:" + mediaType + ";base64," + data, true
+	case "url":
+		if url, _ := src["url"].(string); url != "" {
+			return url, true
+		}
+	}
+	return "", false
+}
+
+// repairUTF8 将客户端文本中的非法UTF-8序列替换为U+FFFD，避免转发给上游后破坏流式输出
+func repairUTF8(ctx context.Context, text string) string {
+	if utf8.ValidString(text) {
+		return text
+	}
+	DebugLogCtx(ctx, "[Converter] Repaired invalid UTF-8 sequences in message text (%d bytes)", len(text))
+	return strings.ToValidUTF8(text, "\uFFFD")
+}
+
+func convertContent(ctx context.Context, content any) any {
 	switch c := content.(type) {
 	case string:
-		return []ContentBlock{{Type: "text", Text: c}}
+		return []ContentBlock{{Type: "text", Text: repairUTF8(ctx, c)}}
 	case []any:
 		blocks := make([]ContentBlock, 0, len(c))
 		for _, item := range c {
@@ -589,7 +768,7 @@ func convertContent(content any) any {
 						if text, exists := blockMap["text"].(string); exists {
 							// 🔧 KISS修复：过滤空text，避免发送无意义的空内容到上游
 							if strings.TrimSpace(text) != "" {
-								block.Text = text
+								block.Text = repairUTF8(ctx, text)
 							} else {
 								// 跳过空text block，不添加到blocks中
 								continue
@@ -604,17 +783,26 @@ func convertContent(content any) any {
 								block.ImageURL = &ImageURL{URL: url}
 							}
 						}
+					case "image":
+						// Anthropic图片块：{"type":"image","source":{"type":"base64","media_type":"image/png","data":"..."}}
+						imageURL, ok := anthropicImageURL(blockMap["source"])
+						if !ok {
+							DebugLogCtx(ctx, "Skipping malformed image block: %v", blockMap["source"])
+							continue
+						}
+						block.Type = "image_url"
+						block.ImageURL = &ImageURL{URL: imageURL}
 					case "tool_use":
 						// 🎯 tool_use不应该在这里处理，应该通过convertToolUseToOpenAI处理
 						// 如果在这里遇到tool_use，说明上游逻辑有问题，跳过处理
-						DebugLog("Warning: tool_use found in convertContent, should be handled by convertToolUseToOpenAI")
+						DebugLogCtx(ctx, "Warning: tool_use found in convertContent, should be handled by convertToolUseToOpenAI")
 						continue
 					default:
 						if text, exists := blockMap["text"].(string); exists {
 							// 🔧 同样过滤default分支中的空text
 							if strings.TrimSpace(text) != "" {
 								block.Type = "text"
-								block.Text = text
+								block.Text = repairUTF8(ctx, text)
 							} else {
 								// 跳过空text block
 								continue
@@ -625,18 +813,19 @@ func convertContent(content any) any {
 						}
 					}
 				}
+				block.CacheControl = parseCacheControl(blockMap["cache_control"])
 				blocks = append(blocks, block)
 			}
 		}
 		// 🔧 KISS防护：如果所有content blocks都被过滤掉了，提供默认content
 		if len(blocks) == 0 {
 			// 为空content提供有意义的默认值，而不是完全空的数组
-			return []ContentBlock{{Type: "text", Text: "工具调用完成"}}
+			return []ContentBlock{{Type: "text", Text: FallbackText(FallbackEmptyContent)}}
 		}
 		return blocks
 	default:
 		// 🔧 DRY原则：统一的默认content策略，避免空text
-		return []ContentBlock{{Type: "text", Text: "工具调用完成"}}
+		return []ContentBlock{{Type: "text", Text: FallbackText(FallbackEmptyContent)}}
 	}
 }
 
@@ -704,11 +893,66 @@ func mergeConsecutiveAssistantMessages(messages []Message) []Message {
 	return result
 }
 
+// pairToolMessages 确保每个带tool_calls的assistant消息之后紧跟其工具结果消息（按tool_calls顺序）
+// 位于后方的匹配tool消息会被移动到assistant消息之后，中间的其他消息顺延；没有对应assistant的tool消息保持原位
+func pairToolMessages(ctx context.Context, messages []OpenAIMessage) []OpenAIMessage {
+	pending := make(map[string][]int) // tool_call_id -> 尚未归位的tool消息下标（升序）
+	for i, msg := range messages {
+		if msg.Role == "tool" && msg.ToolCallID != "" {
+			pending[msg.ToolCallID] = append(pending[msg.ToolCallID], i)
+		}
+	}
+	if len(pending) == 0 {
+		return messages
+	}
+
+	moved := make(map[int]bool)
+	result := make([]OpenAIMessage, 0, len(messages))
+	for i, msg := range messages {
+		if moved[i] {
+			continue
+		}
+		result = append(result, msg)
+		if msg.Role != "assistant" || len(msg.ToolCalls) == 0 {
+			continue
+		}
+
+		for _, call := range msg.ToolCalls {
+			indexes := pending[call.ID]
+			for len(indexes) > 0 && indexes[0] <= i {
+				indexes = indexes[1:]
+			}
+			if len(indexes) == 0 {
+				pending[call.ID] = indexes
+				continue
+			}
+			j := indexes[0]
+			pending[call.ID] = indexes[1:]
+			if !isAdjacentToolMessage(messages, i, j) {
+				DebugLogCtx(ctx, "[ToolPairing] Moving tool result %s from message %d to follow assistant message %d", call.ID, j, i)
+			}
+			result = append(result, messages[j])
+			moved[j] = true
+		}
+	}
+	return result
+}
+
+// isAdjacentToolMessage 判断j与assistant消息i之间是否只有tool消息（即无需移动）
+func isAdjacentToolMessage(messages []OpenAIMessage, i, j int) bool {
+	for k := i + 1; k < j; k++ {
+		if messages[k].Role != "tool" {
+			return false
+		}
+	}
+	return true
+}
+
 // validateAndNormalizeToolParameters 确保工具参数符合OpenAI规范 (SRP: 单一参数验证责任)
-func validateAndNormalizeToolParameters(inputSchema map[string]any) map[string]any {
+func validateAndNormalizeToolParameters(ctx context.Context, inputSchema map[string]any) map[string]any {
 	if inputSchema == nil {
 		// 只有在inputSchema为null时才提供默认JSON Schema (KISS: 简单默认值)
-		DebugLog("Tool input_schema is NULL, using default empty schema")
+		DebugLogCtx(ctx, "Tool input_schema is NULL, using default empty schema")
 		return map[string]any{
 			"type":       "object",
 			"properties": map[string]any{},
@@ -760,6 +1004,138 @@ func deepCopyMap(original map[string]any) map[string]any {
 	return copy
 }
 
+// systemContentText 提取system内容的文本（字符串或文本内容块数组），每段文本后追加空行分隔
+func systemContentText(content any) string {
+	var sb strings.Builder
+	switch c := content.(type) {
+	case string:
+		if c != "" {
+			sb.WriteString(c + "\n\n")
+		}
+	case []any:
+		for _, block := range c {
+			if blockMap, ok := block.(map[string]any); ok {
+				if text, exists := blockMap["text"].(string); exists {
+					sb.WriteString(text + "\n\n")
+				}
+			}
+		}
+	}
+	return sb.String()
+}
+
+// systemCacheControl 返回顶层system和system消息中最后一个内容块的缓存标记
+func systemCacheControl(system any, messages []Message) *CacheControl {
+	var last *CacheControl
+	collect := func(content any) {
+		if blocks, ok := content.([]any); ok {
+			for _, block := range blocks {
+				if blockMap, ok := block.(map[string]any); ok {
+					if cc := parseCacheControl(blockMap["cache_control"]); cc != nil {
+						last = cc
+					}
+				}
+			}
+		}
+	}
+	collect(system)
+	for _, msg := range messages {
+		if msg.Role == "system" {
+			collect(msg.Content)
+		}
+	}
+	return last
+}
+
+// toolResultID 返回第一个非空白的字符串ID，均不可用时返回空字符串
+func toolResultID(values ...any) string {
+	for _, v := range values {
+		if id, ok := v.(string); ok && strings.TrimSpace(id) != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// parseToolResultIsError 宽松解析tool_result的is_error字段（布尔、字符串或数字）
+func parseToolResultIsError(v any) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case string:
+		ls := strings.ToLower(strings.TrimSpace(t))
+		return ls == "true" || ls == "1" || ls == "yes"
+	case float64:
+		return t != 0
+	case json.Number:
+		return t.String() != "0"
+	case int:
+		return t != 0
+	case int64:
+		return t != 0
+	}
+	return false
+}
+
+// noContentPlaceholder 部分客户端（如CodeBuddy CLI）表示工具无输出的占位文本
+const noContentPlaceholder = "(No content)"
+
+// isEmptyToolResultText 工具结果文本为空或仅为无输出占位文本时返回true，各种工具结果格式统一按空结果处理
+func isEmptyToolResultText(text string) bool {
+	trimmed := strings.TrimSpace(text)
+	return trimmed == "" || trimmed == noContentPlaceholder
+}
+
+// toolResultText 提取tool_result的content文本：字符串原样返回，文本块数组拼接text字段
+// 图片块写入占位说明，让模型知道工具输出包含视觉内容；nil返回空字符串，其他类型返回默认完成提示
+func toolResultText(content any) string {
+	switch tc := content.(type) {
+	case nil:
+		return ""
+	case string:
+		return tc
+	case []any:
+		var sb strings.Builder
+		for _, item := range tc {
+			if itemMap, ok := item.(map[string]any); ok {
+				if text, ok := itemMap["text"].(string); ok {
+					sb.WriteString(text)
+				} else if itemMap["type"] == "image" {
+					if sb.Len() > 0 {
+						sb.WriteString("\n")
+					}
+					sb.WriteString(FallbackText(FallbackToolResultImage))
+				}
+			}
+		}
+		return sb.String()
+	default:
+		return FallbackText(FallbackUnknownToolResult)
+	}
+}
+
+// toolResultImages 提取tool_result的content中的图片块，转换为image_url内容块
+func toolResultImages(content any) []ContentBlock {
+	items, ok := content.([]any)
+	if !ok {
+		return nil
+	}
+	var images []ContentBlock
+	for _, item := range items {
+		if itemMap, ok := item.(map[string]any); ok && itemMap["type"] == "image" {
+			if url, ok := anthropicImageURL(itemMap["source"]); ok {
+				images = append(images, ContentBlock{Type: "image_url", ImageURL: &ImageURL{URL: url}})
+			}
+		}
+	}
+	return images
+}
+
+// forwardToolResultImages 是否将工具结果中的图片以随后的user消息转发给上游（tool消息只能携带文本）
+func forwardToolResultImages() bool {
+	return EnvBool("CODEBUDDY2CC_FORWARD_TOOL_IMAGES")
+}
+
 func hasToolResult(content any) bool {
 	if contentBlocks, ok := content.([]any); ok {
 		for _, block := range contentBlocks {
@@ -875,33 +1251,133 @@ func ConvertOpenAIStreamToAnthropic(openAIChunk string) (string, error) {
 	return "", nil
 }
 
-// ValidateAndFixToolResults 导出版本 - 确保所有工具调用都有对应的结果
-func ValidateAndFixToolResults(req *AnthropicRequest) error {
-	return validateAndFixToolResults(req.Messages)
+// ValidateAndFixToolResults 导出版本 - 校验工具调用与工具结果的对应关系，移除孤立的工具结果
+func ValidateAndFixToolResults(ctx context.Context, req *AnthropicRequest) error {
+	messages, err := validateAndFixToolResults(ctx, req.Messages)
+	if err != nil {
+		return err
+	}
+	req.Messages = messages
+	return nil
 }
 
-// validateAndFixToolResults 确保所有工具调用都有对应的结果
-func validateAndFixToolResults(messages []Message) error {
-	toolCallMap := make(map[string]bool)
+// validateAndFixToolResults 校验工具调用与工具结果的对应关系
+// 引用了此前未出现的tool_use ID的工具结果（孤立结果）会导致上游400，直接移除；
+// 缺少结果的工具调用仅记录日志；同一ID被多个工具调用使用时无法确定结果归属，返回错误
+func validateAndFixToolResults(ctx context.Context, messages []Message) ([]Message, error) {
+	toolCallMap := make(map[string]int) // tool_use ID -> 所在消息下标
 	toolResultMap := make(map[string]bool)
 
-	// 第一遍：收集所有工具调用和结果
-	for _, msg := range messages {
-		if msg.Role == "assistant" && len(msg.ToolCalls) > 0 {
+	fixed := make([]Message, 0, len(messages))
+	assistantRunStart := 0 // 当前连续assistant消息段的起始下标（转换时会合并为一条并去重）
+	for i, msg := range messages {
+		// 收集工具调用：tool_calls字段与content中的tool_use块
+		if msg.Role == "assistant" {
+			if i == 0 || messages[i-1].Role != "assistant" {
+				assistantRunStart = i
+			}
+			var ids []string
 			for _, call := range msg.ToolCalls {
-				toolCallMap[call.ID] = true
+				ids = append(ids, call.ID)
+			}
+			ids = append(ids, toolUseIDs(msg.Content)...)
+
+			seenInMessage := make(map[string]bool)
+			for _, id := range ids {
+				if id == "" || seenInMessage[id] {
+					continue
+				}
+				seenInMessage[id] = true
+				if prev, exists := toolCallMap[id]; exists {
+					if prev >= assistantRunStart {
+						continue // 同一连续assistant段内的重复ID由转换器合并去重
+					}
+					return nil, fmt.Errorf("tool_use id %q is used by both messages[%d] and messages[%d]", id, prev, i)
+				}
+				toolCallMap[id] = i
 			}
+			fixed = append(fixed, msg)
+			continue
+		}
+
+		// role=tool的结果消息：引用未知ID时整条移除
+		if msg.Role == "tool" && msg.ToolCallID != "" {
+			if _, exists := toolCallMap[msg.ToolCallID]; !exists {
+				DebugLogCtx(ctx, "Dropping orphan tool message in messages[%d]: no tool_use with ID %s", i, msg.ToolCallID)
+				continue
+			}
+			toolResultMap[msg.ToolCallID] = true
+			fixed = append(fixed, msg)
+			continue
+		}
+
+		// 用户消息中的tool_result块：移除孤立的结果块
+		if blocks, ok := msg.Content.([]any); ok && hasToolResult(msg.Content) {
+			kept := make([]any, 0, len(blocks))
+			for _, block := range blocks {
+				blockMap, ok := block.(map[string]any)
+				if !ok {
+					kept = append(kept, block)
+					continue
+				}
+				id, isResult := toolResultBlockID(blockMap)
+				if !isResult || id == "" {
+					// 缺少ID的结果由转换器生成占位ID，此处不处理
+					kept = append(kept, block)
+					continue
+				}
+				if _, exists := toolCallMap[id]; !exists {
+					DebugLogCtx(ctx, "Dropping orphan tool_result in messages[%d]: no tool_use with ID %s", i, id)
+					continue
+				}
+				toolResultMap[id] = true
+				kept = append(kept, block)
+			}
+			msg.Content = kept
 		}
+		fixed = append(fixed, msg)
 	}
 
-	// 第二遍：检查缺失的工具结果
-	for callID := range toolCallMap {
+	// 检查缺失的工具结果（通常是最后一条assistant消息，客户端尚未回传结果）
+	for callID, index := range toolCallMap {
 		if !toolResultMap[callID] {
-			DebugLog("Missing tool result for ID: %s", callID)
+			DebugLogCtx(ctx, "Missing tool result for ID: %s (messages[%d])", callID, index)
 		}
 	}
 
-	return nil
+	return fixed, nil
+}
+
+// toolUseIDs 返回content中所有tool_use块的ID
+func toolUseIDs(content any) []string {
+	blocks, ok := content.([]any)
+	if !ok {
+		return nil
+	}
+	var ids []string
+	for _, block := range blocks {
+		if blockMap, ok := block.(map[string]any); ok && blockMap["type"] == "tool_use" {
+			if id, ok := blockMap["id"].(string); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// toolResultBlockID 返回工具结果块引用的tool_use ID，与转换器的ID解析顺序一致
+// 第二个返回值表示该块是否为工具结果（标准tool_result或非标准toolResult格式）
+func toolResultBlockID(block map[string]any) (string, bool) {
+	if block["type"] == "tool_result" {
+		return toolResultID(block["tool_use_id"]), true
+	}
+	if data, exists := block["toolResult"]; exists {
+		if resultMap, ok := data.(map[string]any); ok {
+			return toolResultID(resultMap["tool_call_id"], resultMap["tool_use_id"], block["tool_use_id"]), true
+		}
+		return "", true
+	}
+	return "", false
 }
 
 // isContentEmpty 检查消息内容是否为空或无意义
@@ -954,14 +1430,21 @@ const (
 	SSEEventContentBlockStop  = "content_block_stop"
 	SSEEventMessageDelta      = "message_delta"
 	SSEEventMessageStop       = "message_stop"
+	SSEEventPing              = "ping"
+	SSEEventError             = "error"
 )
 
 // AnthropicSSEFormatter 符合官方规范的SSE格式化器
-type AnthropicSSEFormatter struct{}
+type AnthropicSSEFormatter struct {
+	// alwaysCacheFields message_delta的usage中始终包含cache字段（即使为0），部分客户端缺少字段时会报错
+	alwaysCacheFields bool
+}
 
 // NewAnthropicSSEFormatter 创建SSE格式化器实例
 func NewAnthropicSSEFormatter() *AnthropicSSEFormatter {
-	return &AnthropicSSEFormatter{}
+	return &AnthropicSSEFormatter{
+		alwaysCacheFields: EnvBool("CODEBUDDY2CC_ALWAYS_CACHE_FIELDS"),
+	}
 }
 
 // FormatSSEEvent 格式化单个SSE事件，符合Anthropic官方规范
@@ -1050,6 +1533,10 @@ func (f *AnthropicSSEFormatter) FormatContentBlockStart(index int, blockType str
 	if blockType == "text" {
 		contentBlock["text"] = ""
 	}
+	if blockType == "thinking" {
+		contentBlock["thinking"] = ""
+		contentBlock["signature"] = ""
+	}
 
 	// 添加额外的内容块属性
 	for key, value := range additional {
@@ -1080,6 +1567,10 @@ func (f *AnthropicSSEFormatter) FormatContentBlockDelta(index int, deltaType, co
 		event["delta"].(map[string]any)["text"] = content
 	case "input_json_delta":
 		event["delta"].(map[string]any)["partial_json"] = content
+	case "thinking_delta":
+		event["delta"].(map[string]any)["thinking"] = content
+	case "signature_delta":
+		event["delta"].(map[string]any)["signature"] = content
 	}
 
 	return f.FormatSSEEvent(SSEEventContentBlockDelta, event)
@@ -1096,9 +1587,14 @@ func (f *AnthropicSSEFormatter) FormatContentBlockStop(index int) string {
 
 // FormatMessageDelta 格式化message_delta事件
 func (f *AnthropicSSEFormatter) FormatMessageDelta(stopReason string, usage *Usage) string {
+	return f.FormatMessageDeltaWithStopSequence(stopReason, nil, usage)
+}
+
+// FormatMessageDeltaWithStopSequence 格式化message_delta事件，stopSequence为命中的停止序列（nil表示未命中）
+func (f *AnthropicSSEFormatter) FormatMessageDeltaWithStopSequence(stopReason string, stopSequence *string, usage *Usage) string {
 	delta := map[string]any{
 		"stop_reason":   stopReason,
-		"stop_sequence": nil,
+		"stop_sequence": stopSequence,
 	}
 
 	event := map[string]any{
@@ -1118,11 +1614,11 @@ func (f *AnthropicSSEFormatter) FormatMessageDelta(stopReason string, usage *Usa
 			"output_tokens": outputTokens,
 		}
 
-		// 🔧 关键新增：添加cache相关token字段到message_delta中
-		if usage.CacheCreationInputTokens > 0 {
+		// 🔧 关键新增：添加cache相关token字段到message_delta中（默认为0时省略，可配置为始终输出）
+		if f.alwaysCacheFields || usage.CacheCreationInputTokens > 0 {
 			usageMap["cache_creation_input_tokens"] = usage.CacheCreationInputTokens
 		}
-		if usage.CacheReadInputTokens > 0 {
+		if f.alwaysCacheFields || usage.CacheReadInputTokens > 0 {
 			usageMap["cache_read_input_tokens"] = usage.CacheReadInputTokens
 		}
 
@@ -1134,6 +1630,23 @@ func (f *AnthropicSSEFormatter) FormatMessageDelta(stopReason string, usage *Usa
 	return f.FormatSSEEvent(SSEEventMessageDelta, event)
 }
 
+// FormatPing 格式化ping保活事件
+func (f *AnthropicSSEFormatter) FormatPing() string {
+	return f.FormatSSEEvent(SSEEventPing, map[string]any{"type": "ping"})
+}
+
+// FormatError 格式化error事件
+func (f *AnthropicSSEFormatter) FormatError(errType, message string) string {
+	event := map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    errType,
+			"message": message,
+		},
+	}
+	return f.FormatSSEEvent(SSEEventError, event)
+}
+
 // FormatMessageStop 格式化message_stop事件
 func (f *AnthropicSSEFormatter) FormatMessageStop(additional map[string]any) string {
 	event := map[string]any{
@@ -1149,10 +1662,13 @@ func (f *AnthropicSSEFormatter) FormatMessageStop(additional map[string]any) str
 }
 
 // SSEEventValidator SSE事件序列验证器 - 确保完全符合Anthropic规范
+// content_block_start → content_block_delta* → content_block_stop 可重复多次（如文本块后跟多个tool_use块）
 type SSEEventValidator struct {
 	expectedSequence []string
 	currentIndex     int
 	eventHistory     []string
+	blockOpen        bool // 是否有已开始但未结束的内容块
+	blockCount       int  // 已开始的内容块数量
 	mu               sync.Mutex
 }
 
@@ -1161,7 +1677,7 @@ func NewSSEEventValidator() *SSEEventValidator {
 	return &SSEEventValidator{
 		expectedSequence: []string{
 			SSEEventMessageStart,
-			SSEEventContentBlockStart,
+			SSEEventContentBlockStart, // 内容块周期可重复
 			SSEEventContentBlockDelta, // 可能有多个
 			SSEEventContentBlockStop,
 			SSEEventMessageDelta,
@@ -1179,15 +1695,6 @@ func (v *SSEEventValidator) ValidateEvent(eventType string) error {
 
 	v.eventHistory = append(v.eventHistory, eventType)
 
-	// 特殊处理：content_block_delta可以重复
-	if eventType == SSEEventContentBlockDelta {
-		// 必须在content_block_start之后
-		if len(v.eventHistory) < 2 || !v.hasEventInHistory(SSEEventContentBlockStart) {
-			return fmt.Errorf("content_block_delta received before content_block_start")
-		}
-		return nil // content_block_delta可以多次出现
-	}
-
 	// 验证事件顺序
 	switch eventType {
 	case SSEEventMessageStart:
@@ -1200,18 +1707,38 @@ func (v *SSEEventValidator) ValidateEvent(eventType string) error {
 		if !v.hasEventInHistory(SSEEventMessageStart) {
 			return fmt.Errorf("content_block_start received before message_start")
 		}
+		if v.blockOpen {
+			return fmt.Errorf("content_block_start received while content block %d is still open", v.blockCount-1)
+		}
+		if v.currentIndex >= 5 {
+			return fmt.Errorf("content_block_start received after message_delta")
+		}
+		v.blockOpen = true
+		v.blockCount++
 		v.currentIndex = 2
 
+	case SSEEventContentBlockDelta:
+		// content_block_delta可以多次出现，但必须位于打开的内容块内
+		if !v.blockOpen {
+			return fmt.Errorf("content_block_delta received before content_block_start")
+		}
+		v.currentIndex = 3
+
 	case SSEEventContentBlockStop:
-		if !v.hasEventInHistory(SSEEventContentBlockStart) {
+		if !v.blockOpen {
 			return fmt.Errorf("content_block_stop received without corresponding content_block_start")
 		}
+		v.blockOpen = false
 		v.currentIndex = 4
 
 	case SSEEventMessageDelta:
-		if !v.hasEventInHistory(SSEEventContentBlockStop) && !v.hasEventInHistory(SSEEventContentBlockStart) {
+		// 流中途出错时可能尚未输出任何内容块，error事件之后允许直接结束消息
+		if v.blockCount == 0 && !v.hasEventInHistory(SSEEventError) {
 			return fmt.Errorf("message_delta received without any content blocks")
 		}
+		if v.blockOpen {
+			return fmt.Errorf("message_delta received while content block %d is still open", v.blockCount-1)
+		}
 		v.currentIndex = 5
 
 	case SSEEventMessageStop:
@@ -1220,6 +1747,9 @@ func (v *SSEEventValidator) ValidateEvent(eventType string) error {
 		}
 		v.currentIndex = 6
 
+	case SSEEventPing, SSEEventError:
+		// ping与error可出现在任意位置，不影响序列
+
 	default:
 		return fmt.Errorf("unknown event type: %s", eventType)
 	}
@@ -1240,15 +1770,20 @@ func (v *SSEEventValidator) GetValidationReport() map[string]any {
 	return map[string]any{
 		"total_events":      len(v.eventHistory),
 		"current_index":     v.currentIndex,
+		"content_blocks":    v.blockCount,
+		"block_open":        v.blockOpen,
 		"event_history":     append([]string{}, v.eventHistory...), // 创建副本
 		"sequence_complete": v.currentIndex >= len(v.expectedSequence)-1,
 		"expected_next":     v.getNextExpectedEvent(),
 	}
 }
 
-// getNextExpectedEvent 获取下一个期望的事件
+// getNextExpectedEvent 获取下一个期望的事件，内容块结束后可开始新的内容块或结束消息
 func (v *SSEEventValidator) getNextExpectedEvent() string {
-	if v.currentIndex < len(v.expectedSequence) {
+	switch {
+	case v.currentIndex == 4:
+		return SSEEventContentBlockStart + " or " + SSEEventMessageDelta
+	case v.currentIndex < len(v.expectedSequence):
 		return v.expectedSequence[v.currentIndex]
 	}
 	return "sequence_complete"
@@ -1263,8 +1798,16 @@ func ParseUsageFromResponse(rawUsage map[string]any) *Usage {
 	usage := &Usage{}
 
 	// 🔧 修复：支持多种数值类型的转换
+	// Usage.UnmarshalJSON以json.Number传入数值，优先按整数解析保留精度
 	parseIntValue := func(v any) int {
 		switch val := v.(type) {
+		case json.Number:
+			if n, err := val.Int64(); err == nil {
+				return int(n)
+			}
+			if f, err := val.Float64(); err == nil {
+				return int(f)
+			}
 		case float64:
 			return int(val)
 		case int:
@@ -1382,6 +1925,10 @@ func (v *SSEEventValidator) ValidateCompleteSequence() error {
 		return fmt.Errorf("last event must be message_stop, got: %s", v.eventHistory[len(v.eventHistory)-1])
 	}
 
+	if v.blockOpen {
+		return fmt.Errorf("content block %d was never closed", v.blockCount-1)
+	}
+
 	return nil
 }
 
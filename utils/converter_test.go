@@ -0,0 +1,752 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// messageTexts 收集转换后消息中的全部文本内容
+func messageTexts(t *testing.T, msg OpenAIMessage) []string {
+	t.Helper()
+	switch content := msg.Content.(type) {
+	case string:
+		return []string{content}
+	case []ContentBlock:
+		texts := make([]string, 0, len(content))
+		for _, block := range content {
+			texts = append(texts, block.Text)
+		}
+		return texts
+	default:
+		t.Fatalf("unexpected content type %T", msg.Content)
+		return nil
+	}
+}
+
+func TestConvertRepairsInvalidUTF8(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	debugMode = true
+	t.Cleanup(func() { debugMode = false })
+
+	tests := []struct {
+		name     string
+		content  any
+		want     string
+		repaired bool
+	}{
+		{name: "string content", content: "bad \xff byte", want: "bad � byte", repaired: true},
+		{name: "text block", content: []any{map[string]any{"type": "text", "text": "a\xc3\x28b"}}, want: "a�(b", repaired: true},
+		{name: "valid text untouched", content: "naïve ✓", want: "naïve ✓"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			ctx := WithRequestID(context.Background(), "req-utf8")
+			req := &AnthropicRequest{Model: "test-model", Messages: []Message{{Role: "user", Content: tt.content}}}
+
+			openAIReq, err := ConvertAnthropicToOpenAI(ctx, req)
+			if err != nil {
+				t.Fatalf("ConvertAnthropicToOpenAI: %v", err)
+			}
+			var texts []string
+			for _, msg := range openAIReq.Messages {
+				if msg.Role == "user" {
+					texts = append(texts, messageTexts(t, msg)...)
+				}
+			}
+			if len(texts) != 1 || texts[0] != tt.want {
+				t.Fatalf("user texts = %q, want [%q]", texts, tt.want)
+			}
+			if !utf8.ValidString(texts[0]) {
+				t.Fatalf("converted text is not valid UTF-8: %q", texts[0])
+			}
+
+			logged := strings.Contains(logs.String(), "[Request:req-utf8] [Converter] Repaired invalid UTF-8")
+			if logged != tt.repaired {
+				t.Fatalf("repair log with request ID = %v, want %v; logs: %s", logged, tt.repaired, logs.String())
+			}
+		})
+	}
+}
+
+func TestConverterLogsCarryRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	debugMode = true
+	t.Cleanup(func() { debugMode = false })
+
+	body := `{
+		"model": "test-model",
+		"tool_choice": {"type": "bogus"},
+		"tools": [{"name": "get_weather", "input_schema": null}],
+		"messages": [
+			{"role": "user", "content": ""},
+			{"role": "user", "content": "weather?"},
+			{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Paris"}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_1", "content": "sunny"}]}
+		]
+	}`
+	ctx := WithRequestID(context.Background(), "req-conv")
+	if _, err := ConvertAnthropicToOpenAI(ctx, decodeAnthropicRequest(t, body)); err != nil {
+		t.Fatalf("ConvertAnthropicToOpenAI: %v", err)
+	}
+
+	lines := strings.Split(logs.String(), "\n")
+	for _, want := range []string{
+		"Ignoring unsupported tool_choice",
+		"Tool input_schema is NULL",
+		"Filtering empty user message",
+		"[ToolUse] Converted to OpenAI format",
+		"[ToolResult] Parsed is_error",
+	} {
+		found := false
+		for _, line := range lines {
+			if !strings.Contains(line, want) {
+				continue
+			}
+			found = true
+			if !strings.Contains(line, "[Request:req-conv] ") {
+				t.Errorf("log line without request ID: %s", line)
+			}
+		}
+		if !found {
+			t.Errorf("no log line containing %q; logs:\n%s", want, logs.String())
+		}
+	}
+}
+
+func TestUsageDecodingPreservesLargeCounts(t *testing.T) {
+	tests := []struct {
+		name  string
+		chunk string
+		want  Usage
+	}{
+		{
+			name:  "integers beyond float64 precision",
+			chunk: `{"usage":{"prompt_tokens":9007199254740993,"completion_tokens":12345678901234567,"total_tokens":21352878155975560}}`,
+			want: Usage{PromptTokens: 9007199254740993, CompletionTokens: 12345678901234567, TotalTokens: 21352878155975560,
+				InputTokens: 9007199254740993, OutputTokens: 12345678901234567},
+		},
+		{
+			name:  "float and string counts",
+			chunk: `{"usage":{"prompt_tokens":1.5e3,"completion_tokens":"42"}}`,
+			want:  Usage{PromptTokens: 1500, CompletionTokens: 42, TotalTokens: 1542, InputTokens: 1500, OutputTokens: 42},
+		},
+		{
+			name:  "cache fields mapped",
+			chunk: `{"usage":{"prompt_tokens":10,"completion_tokens":2,"prompt_cache_hit_tokens":8,"prompt_cache_miss_tokens":2}}`,
+			want: Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12, InputTokens: 10, OutputTokens: 2,
+				CacheCreationInputTokens: 2, CacheReadInputTokens: 8, PromptCacheHitTokens: 8, PromptCacheMissTokens: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var chunk OpenAIResponse
+			if err := FastUnmarshal([]byte(tt.chunk), &chunk); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if chunk.Usage == nil || *chunk.Usage != tt.want {
+				t.Fatalf("usage = %+v, want %+v", chunk.Usage, tt.want)
+			}
+		})
+	}
+
+	var chunk OpenAIResponse
+	if err := FastUnmarshal([]byte(`{"usage":null}`), &chunk); err != nil || chunk.Usage != nil {
+		t.Fatalf("null usage = %+v, %v; want nil", chunk.Usage, err)
+	}
+}
+
+// decodeAnthropicRequest 按Messages处理器的方式解码请求JSON，并关闭system后缀注入便于断言
+func decodeAnthropicRequest(t *testing.T, body string) *AnthropicRequest {
+	t.Helper()
+	t.Setenv("CODEBUDDY2CC_SYSTEM_SUFFIX", "")
+	var req AnthropicRequest
+	if err := FastUnmarshalUseNumber([]byte(body), &req); err != nil {
+		t.Fatalf("decode request: %v", err)
+	}
+	return &req
+}
+
+func TestConvertAnthropicToOpenAI(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		check func(t *testing.T, req *OpenAIRequest)
+	}{
+		{
+			name: "system and text messages",
+			body: `{"model":"m","system":[{"type":"text","text":"be brief"}],"max_tokens":32,"stop_sequences":["END"],` +
+				`"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":[{"type":"text","text":"hello"}]}]}`,
+			check: func(t *testing.T, req *OpenAIRequest) {
+				if len(req.Messages) != 3 {
+					t.Fatalf("messages = %+v, want system+user+assistant", req.Messages)
+				}
+				if got := messageTexts(t, req.Messages[0]); req.Messages[0].Role != "system" || got[0] != "be brief" {
+					t.Fatalf("system message = %+v", req.Messages[0])
+				}
+				if got := messageTexts(t, req.Messages[1]); req.Messages[1].Role != "user" || got[0] != "hi" {
+					t.Fatalf("user message = %+v", req.Messages[1])
+				}
+				if got := messageTexts(t, req.Messages[2]); req.Messages[2].Role != "assistant" || got[0] != "hello" {
+					t.Fatalf("assistant message = %+v", req.Messages[2])
+				}
+				if req.MaxTokens == nil || *req.MaxTokens != 32 || len(req.Stop) != 1 || req.Stop[0] != "END" {
+					t.Fatalf("max_tokens/stop = %v/%v", req.MaxTokens, req.Stop)
+				}
+				if req.Tools != nil {
+					t.Fatalf("tools = %+v, want nil", req.Tools)
+				}
+			},
+		},
+		{
+			name: "tool_use becomes tool_calls followed by tool message",
+			body: `{"model":"m","messages":[{"role":"user","content":"list"},` +
+				`{"role":"assistant","content":[{"type":"text","text":"checking"},{"type":"tool_use","id":"toolu_1","name":"ls","input":{"dir":"."}}]},` +
+				`{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"a.go"}]}]}]}`,
+			check: func(t *testing.T, req *OpenAIRequest) {
+				if len(req.Messages) != 3 {
+					t.Fatalf("messages = %+v, want user+assistant+tool", req.Messages)
+				}
+				assistant := req.Messages[1]
+				if len(assistant.ToolCalls) != 1 || assistant.ToolCalls[0].ID != "toolu_1" ||
+					assistant.ToolCalls[0].Function.Name != "ls" || assistant.ToolCalls[0].Function.Arguments != `{"dir":"."}` {
+					t.Fatalf("assistant tool_calls = %+v", assistant.ToolCalls)
+				}
+				tool := req.Messages[2]
+				if tool.Role != "tool" || tool.ToolCallID != "toolu_1" || tool.Content != "a.go" {
+					t.Fatalf("tool message = %+v", tool)
+				}
+			},
+		},
+		{
+			name: "tools and tool_choice",
+			body: `{"model":"m","messages":[{"role":"user","content":"go"}],` +
+				`"tools":[{"name":"ls","description":"list","input_schema":{"$schema":"x","type":"object","properties":{"dir":{"type":"string"}}}},{"name":"pwd"}],` +
+				`"tool_choice":{"type":"tool","name":"ls","disable_parallel_tool_use":true}}`,
+			check: func(t *testing.T, req *OpenAIRequest) {
+				if len(req.Tools) != 2 || req.Tools[0].Type != "function" || req.Tools[0].Function.Name != "ls" {
+					t.Fatalf("tools = %+v", req.Tools)
+				}
+				if _, ok := req.Tools[0].Function.Parameters["$schema"]; ok {
+					t.Fatalf("$schema should be stripped: %+v", req.Tools[0].Function.Parameters)
+				}
+				if req.Tools[1].Function.Parameters["type"] != "object" {
+					t.Fatalf("missing schema should default to object: %+v", req.Tools[1].Function.Parameters)
+				}
+				choice, ok := req.ToolChoice.(map[string]any)
+				if !ok || choice["type"] != "function" {
+					t.Fatalf("tool_choice = %#v", req.ToolChoice)
+				}
+				if req.ParallelToolCalls == nil || *req.ParallelToolCalls {
+					t.Fatalf("parallel_tool_calls = %v, want false", req.ParallelToolCalls)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := ConvertAnthropicToOpenAI(context.Background(), decodeAnthropicRequest(t, tt.body))
+			if err != nil {
+				t.Fatalf("ConvertAnthropicToOpenAI: %v", err)
+			}
+			tt.check(t, req)
+		})
+	}
+}
+
+func TestConvertToolResultFormats(t *testing.T) {
+	done := FallbackText(FallbackEmptyToolResult)
+	tests := []struct {
+		name       string
+		block      string // user消息中的工具结果块
+		wantID     string // 为空时期望生成unknown_tool_前缀的ID
+		wantText   string
+		wantImages int
+	}{
+		{name: "non-standard content string", block: `{"toolResult":{"tool_call_id":"call_1","content":"ok"}}`, wantID: "call_1", wantText: "ok"},
+		{name: "non-standard content blocks", block: `{"toolResult":{"tool_use_id":"call_1","content":[{"type":"text","text":"a"},{"type":"text","text":"b"}]}}`, wantID: "call_1", wantText: "ab"},
+		{name: "non-standard renderer only", block: `{"toolResult":{"tool_call_id":"call_1","renderer":{"value":"rendered"}}}`, wantID: "call_1", wantText: "rendered"},
+		{name: "non-standard no content falls back to renderer", block: `{"toolResult":{"tool_call_id":"call_1","content":" (No content) ","renderer":{"value":"rendered"}}}`, wantID: "call_1", wantText: "rendered"},
+		{name: "non-standard no content anywhere", block: `{"toolResult":{"tool_call_id":"call_1","content":"(No content)","renderer":{"value":"(No content)"}}}`, wantID: "call_1", wantText: done},
+		{name: "non-standard id from outer block", block: `{"tool_use_id":"call_2","toolResult":{"content":"ok"}}`, wantID: "call_2", wantText: "ok"},
+		{name: "non-standard missing id", block: `{"toolResult":{"content":"ok"}}`, wantText: "ok"},
+		{
+			name:       "non-standard image forwarded like standard",
+			block:      `{"toolResult":{"tool_call_id":"call_1","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}]}}`,
+			wantID:     "call_1",
+			wantText:   FallbackText(FallbackToolResultImage),
+			wantImages: 1,
+		},
+		{name: "standard content", block: `{"type":"tool_result","tool_use_id":"call_1","content":"ok"}`, wantID: "call_1", wantText: "ok"},
+		{name: "standard no content placeholder", block: `{"type":"tool_result","tool_use_id":"call_1","content":"(No content)"}`, wantID: "call_1", wantText: done},
+		{name: "standard missing id", block: `{"type":"tool_result","content":""}`, wantText: done},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CODEBUDDY2CC_FORWARD_TOOL_IMAGES", "1")
+			body := `{"model":"m","messages":[{"role":"user","content":[` + tt.block + `]}]}`
+			req, err := ConvertAnthropicToOpenAI(context.Background(), decodeAnthropicRequest(t, body))
+			if err != nil {
+				t.Fatalf("ConvertAnthropicToOpenAI: %v", err)
+			}
+
+			var tools []OpenAIMessage
+			images := 0
+			for _, msg := range req.Messages {
+				switch msg.Role {
+				case "tool":
+					tools = append(tools, msg)
+				case "user":
+					if blocks, ok := msg.Content.([]ContentBlock); ok {
+						for _, block := range blocks {
+							if block.Type == "image_url" {
+								images++
+							}
+						}
+					}
+				}
+			}
+			if len(tools) != 1 {
+				t.Fatalf("tool messages = %+v, want exactly one", req.Messages)
+			}
+			if tt.wantID != "" && tools[0].ToolCallID != tt.wantID {
+				t.Fatalf("tool_call_id = %q, want %q", tools[0].ToolCallID, tt.wantID)
+			}
+			if tt.wantID == "" && !strings.HasPrefix(tools[0].ToolCallID, "unknown_tool_") {
+				t.Fatalf("tool_call_id = %q, want generated unknown_tool_ ID", tools[0].ToolCallID)
+			}
+			if tools[0].Content != tt.wantText {
+				t.Fatalf("tool content = %q, want %q", tools[0].Content, tt.wantText)
+			}
+			if images != tt.wantImages {
+				t.Fatalf("forwarded images = %d, want %d", images, tt.wantImages)
+			}
+		})
+	}
+}
+
+func TestFallbackTextScenariosUseConfiguredText(t *testing.T) {
+	scenarios := []FallbackScenario{
+		FallbackEmptyToolResult, FallbackUnknownToolResult, FallbackToolCallNoContent,
+		FallbackToolUseNoContent, FallbackEmptyContent, FallbackToolResultImage,
+	}
+	for _, scenario := range scenarios {
+		t.Setenv(fallbackEnvKey(scenario), "custom "+string(scenario))
+	}
+
+	toolUse := `{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"ls","input":{}}]}`
+	toolResult := func(content string) string {
+		return `{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":` + content + `}]}`
+	}
+	tests := []struct {
+		name     string
+		messages string
+		role     string
+		want     string
+	}{
+		{name: "empty tool result", messages: toolUse + "," + toolResult(`""`), role: "tool", want: "custom empty-tool-result"},
+		{name: "unknown tool result", messages: toolUse + "," + toolResult(`{"rows":3}`), role: "tool", want: "custom unknown-tool-result"},
+		{
+			name:     "tool calls without content",
+			messages: `{"role":"assistant","content":"","tool_calls":[{"id":"call_1","type":"function","function":{"name":"ls","arguments":"{}"}}]}`,
+			role:     "assistant",
+			want:     "custom tool-call-no-content",
+		},
+		{name: "tool use without content", messages: toolUse + "," + toolResult(`"ok"`), role: "assistant", want: "custom tool-use-no-content"},
+		{name: "empty content", messages: `{"role":"user","content":{"note":"unrecognized"}}`, role: "user", want: "custom empty-content"},
+		{
+			name:     "tool result image",
+			messages: toolUse + "," + toolResult(`[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}]`),
+			role:     "tool",
+			want:     "custom tool-result-image",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"model":"m","messages":[{"role":"user","content":"go"},` + tt.messages + `]}`
+			req, err := ConvertAnthropicToOpenAI(context.Background(), decodeAnthropicRequest(t, body))
+			if err != nil {
+				t.Fatalf("ConvertAnthropicToOpenAI: %v", err)
+			}
+			var got []string
+			for _, msg := range req.Messages {
+				if msg.Role == tt.role {
+					got = append(got, messageTexts(t, msg)...)
+				}
+			}
+			if !slices.Contains(got, tt.want) {
+				t.Fatalf("%s texts = %q, want one to be %q", tt.role, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertOpenAIStreamToAnthropic(t *testing.T) {
+	tests := []struct {
+		name  string
+		chunk string
+		want  string // 期望输出包含的片段，为空表示期望空输出
+	}{
+		{name: "comment line ignored", chunk: ": keep-alive", want: ""},
+		{name: "done passthrough", chunk: "data: [DONE]", want: "data: [DONE]"},
+		{name: "text delta", chunk: `data: {"choices":[{"delta":{"content":"hi"}}]}`, want: `"delta":{"text":"hi","type":"text_delta"}`},
+		{name: "finish reason signal", chunk: `data: {"choices":[{"delta":{},"finish_reason":"tool_calls"}]}`, want: "internal:finish_reason:tool_calls"},
+		{name: "tool calls signal", chunk: `data: {"choices":[{"delta":{"tool_calls":[{"id":"call_1","type":"function","function":{"name":"ls","arguments":"{}"}}]}}]}`, want: `internal:tool_calls:[{"id":"call_1"`},
+		{name: "empty choices ignored", chunk: `data: {"choices":[]}`, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ConvertOpenAIStreamToAnthropic(tt.chunk)
+			if err != nil {
+				t.Fatalf("ConvertOpenAIStreamToAnthropic: %v", err)
+			}
+			if (tt.want == "" && got != "") || !strings.Contains(got, tt.want) {
+				t.Fatalf("output = %q, want containing %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ConvertOpenAIStreamToAnthropic("data: {not json"); err == nil {
+		t.Fatal("malformed chunk should return an error")
+	}
+}
+
+func TestAnthropicSSEFormatter(t *testing.T) {
+	formatter := NewAnthropicSSEFormatter()
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{name: "text block start", got: formatter.FormatContentBlockStart(0, "text", nil), want: `"content_block":{"text":"","type":"text"}`},
+		{name: "tool block start", got: formatter.FormatContentBlockStart(1, "tool_use", map[string]any{"id": "toolu_1", "name": "ls", "input": map[string]any{}}), want: `"id":"toolu_1"`},
+		{name: "text delta", got: formatter.FormatContentBlockDelta(0, "text_delta", "hi"), want: `"delta":{"text":"hi","type":"text_delta"}`},
+		{name: "input json delta", got: formatter.FormatContentBlockDelta(1, "input_json_delta", `{"a":`), want: `"partial_json":"{\"a\":"`},
+		{name: "thinking delta", got: formatter.FormatContentBlockDelta(0, "thinking_delta", "hmm"), want: `"thinking":"hmm"`},
+		{name: "thinking block start", got: formatter.FormatContentBlockStart(0, "thinking", nil), want: `"content_block":{"signature":"","thinking":"","type":"thinking"}`},
+		{name: "signature delta", got: formatter.FormatContentBlockDelta(0, "signature_delta", "sig"), want: `"delta":{"signature":"sig","type":"signature_delta"}`},
+		{name: "message delta usage", got: formatter.FormatMessageDelta("end_turn", &Usage{CompletionTokens: 7}), want: `"usage":{"output_tokens":7}`},
+		{name: "error event", got: formatter.FormatError("api_error", "boom"), want: "event: error\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(tt.got, tt.want) || !strings.HasSuffix(tt.got, "\n\n") {
+				t.Fatalf("event = %q, want containing %q", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThinkingBlockMarshalIncludesSignature(t *testing.T) {
+	tests := []struct {
+		block ContentBlock
+		want  string
+	}{
+		{block: ContentBlock{Type: "thinking", Thinking: "plan", Signature: "sig"}, want: `{"type":"thinking","thinking":"plan","signature":"sig"}`},
+		{block: ContentBlock{Type: "thinking", Thinking: "plan"}, want: `{"type":"thinking","thinking":"plan","signature":""}`},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.block)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		var got, want any
+		json.Unmarshal(data, &got)
+		json.Unmarshal([]byte(tt.want), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("marshal = %s, want %s", data, tt.want)
+		}
+	}
+}
+
+func TestConvertOmitsToolsWhenNoneProvided(t *testing.T) {
+	tests := []struct {
+		name  string
+		tools string // 请求JSON中tools字段的片段，空表示不携带
+	}{
+		{name: "tools absent"},
+		{name: "tools null", tools: `,"tools":null`},
+		{name: "tools empty array", tools: `,"tools":[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"model":"m","messages":[{"role":"user","content":"hi"}]` + tt.tools + `}`
+			req, err := ConvertAnthropicToOpenAI(context.Background(), decodeAnthropicRequest(t, body))
+			if err != nil {
+				t.Fatalf("ConvertAnthropicToOpenAI: %v", err)
+			}
+			data, err := FastMarshal(req)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			for _, key := range []string{"tools", "tool_choice", "parallel_tool_calls"} {
+				if raw, ok := fields[key]; ok {
+					t.Fatalf("serialized request has %q: %s", key, raw)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertStripAgent(t *testing.T) {
+	body := `{"model":"m","messages":[` +
+		`{"role":"user","content":"hi","agent":"planner"},` +
+		`{"role":"assistant","content":"hello","agent":"planner"},` +
+		`{"role":"user","content":"again","agent":"planner"}]}`
+	tests := []struct {
+		name      string
+		strip     string
+		wantAgent bool
+	}{
+		{name: "kept by default", strip: "", wantAgent: true},
+		{name: "stripped when enabled", strip: "1", wantAgent: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CODEBUDDY2CC_STRIP_AGENT", tt.strip)
+			req, err := ConvertAnthropicToOpenAI(context.Background(), decodeAnthropicRequest(t, body))
+			if err != nil {
+				t.Fatalf("ConvertAnthropicToOpenAI: %v", err)
+			}
+			data, err := FastMarshal(req)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			var decoded struct {
+				Messages []map[string]json.RawMessage `json:"messages"`
+			}
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			agents := 0
+			for _, msg := range decoded.Messages {
+				if _, ok := msg["agent"]; ok {
+					agents++
+				}
+			}
+			if tt.wantAgent && agents != 3 {
+				t.Fatalf("%d of 3 client messages kept agent: %s", agents, data)
+			}
+			if !tt.wantAgent && agents != 0 {
+				t.Fatalf("serialized request still has agent: %s", data)
+			}
+		})
+	}
+}
+
+func TestMessageDeltaCacheFields(t *testing.T) {
+	tests := []struct {
+		name       string
+		always     string
+		usage      Usage
+		wantFields map[string]float64 // 期望出现的cache字段，未列出的字段不应出现
+	}{
+		{name: "omitted when zero", usage: Usage{OutputTokens: 5}, wantFields: map[string]float64{}},
+		{name: "present when non-zero", usage: Usage{OutputTokens: 5, CacheReadInputTokens: 7}, wantFields: map[string]float64{"cache_read_input_tokens": 7}},
+		{name: "always present when zero", always: "1", usage: Usage{OutputTokens: 5},
+			wantFields: map[string]float64{"cache_creation_input_tokens": 0, "cache_read_input_tokens": 0}},
+		{name: "always present keeps values", always: "1", usage: Usage{OutputTokens: 5, CacheCreationInputTokens: 3},
+			wantFields: map[string]float64{"cache_creation_input_tokens": 3, "cache_read_input_tokens": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CODEBUDDY2CC_ALWAYS_CACHE_FIELDS", tt.always)
+			event := NewAnthropicSSEFormatter().FormatMessageDelta("end_turn", &tt.usage)
+
+			_, data, ok := strings.Cut(strings.TrimSpace(event), "data: ")
+			if !ok {
+				t.Fatalf("event = %q, want data line", event)
+			}
+			var delta struct {
+				Usage map[string]float64 `json:"usage"`
+			}
+			if err := json.Unmarshal([]byte(data), &delta); err != nil {
+				t.Fatalf("decode %q: %v", data, err)
+			}
+			if delta.Usage["output_tokens"] != 5 {
+				t.Fatalf("usage = %v, want output_tokens 5", delta.Usage)
+			}
+			for _, key := range []string{"cache_creation_input_tokens", "cache_read_input_tokens"} {
+				got, present := delta.Usage[key]
+				want, wantPresent := tt.wantFields[key]
+				if present != wantPresent || got != want {
+					t.Fatalf("usage[%s] = %v (present %v), want %v (present %v)", key, got, present, want, wantPresent)
+				}
+			}
+		})
+	}
+}
+
+// useModelMapping 在临时目录写入model.json并加载，测试结束后恢复原映射
+func useModelMapping(t *testing.T, config string) {
+	t.Helper()
+	t.Cleanup(func() { LoadModelMapping() })
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("model.json", []byte(config), 0o644); err != nil {
+		t.Fatalf("write model.json: %v", err)
+	}
+	if err := LoadModelMapping(); err != nil {
+		t.Fatalf("LoadModelMapping: %v", err)
+	}
+}
+
+func TestParallelToolCallsDefaultFromModelMetadata(t *testing.T) {
+	useModelMapping(t, `{
+		"models": {"claude-serial": "serial-upstream"},
+		"metadata": {"serial-upstream": {"parallel_tool_calls": false}}
+	}`)
+	const tools = `"tools":[{"name":"ls","input_schema":{"type":"object"}}]`
+	serial, parallel := false, true
+
+	tests := []struct {
+		name string
+		body string
+		want *bool
+	}{
+		{
+			name: "metadata disables parallel calls by default",
+			body: `{"model":"claude-serial","messages":[{"role":"user","content":"go"}],` + tools + `}`,
+			want: &serial,
+		},
+		{
+			name: "client setting wins over metadata",
+			body: `{"model":"claude-serial","messages":[{"role":"user","content":"go"}],` + tools +
+				`,"tool_choice":{"type":"auto","disable_parallel_tool_use":false}}`,
+			want: &parallel,
+		},
+		{
+			name: "unconfigured model leaves upstream default",
+			body: `{"model":"other","messages":[{"role":"user","content":"go"}],` + tools + `}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := ConvertAnthropicToOpenAI(context.Background(), decodeAnthropicRequest(t, tt.body))
+			if err != nil {
+				t.Fatalf("ConvertAnthropicToOpenAI: %v", err)
+			}
+			if !reflect.DeepEqual(req.ParallelToolCalls, tt.want) {
+				t.Fatalf("parallel_tool_calls = %v, want %v", req.ParallelToolCalls, tt.want)
+			}
+
+			data, err := FastMarshal(req)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if wantFalse := tt.want != nil && !*tt.want; wantFalse != strings.Contains(string(data), `"parallel_tool_calls":false`) {
+				t.Fatalf("serialized request = %s", data)
+			}
+		})
+	}
+}
+
+// toolPairingMessages 由简写构造消息："user"、"assistant:id1,id2"（带tool_calls）、"tool:id"
+func toolPairingMessages(specs ...string) []OpenAIMessage {
+	messages := make([]OpenAIMessage, 0, len(specs))
+	for _, spec := range specs {
+		role, ids, _ := strings.Cut(spec, ":")
+		msg := OpenAIMessage{Role: role, Content: spec}
+		switch role {
+		case "assistant":
+			for id := range strings.SplitSeq(ids, ",") {
+				if id != "" {
+					msg.ToolCalls = append(msg.ToolCalls, OpenAIToolCall{ID: id, Type: "function"})
+				}
+			}
+		case "tool":
+			msg.ToolCallID = ids
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func TestPairToolMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{
+			name: "already paired",
+			in:   []string{"user", "assistant:a,b", "tool:a", "tool:b", "user:next"},
+			want: []string{"user", "assistant:a,b", "tool:a", "tool:b", "user:next"},
+		},
+		{
+			name: "tool result moved before intervening message",
+			in:   []string{"user", "assistant:a", "user:interjection", "tool:a"},
+			want: []string{"user", "assistant:a", "tool:a", "user:interjection"},
+		},
+		{
+			name: "tool results follow tool_calls order",
+			in:   []string{"assistant:a,b", "tool:b", "tool:a"},
+			want: []string{"assistant:a,b", "tool:a", "tool:b"},
+		},
+		{
+			name: "orphan tool result stays in place",
+			in:   []string{"user", "tool:orphan", "assistant:a", "tool:a"},
+			want: []string{"user", "tool:orphan", "assistant:a", "tool:a"},
+		},
+		{
+			name: "reused id pairs with the next assistant turn",
+			in:   []string{"assistant:a", "tool:a", "user:again", "assistant:a", "user:late", "tool:a"},
+			want: []string{"assistant:a", "tool:a", "user:again", "assistant:a", "tool:a", "user:late"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pairToolMessages(context.Background(), toolPairingMessages(tt.in...))
+			specs := make([]string, len(got))
+			for i, msg := range got {
+				specs[i] = msg.Content.(string)
+			}
+			if !reflect.DeepEqual(specs, tt.want) {
+				t.Fatalf("order = %q, want %q", specs, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertKeepsToolResultsAfterToolCalls(t *testing.T) {
+	body := `{"model":"m","messages":[{"role":"user","content":"list"},` +
+		`{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"ls","input":{}}]},` +
+		`{"role":"assistant","content":[{"type":"tool_use","id":"toolu_2","name":"pwd","input":{}}]},` +
+		`{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_2","content":"/tmp"},{"type":"tool_result","tool_use_id":"toolu_1","content":"a.go"}]}]}`
+	req, err := ConvertAnthropicToOpenAI(context.Background(), decodeAnthropicRequest(t, body))
+	if err != nil {
+		t.Fatalf("ConvertAnthropicToOpenAI: %v", err)
+	}
+
+	calls := 0
+	for i, msg := range req.Messages {
+		if msg.Role != "assistant" || len(msg.ToolCalls) == 0 {
+			continue
+		}
+		for k, call := range msg.ToolCalls {
+			calls++
+			next := i + 1 + k
+			if next >= len(req.Messages) || req.Messages[next].Role != "tool" || req.Messages[next].ToolCallID != call.ID {
+				t.Fatalf("tool call %s not followed by its result: %+v", call.ID, req.Messages)
+			}
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("converted %d tool calls, want 2: %+v", calls, req.Messages)
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -74,12 +75,26 @@ func writeToDebugFile(content string) {
 	}
 }
 
+// WriteDebugFileRaw 在debug模式下将内容原样写入debug文件（不输出到控制台）
+func WriteDebugFileRaw(content string) {
+	if !debugMode {
+		return
+	}
+	writeToDebugFile(content)
+}
+
 // DebugLogJSON 在debug模式下输出JSON格式的调试信息
 func DebugLogJSON(prefix string, data interface{}) {
 	if !debugMode {
 		return
 	}
 
+	if jsonLogFormat {
+		requestID, msg := splitRequestIDPrefix(prefix)
+		writeJSONLog(formatJSONLog("debug", requestID, msg, map[string]any{"data": data}), true)
+		return
+	}
+
 	jsonData, err := PrettyMarshal(data)
 	if err != nil {
 		message := fmt.Sprintf("[DEBUG] %s: Failed to marshal JSON: %v", prefix, err)
@@ -93,23 +108,66 @@ func DebugLogJSON(prefix string, data interface{}) {
 	writeToDebugFile(message)
 }
 
+// DebugLogJSONCtx 带请求上下文的JSON调试日志，context中含请求ID时自动添加[Request:id]前缀
+func DebugLogJSONCtx(ctx context.Context, prefix string, data interface{}) {
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		prefix = "[Request:" + requestID + "] " + prefix
+	}
+	DebugLogJSON(prefix, data)
+}
+
 // DebugLog 在debug模式下输出普通调试信息
 func DebugLog(format string, args ...interface{}) {
 	if !debugMode {
 		return
 	}
 
-	message := fmt.Sprintf("[DEBUG] "+format, args...)
+	message := fmt.Sprintf(format, args...)
+	if jsonLogFormat {
+		requestID, msg := splitRequestIDPrefix(message)
+		writeJSONLog(formatJSONLog("debug", requestID, msg, nil), true)
+		return
+	}
+
+	message = "[DEBUG] " + message
 	log.Printf("%s", message)
 	writeToDebugFile(message)
 }
 
+// DebugLogCtx 带请求上下文的调试日志，context中含请求ID时自动添加[Request:id]前缀
+func DebugLogCtx(ctx context.Context, format string, args ...interface{}) {
+	if !debugMode {
+		return
+	}
+
+	requestID := RequestIDFromContext(ctx)
+	if jsonLogFormat {
+		writeJSONLog(formatJSONLog("debug", requestID, fmt.Sprintf(format, args...), nil), true)
+		return
+	}
+
+	if requestID != "" {
+		format = "[Request:" + requestID + "] " + format
+	}
+	DebugLog(format, args...)
+}
+
 // DebugLogToolCall 专门用于工具调用的调试日志，包含更多上下文信息
 func DebugLogToolCall(sessionID, action, toolID string, stats map[string]int, extra ...interface{}) {
 	if !debugMode {
 		return
 	}
 
+	if jsonLogFormat {
+		fields := map[string]any{"action": action, "tool_id": toolID, "stats": stats}
+		if len(extra) > 0 {
+			fields["extra"] = fmt.Sprintf("%+v", extra)
+		}
+		// 会话ID即请求ID
+		writeJSONLog(formatJSONLog("debug", sessionID, "[ToolCall]", fields), true)
+		return
+	}
+
 	var extraInfo string
 	if len(extra) > 0 {
 		extraInfo = fmt.Sprintf(" | extra: %+v", extra)
@@ -127,6 +185,15 @@ func DebugLogError(context string, err error, details ...interface{}) {
 		return
 	}
 
+	if jsonLogFormat {
+		fields := map[string]any{"context": context, "error": fmt.Sprint(err)}
+		if len(details) > 0 {
+			fields["details"] = fmt.Sprintf("%+v", details)
+		}
+		writeJSONLog(formatJSONLog("error", "", "[ERROR]", fields), true)
+		return
+	}
+
 	var detailsStr string
 	if len(details) > 0 {
 		detailsStr = fmt.Sprintf(" | details: %+v", details)
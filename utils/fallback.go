@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"os"
+	"strings"
+)
+
+// FallbackScenario 需要填充默认文本的场景（上游通常拒绝空content）
+type FallbackScenario string
+
+const (
+	// FallbackEmptyToolResult 工具结果内容为空
+	FallbackEmptyToolResult FallbackScenario = "empty-tool-result"
+	// FallbackUnknownToolResult 工具结果内容格式无法识别
+	FallbackUnknownToolResult FallbackScenario = "unknown-tool-result"
+	// FallbackToolCallNoContent 带tool_calls的assistant消息没有文本，{tool}替换为首个工具名
+	FallbackToolCallNoContent FallbackScenario = "tool-call-no-content"
+	// FallbackToolUseNoContent tool_use转换后的assistant消息没有文本
+	FallbackToolUseNoContent FallbackScenario = "tool-use-no-content"
+	// FallbackEmptyContent 消息内容块全部被过滤或格式无法识别
+	FallbackEmptyContent FallbackScenario = "empty-content"
+	// FallbackEmptyResponse 上游响应没有任何有效内容
+	FallbackEmptyResponse FallbackScenario = "empty-response"
+	// FallbackToolResultImage 工具结果中的图片块在文本中的占位说明（tool消息只能携带文本）
+	FallbackToolResultImage FallbackScenario = "tool-result-image"
+)
+
+// fallbackCatalogs 内置默认文本，按 CODEBUDDY2CC_FALLBACK_LANG 选择（默认zh）
+var fallbackCatalogs = map[string]map[FallbackScenario]string{
+	"zh": {
+		FallbackEmptyToolResult:   "工具调用完成",
+		FallbackUnknownToolResult: "工具执行完成",
+		FallbackToolCallNoContent: "调用{tool}工具",
+		FallbackToolUseNoContent:  "正在使用工具",
+		FallbackEmptyContent:      "工具调用完成",
+		FallbackEmptyResponse:     "处理完成",
+		FallbackToolResultImage:   "[工具返回了图片]",
+	},
+	"en": {
+		FallbackEmptyToolResult:   "Tool call completed",
+		FallbackUnknownToolResult: "Tool execution completed",
+		FallbackToolCallNoContent: "Calling {tool} tool",
+		FallbackToolUseNoContent:  "Using tools",
+		FallbackEmptyContent:      "Tool call completed",
+		FallbackEmptyResponse:     "Done",
+		FallbackToolResultImage:   "[Tool returned an image]",
+	},
+}
+
+// fallbackGroupEnvKeys 一次覆盖多个场景的简写环境变量，优先级低于按场景的覆盖
+var fallbackGroupEnvKeys = map[FallbackScenario]string{
+	FallbackEmptyResponse:     "CODEBUDDY2CC_DEFAULT_TEXT",
+	FallbackEmptyToolResult:   "CODEBUDDY2CC_TOOL_DONE_TEXT",
+	FallbackUnknownToolResult: "CODEBUDDY2CC_TOOL_DONE_TEXT",
+	FallbackEmptyContent:      "CODEBUDDY2CC_TOOL_DONE_TEXT",
+	FallbackToolUseNoContent:  "CODEBUDDY2CC_TOOL_USE_TEXT",
+}
+
+// fallbackEnvKey 场景对应的覆盖环境变量，如 empty-tool-result -> CODEBUDDY2CC_FALLBACK_EMPTY_TOOL_RESULT
+func fallbackEnvKey(scenario FallbackScenario) string {
+	return "CODEBUDDY2CC_FALLBACK_" + strings.ToUpper(strings.ReplaceAll(string(scenario), "-", "_"))
+}
+
+// FallbackText 返回场景的默认文本：按场景的环境变量覆盖优先，其次简写环境变量，最后按语言选择内置文本
+func FallbackText(scenario FallbackScenario) string {
+	if text := os.Getenv(fallbackEnvKey(scenario)); strings.TrimSpace(text) != "" {
+		return text
+	}
+	if key, ok := fallbackGroupEnvKeys[scenario]; ok {
+		if text := os.Getenv(key); strings.TrimSpace(text) != "" {
+			return text
+		}
+	}
+
+	lang := strings.ToLower(strings.TrimSpace(os.Getenv("CODEBUDDY2CC_FALLBACK_LANG")))
+	catalog, ok := fallbackCatalogs[lang]
+	if !ok {
+		catalog = fallbackCatalogs["zh"]
+	}
+	return catalog[scenario]
+}
+
+// FallbackToolCallText 返回工具调用无文本时的默认文本，{tool}替换为工具名
+func FallbackToolCallText(toolName string) string {
+	return strings.ReplaceAll(FallbackText(FallbackToolCallNoContent), "{tool}", toolName)
+}
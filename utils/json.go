@@ -49,7 +49,20 @@ func FastUnmarshal(data []byte, v any) error {
 	return JSON.Unmarshal(data, v)
 }
 
+// numberPreservingAPI 将any中的数字解码为json.Number的sonic配置
+var numberPreservingAPI = sonic.Config{UseNumber: true}.Froze()
+
+// FastUnmarshalUseNumber 反序列化时将any中的数字保留为json.Number，避免大整数和小数经float64转换失真
+func FastUnmarshalUseNumber(data []byte, v any) error {
+	return numberPreservingAPI.Unmarshal(data, v)
+}
+
 // PrettyMarshal 格式化序列化，用于调试和日志输出
 func PrettyMarshal(v any) ([]byte, error) {
 	return JSON.MarshalIndent(v, "", "  ")
 }
+
+// FastValid 快速校验数据是否为合法JSON，不进行反序列化
+func FastValid(data []byte) bool {
+	return sonic.Valid(data)
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestIDKey gin上下文中保存请求ID的键，供请求日志中间件关联同一请求的日志
+const RequestIDKey = "codebuddy2cc_request_id"
+
+// UserIDKey gin上下文中保存客户端metadata.user_id的键，用于按用户归属请求日志
+const UserIDKey = "codebuddy2cc_user_id"
+
+// AuthSubjectKey gin上下文中保存已验证JWT的sub的键
+const AuthSubjectKey = "codebuddy2cc_auth_subject"
+
+// AuthClaimsKey gin上下文中保存已验证JWT全部claims（map[string]any）的键
+const AuthClaimsKey = "codebuddy2cc_auth_claims"
+
+// 结构化日志状态
+var (
+	jsonLogFormat bool
+	jsonLogMu     sync.Mutex
+	jsonLogOutput io.Writer = os.Stderr
+)
+
+// InitLogFormat 读取 CODEBUDDY2CC_LOG_FORMAT 配置日志格式，json 表示每行输出一个JSON对象，默认text
+// JSON模式下标准库log的输出也会被转换为JSON行，保证日志聚合时格式统一
+func InitLogFormat() {
+	format := strings.ToLower(strings.TrimSpace(os.Getenv("CODEBUDDY2CC_LOG_FORMAT")))
+	jsonLogFormat = format == "json"
+
+	if jsonLogFormat {
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{})
+		return
+	}
+	if format != "" && format != "text" {
+		log.Printf("Warning: unknown CODEBUDDY2CC_LOG_FORMAT %q, using text", format)
+	}
+}
+
+// IsJSONLogFormat 是否启用结构化JSON日志
+func IsJSONLogFormat() bool {
+	return jsonLogFormat
+}
+
+// LogJSON 输出一行结构化日志，fields中的字段附加在level/ts/request_id/msg之后
+func LogJSON(level, requestID, msg string, fields map[string]any) {
+	writeJSONLog(formatJSONLog(level, requestID, msg, fields), false)
+}
+
+// InfoLogCtx 输出info级别日志（不受DEBUG开关影响），context中含请求ID时自动关联请求
+func InfoLogCtx(ctx context.Context, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	requestID := RequestIDFromContext(ctx)
+	if jsonLogFormat {
+		LogJSON("info", requestID, message, nil)
+		return
+	}
+	if requestID != "" {
+		message = "[Request:" + requestID + "] " + message
+	}
+	log.Printf("%s", message)
+}
+
+// formatJSONLog 将日志条目编码为以换行结尾的JSON行
+func formatJSONLog(level, requestID, msg string, fields map[string]any) []byte {
+	entry := make(map[string]any, len(fields)+4)
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["level"] = level
+	entry["ts"] = time.Now().Format(time.RFC3339Nano)
+	entry["msg"] = msg
+	if requestID != "" {
+		entry["request_id"] = requestID
+	}
+
+	line, err := FastMarshal(entry)
+	if err != nil {
+		// 附加字段无法序列化时退化为只输出消息文本
+		entry["msg"] = msg + " (fields not serializable: " + err.Error() + ")"
+		for k := range fields {
+			delete(entry, k)
+		}
+		line, _ = FastMarshal(entry)
+	}
+	return append(line, '\n')
+}
+
+// writeJSONLog 写出一行JSON日志，toDebugFile为true时同时写入debug文件
+func writeJSONLog(line []byte, toDebugFile bool) {
+	jsonLogMu.Lock()
+	defer jsonLogMu.Unlock()
+	jsonLogOutput.Write(line)
+	if toDebugFile && debugFile != nil {
+		debugFile.Write(line)
+	}
+}
+
+// splitRequestIDPrefix 拆分消息开头的"[Request:id] "前缀，返回请求ID和剩余消息
+func splitRequestIDPrefix(msg string) (string, string) {
+	rest, ok := strings.CutPrefix(msg, "[Request:")
+	if !ok {
+		return "", msg
+	}
+	end := strings.IndexByte(rest, ']')
+	if end < 0 {
+		return "", msg
+	}
+	return rest[:end], strings.TrimPrefix(rest[end+1:], " ")
+}
+
+// jsonLogWriter 将标准库log的文本输出转换为JSON行，"Warning:"开头的消息记为warn级别
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	level := "info"
+	if strings.HasPrefix(msg, "Warning:") {
+		level = "warn"
+	}
+	requestID, msg := splitRequestIDPrefix(msg)
+	LogJSON(level, requestID, msg, nil)
+	return len(p), nil
+}
@@ -1,70 +1,502 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 type ModelMapping struct {
 	Models map[string]string `json:"models"`
+	// Metadata 模型元数据，键可以是客户端模型名或映射后的上游模型名
+	Metadata map[string]ModelMetadata `json:"metadata,omitempty"`
+	// Default 没有任何映射命中时使用的默认上游模型，为空时使用 CODEBUDDY2CC_DEFAULT_MODEL，均为空则原样透传
+	Default string `json:"default,omitempty"`
+	// Upstreams 按映射后的上游模型名指定上游地址，未配置的模型使用全局上游地址
+	Upstreams map[string]string `json:"upstreams,omitempty"`
+	// NoSystemInjection 不注入CodeBuddy system后缀的上游模型名列表（映射后的模型名，如推理模型）
+	NoSystemInjection []string `json:"no_system_injection,omitempty"`
+
+	// patterns 由 re: 前缀或 * 通配符键编译而来的匹配规则，按键名排序
+	patterns []modelPattern
+}
+
+// ModelMetadata 单个模型的元数据
+type ModelMetadata struct {
+	ContextWindow int `json:"context_window,omitempty"` // 上下文窗口大小（token）
+	// ParallelToolCalls 客户端未指定时的并行工具调用默认值，nil表示不设置
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+}
+
+// modelPattern 单条正则/通配符映射规则
+type modelPattern struct {
+	key    string
+	re     *regexp.Regexp
+	target string
+}
+
+// modelRegexPrefix 正则映射键前缀
+const modelRegexPrefix = "re:"
+
+var (
+	modelMapping   *ModelMapping
+	modelMappingMu sync.RWMutex
+
+	// modelMappingModTime 最近一次成功加载的model.json修改时间，用于热加载检测
+	modelMappingModTime time.Time
+	modelWatcherOnce    sync.Once
+
+	// defaultModelLogged 已输出过默认模型回退日志的客户端模型，避免每个请求重复输出
+	defaultModelLogged sync.Map
+)
+
+// modelMappingPath model.json配置文件路径
+func modelMappingPath() string {
+	return filepath.Join(".", "model.json")
+}
+
+// setModelMapping 原子替换当前模型映射
+func setModelMapping(mapping *ModelMapping, modTime time.Time) {
+	modelMappingMu.Lock()
+	modelMapping = mapping
+	modelMappingModTime = modTime
+	modelMappingMu.Unlock()
+}
+
+// currentModelMapping 获取当前模型映射，未加载时先加载
+func currentModelMapping() *ModelMapping {
+	modelMappingMu.RLock()
+	mapping := modelMapping
+	modelMappingMu.RUnlock()
+
+	if mapping == nil {
+		LoadModelMapping()
+		modelMappingMu.RLock()
+		mapping = modelMapping
+		modelMappingMu.RUnlock()
+	}
+	return mapping
+}
+
+// IsModelPattern 判断映射键是否为正则或通配符规则（而非具体模型ID）
+func IsModelPattern(key string) bool {
+	return strings.HasPrefix(key, modelRegexPrefix) || strings.Contains(key, "*")
+}
+
+// compileModelPattern 将映射键编译为正则：re: 前缀按正则处理，* 通配符转换为捕获组
+func compileModelPattern(key string) (*regexp.Regexp, error) {
+	if expr, ok := strings.CutPrefix(key, modelRegexPrefix); ok {
+		return regexp.Compile(expr)
+	}
+
+	parts := strings.Split(key, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.Compile("^" + strings.Join(parts, "(.*)") + "$")
+}
+
+// compilePatterns 编译所有正则/通配符规则，非法规则记录日志后跳过
+func (m *ModelMapping) compilePatterns() {
+	keys := make([]string, 0, len(m.Models))
+	for key := range m.Models {
+		if IsModelPattern(key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	m.patterns = make([]modelPattern, 0, len(keys))
+	for _, key := range keys {
+		re, err := compileModelPattern(key)
+		if err != nil {
+			DebugLog("Invalid model mapping pattern %q skipped: %v", key, err)
+			continue
+		}
+		m.patterns = append(m.patterns, modelPattern{key: key, re: re, target: m.Models[key]})
+	}
 }
 
-var modelMapping *ModelMapping
+// readModelMapping 读取并解析模型映射文件
+func readModelMapping(configPath string) (*ModelMapping, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model mapping file: %w", err)
+	}
+
+	var mapping ModelMapping
+	if err := FastUnmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("failed to parse model mapping file: %w", err)
+	}
+	if mapping.Models == nil {
+		mapping.Models = make(map[string]string)
+	}
+	// 空目标会导致上游收到空model而返回难以排查的400，按原样透传处理
+	for key, target := range mapping.Models {
+		if strings.TrimSpace(target) != "" {
+			continue
+		}
+		if IsModelPattern(key) {
+			log.Printf("Warning: model mapping rule %q has an empty target, ignoring it", key)
+			delete(mapping.Models, key)
+		} else {
+			log.Printf("Warning: model mapping %q has an empty target, treating it as identity", key)
+			mapping.Models[key] = key
+		}
+	}
+	mapping.Default = strings.TrimSpace(mapping.Default)
+	mapping.normalizeKeys()
+	mapping.compilePatterns()
+	return &mapping, nil
+}
+
+// modelNormalizeMode 模型名规范化方式（CODEBUDDY2CC_MODEL_NORMALIZE）
+// 未设置时不处理；trim 去除首尾空白；lower（或true/1/on/yes）去除首尾空白并转为小写
+func modelNormalizeMode() string {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("CODEBUDDY2CC_MODEL_NORMALIZE")))
+	switch mode {
+	case "trim", "lower":
+		return mode
+	case "true", "1", "on", "yes":
+		return "lower"
+	default:
+		return ""
+	}
+}
+
+// NormalizeModelName 按 CODEBUDDY2CC_MODEL_NORMALIZE 规范化模型名，用于映射键与查找时的模型名
+func NormalizeModelName(model string) string {
+	switch modelNormalizeMode() {
+	case "trim":
+		return strings.TrimSpace(model)
+	case "lower":
+		return strings.ToLower(strings.TrimSpace(model))
+	default:
+		return model
+	}
+}
+
+// normalizeKeys 规范化精确映射与元数据的键（正则/通配符规则保持原样），规范化后冲突的键保留先出现的一个
+func (m *ModelMapping) normalizeKeys() {
+	if modelNormalizeMode() == "" {
+		return
+	}
+
+	models := make(map[string]string, len(m.Models))
+	for _, key := range slices.Sorted(maps.Keys(m.Models)) {
+		normalized := key
+		if !IsModelPattern(key) {
+			normalized = NormalizeModelName(key)
+		}
+		if _, exists := models[normalized]; exists {
+			log.Printf("Warning: model mapping %q conflicts with another key after normalization, ignoring it", key)
+			continue
+		}
+		models[normalized] = m.Models[key]
+	}
+	m.Models = models
+
+	if len(m.Metadata) > 0 {
+		metadata := make(map[string]ModelMetadata, len(m.Metadata))
+		for _, key := range slices.Sorted(maps.Keys(m.Metadata)) {
+			if _, exists := metadata[NormalizeModelName(key)]; !exists {
+				metadata[NormalizeModelName(key)] = m.Metadata[key]
+			}
+		}
+		m.Metadata = metadata
+	}
+}
 
 // LoadModelMapping 加载模型映射配置
 func LoadModelMapping() error {
 	// 获取配置文件路径
-	configPath := filepath.Join(".", "model.json")
+	configPath := modelMappingPath()
 
 	// 检查文件是否存在
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+	info, err := os.Stat(configPath)
+	if os.IsNotExist(err) {
 		DebugLog("Model mapping file not found: %s, using original models", configPath)
-		modelMapping = &ModelMapping{Models: make(map[string]string)}
+		setModelMapping(&ModelMapping{Models: make(map[string]string)}, time.Time{})
 		return nil
 	}
 
-	// 读取文件内容
-	data, err := os.ReadFile(configPath)
+	mapping, err := readModelMapping(configPath)
 	if err != nil {
-		DebugLog("Failed to read model mapping file: %v", err)
-		modelMapping = &ModelMapping{Models: make(map[string]string)}
+		DebugLog("%v", err)
+		setModelMapping(&ModelMapping{Models: make(map[string]string)}, time.Time{})
 		return nil
 	}
 
-	// 解析JSON
-	var mapping ModelMapping
-	if err := FastUnmarshal(data, &mapping); err != nil {
-		DebugLog("Failed to parse model mapping file: %v", err)
-		modelMapping = &ModelMapping{Models: make(map[string]string)}
-		return nil
+	var modTime time.Time
+	if info != nil {
+		modTime = info.ModTime()
 	}
-
-	modelMapping = &mapping
-	DebugLog("Model mapping loaded successfully with %d mappings", len(mapping.Models))
+	setModelMapping(mapping, modTime)
+	DebugLog("Model mapping loaded successfully with %d mappings (%d patterns)", len(mapping.Models), len(mapping.patterns))
 	return nil
 }
 
+// StartModelMappingWatcher 启动model.json轮询监听，修改时间变化时自动热加载
+// 重载失败时保留原有映射；interval<=0 表示不启用，重复调用只启动一次
+func StartModelMappingWatcher(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	modelWatcherOnce.Do(func() {
+		log.Printf("Model mapping hot-reload enabled (interval: %s)", interval)
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				reloadModelMappingIfChanged()
+			}
+		}()
+	})
+}
+
+// reloadModelMappingIfChanged 检测model.json修改时间，有变化时重新加载
+func reloadModelMappingIfChanged() {
+	configPath := modelMappingPath()
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return // 文件暂不可用（如正在替换），保留现有映射
+	}
+
+	modelMappingMu.RLock()
+	lastModTime := modelMappingModTime
+	modelMappingMu.RUnlock()
+
+	if info.ModTime().Equal(lastModTime) {
+		return
+	}
+
+	mapping, err := readModelMapping(configPath)
+	if err != nil {
+		log.Printf("Warning: Failed to hot-reload model mapping, keeping previous mapping: %v", err)
+		// 记录修改时间，避免对同一份错误文件反复报错
+		modelMappingMu.Lock()
+		modelMappingModTime = info.ModTime()
+		modelMappingMu.Unlock()
+		return
+	}
+
+	setModelMapping(mapping, info.ModTime())
+	log.Printf("Model mapping hot-reloaded with %d mappings (%d patterns)", len(mapping.Models), len(mapping.patterns))
+}
+
 // MapModel 将输入模型映射为目标模型，如果没有映射则返回原模型
+// 精确匹配优先，其次按键名顺序尝试正则/通配符规则，目标值支持 $1 等捕获组替换
 func MapModel(inputModel string) string {
-	if modelMapping == nil {
-		if err := LoadModelMapping(); err != nil {
-			return inputModel
-		}
-	}
+	mapping := currentModelMapping()
+	lookupModel := NormalizeModelName(inputModel)
 
-	if targetModel, exists := modelMapping.Models[inputModel]; exists {
+	if targetModel, exists := mapping.Models[lookupModel]; exists && !IsModelPattern(lookupModel) {
 		DebugLog("Model mapping: %s -> %s", inputModel, targetModel)
 		return targetModel
 	}
 
+	for _, p := range mapping.patterns {
+		match := p.re.FindStringSubmatchIndex(lookupModel)
+		if match == nil {
+			continue
+		}
+		targetModel := string(p.re.ExpandString(nil, p.target, lookupModel, match))
+		DebugLog("Model mapping (pattern %s): %s -> %s", p.key, inputModel, targetModel)
+		return targetModel
+	}
+
+	if defaultModel := mapping.defaultModel(); defaultModel != "" {
+		if _, logged := defaultModelLogged.LoadOrStore(inputModel+"\x00"+defaultModel, true); !logged {
+			log.Printf("No mapping found for model %s, using default model %s", inputModel, defaultModel)
+		}
+		DebugLog("Model mapping (default): %s -> %s", inputModel, defaultModel)
+		return defaultModel
+	}
+
 	DebugLog("No mapping found for model: %s, using original", inputModel)
 	return inputModel
 }
 
+// defaultModel 映射未命中时的默认模型：优先model.json的default，其次环境变量
+func (m *ModelMapping) defaultModel() string {
+	if m.Default != "" {
+		return m.Default
+	}
+	return strings.TrimSpace(os.Getenv("CODEBUDDY2CC_DEFAULT_MODEL"))
+}
+
 // GetModelMappings 获取所有模型映射（用于测试和调试）
 func GetModelMappings() map[string]string {
-	if modelMapping == nil {
-		LoadModelMapping()
+	return currentModelMapping().Models
+}
+
+// ModelUpstreamURL 返回映射后模型的专属上游地址
+// CODEBUDDY2CC_UPSTREAM_MAP（格式：model1=url1,model2=url2）优先，其次model.json的upstreams，均未配置时返回false
+func ModelUpstreamURL(mappedModel string) (string, bool) {
+	for pair := range strings.SplitSeq(os.Getenv("CODEBUDDY2CC_UPSTREAM_MAP"), ",") {
+		model, url, found := strings.Cut(pair, "=")
+		if found && strings.TrimSpace(model) == mappedModel && strings.TrimSpace(url) != "" {
+			return strings.TrimSpace(url), true
+		}
+	}
+
+	if url := strings.TrimSpace(currentModelMapping().Upstreams[mappedModel]); url != "" {
+		return url, true
+	}
+	return "", false
+}
+
+// systemInjectionDisabled 映射后的模型是否配置为不注入system后缀
+func systemInjectionDisabled(mappedModel string) bool {
+	return slices.Contains(currentModelMapping().NoSystemInjection, mappedModel)
+}
+
+// GetModelMetadata 获取模型元数据，优先按客户端模型名查找，其次按映射后的模型名
+func GetModelMetadata(model string) (ModelMetadata, bool) {
+	mapping := currentModelMapping()
+	if meta, ok := mapping.Metadata[NormalizeModelName(model)]; ok {
+		return meta, true
+	}
+	if mapped := MapModel(model); mapped != model {
+		if meta, ok := mapping.Metadata[NormalizeModelName(mapped)]; ok {
+			return meta, true
+		}
+	}
+	return ModelMetadata{}, false
+}
+
+// GetUpstreamModelMetadata 获取映射后上游模型的元数据，上游模型名未配置元数据时回退到客户端模型名
+// 上下文窗口等属于上游模型的属性，客户端别名映射到不同上游模型时应以实际调用的模型为准
+func GetUpstreamModelMetadata(model string) (ModelMetadata, bool) {
+	metadata := currentModelMapping().Metadata
+	if meta, ok := metadata[NormalizeModelName(MapModel(model))]; ok {
+		return meta, true
+	}
+	meta, ok := metadata[NormalizeModelName(model)]
+	return meta, ok
+}
+
+// ModelMappingReport model.json校验结果
+type ModelMappingReport struct {
+	Path         string   `json:"path"`
+	Exists       bool     `json:"exists"`
+	Valid        bool     `json:"valid"`
+	Errors       []string `json:"errors,omitempty"`   // 解析错误、重复键
+	Warnings     []string `json:"warnings,omitempty"` // 空目标、非法正则等加载时会被忽略或修正的条目
+	MappingCount int      `json:"mapping_count"`
+	PatternCount int      `json:"pattern_count"`
+}
+
+// CheckModelMapping 从磁盘重新读取并校验model.json，不替换当前生效的映射
+func CheckModelMapping() ModelMappingReport {
+	report := ModelMappingReport{Path: modelMappingPath(), Valid: true}
+
+	data, err := os.ReadFile(report.Path)
+	if os.IsNotExist(err) {
+		return report // 文件不存在时按原样透传模型，属于合法配置
+	}
+	report.Exists = true
+	if err != nil {
+		report.Valid = false
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+
+	// 重复键：解析时后者静默覆盖前者，通常是编辑失误
+	for _, dup := range duplicateJSONKeys(data) {
+		report.Errors = append(report.Errors, "duplicate key: "+dup)
+	}
+
+	// 空目标在加载时会被修正，需在修正前检查原始内容
+	var raw struct {
+		Models map[string]string `json:"models"`
+	}
+	if err := FastUnmarshal(data, &raw); err == nil {
+		for key, target := range raw.Models {
+			if strings.TrimSpace(target) == "" {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("models[%q] has an empty target", key))
+			}
+			if IsModelPattern(key) {
+				if _, err := compileModelPattern(key); err != nil {
+					report.Warnings = append(report.Warnings, fmt.Sprintf("models[%q] is an invalid pattern and will be skipped: %v", key, err))
+				}
+			}
+		}
+	}
+
+	mapping, err := readModelMapping(report.Path)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	} else {
+		report.MappingCount = len(mapping.Models)
+		report.PatternCount = len(mapping.patterns)
+	}
+
+	slices.Sort(report.Warnings)
+	report.Valid = len(report.Errors) == 0
+	return report
+}
+
+// duplicateJSONKeys 返回JSON中所有对象内重复出现的键路径（如 models.claude-x），JSON格式非法时返回nil
+func duplicateJSONKeys(data []byte) []string {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var dups []string
+	if err := walkJSONKeys(dec, "", &dups); err != nil {
+		return nil
+	}
+	return dups
+}
+
+// walkJSONKeys 递归读取一个JSON值，记录对象中的重复键
+func walkJSONKeys(dec *json.Decoder, path string, dups *[]string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil
+	}
+
+	switch delim {
+	case '{':
+		seen := make(map[string]bool)
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := keyTok.(string)
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			if seen[key] {
+				*dups = append(*dups, keyPath)
+			}
+			seen[key] = true
+			if err := walkJSONKeys(dec, keyPath, dups); err != nil {
+				return err
+			}
+		}
+	case '[':
+		for i := 0; dec.More(); i++ {
+			if err := walkJSONKeys(dec, fmt.Sprintf("%s[%d]", path, i), dups); err != nil {
+				return err
+			}
+		}
 	}
-	return modelMapping.Models
+	// 读取结束分隔符
+	_, err = dec.Token()
+	return err
 }
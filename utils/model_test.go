@@ -0,0 +1,37 @@
+package utils
+
+import "testing"
+
+func TestLoadModelMappingFixesEmptyTargets(t *testing.T) {
+	t.Setenv("CODEBUDDY2CC_DEFAULT_MODEL", "")
+	useModelMapping(t, `{
+		"models": {
+			"claude-empty": "",
+			"claude-blank": "   ",
+			"gpt-*": "",
+			"claude-ok": "upstream-ok"
+		}
+	}`)
+
+	mappings := GetModelMappings()
+	for _, key := range []string{"claude-empty", "claude-blank"} {
+		if got := mappings[key]; got != key {
+			t.Errorf("loaded mapping %q = %q, want identity", key, got)
+		}
+	}
+	if _, ok := mappings["gpt-*"]; ok {
+		t.Errorf("pattern with an empty target was kept: %v", mappings)
+	}
+
+	tests := map[string]string{
+		"claude-empty": "claude-empty",
+		"claude-blank": "claude-blank",
+		"gpt-4o":       "gpt-4o",
+		"claude-ok":    "upstream-ok",
+	}
+	for input, want := range tests {
+		if got := MapModel(input); got != want {
+			t.Errorf("MapModel(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
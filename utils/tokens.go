@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"unicode/utf8"
+)
+
+// EstimateInputTokens 粗略估算请求的输入token数（用于本地预检，非精确计数）
+// 按序列化后的消息和工具定义字符数估算，约4个字符折合1个token
+func EstimateInputTokens(req *AnthropicRequest) int {
+	chars := 0
+	if data, err := FastMarshal(req.Messages); err == nil {
+		chars += utf8.RuneCount(data)
+	}
+	if req.System != nil {
+		if data, err := FastMarshal(req.System); err == nil {
+			chars += utf8.RuneCount(data)
+		}
+	}
+	if len(req.Tools) > 0 {
+		if data, err := FastMarshal(req.Tools); err == nil {
+			chars += utf8.RuneCount(data)
+		}
+	}
+	return (chars + 3) / 4
+}